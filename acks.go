@@ -0,0 +1,64 @@
+package incus
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	AckDelivered = "delivered"
+	AckExpired   = "expired"
+
+	ackWebhookTimeout = 10 * time.Second
+)
+
+var ackWebhookClient = &http.Client{Timeout: ackWebhookTimeout}
+
+// What ack_callback reports for each message sent to a user: delivered once
+// the user acknowledges it, or expired if ack_timeout passes first.
+type ackReport struct {
+	UID    string `json:"user"`
+	ID     int64  `json:"id"`
+	Event  string `json:"event"`
+	Status string `json:"status"`
+	Time   int64  `json:"time"`
+}
+
+func (this *Server) reportAck(ack *pendingAck, status string) {
+	report := &ackReport{
+		UID:    ack.UID,
+		ID:     ack.Message.ID,
+		Event:  ack.Message.Event,
+		Status: status,
+		Time:   time.Now().UTC().Unix(),
+	}
+
+	report_str, _ := json.Marshal(report)
+	options := this.runtimeOptions()
+
+	switch options.AckCallback {
+	case "redis":
+		if this.Store.bus == nil {
+			this.Log.Warn("Could not push to ack_callback_queue since neither redis nor nats is enabled")
+			return
+		}
+
+		this.Store.bus.Push(options.AckCallbackQueue, string(report_str))
+
+	case "webhook":
+		go func() {
+			resp, err := ackWebhookClient.Post(options.AckCallbackURL, "application/json", bytes.NewReader(report_str))
+			if err != nil {
+				this.Log.Error("Error reporting ack", "status", status, "uid", ack.UID, "error", err)
+				return
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				this.Log.Error("Error reporting ack", "status", status, "uid", ack.UID, "error", "webhook returned "+resp.Status)
+			}
+		}()
+	}
+}
@@ -0,0 +1,106 @@
+package incus
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestAckStore() *Storage {
+	store := newTestHistoryStore(0)
+	store.acksEnabled = true
+	store.ackTimeout = time.Minute
+
+	return store
+}
+
+func TestAcks(t *testing.T) {
+	store := newTestAckStore()
+
+	for _, event := range []string{"one", "two", "three"} {
+		msg := &Message{Event: event}
+		store.AssignMessageID(msg, "")
+		store.AddPendingAck("TEST", "", msg)
+	}
+
+	pending, _ := store.PendingAcks("TEST")
+	if len(pending) != 3 || pending[0].Message.ID != 1 || pending[2].Message.Event != "three" {
+		t.Fatalf("Expected three pending messages in order, instead %+v", pending)
+	}
+
+	ack, _ := store.Ack("TEST", 2)
+	if ack == nil || ack.Message.Event != "two" {
+		t.Fatalf("Expected acking message 2 to return it, instead %+v", ack)
+	}
+	if ack, _ := store.Ack("TEST", 2); ack != nil {
+		t.Fatalf("Expected acking message 2 twice to return nothing, instead %+v", ack)
+	}
+	if ack, _ := store.Ack("OTHER", 1); ack != nil {
+		t.Fatalf("Expected a different user's ack to return nothing, instead %+v", ack)
+	}
+
+	expired, _ := store.ExpireAcks(time.Now().Add(2 * time.Minute))
+	if len(expired) != 2 {
+		t.Fatalf("Expected the two unacked messages to expire, instead %+v", expired)
+	}
+	if pending, _ := store.PendingAcks("TEST"); len(pending) != 0 {
+		t.Fatalf("Expected nothing pending after expiry, instead %+v", pending)
+	}
+}
+
+func TestReportAckWebhook(t *testing.T) {
+	reports := make(chan ackReport, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report ackReport
+		json.NewDecoder(r.Body).Decode(&report)
+		reports <- report
+	}))
+	defer hook.Close()
+
+	server := &Server{Store: newTestAckStore(), Stats: &DiscardStats{}}
+	server.options.AckCallback = "webhook"
+	server.options.AckCallbackURL = hook.URL
+	server.reportAck(&pendingAck{UID: "TEST", Message: &Message{ID: 7, Event: "foo"}}, AckDelivered)
+
+	select {
+	case report := <-reports:
+		if report.UID != "TEST" || report.ID != 7 || report.Event != "foo" || report.Status != AckDelivered {
+			t.Fatalf("Unexpected report %+v", report)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the webhook to be called")
+	}
+}
+
+func TestMessagePendingOnce(t *testing.T) {
+	server := &Server{Store: newTestAckStore(), Stats: &DiscardStats{}}
+	message := map[string]interface{}{"event": "foo", "data": map[string]interface{}{}}
+
+	entered := &CommandMsg{Command: map[string]string{"command": "message", "user": "TEST"}, Message: message}
+	entered.record(server)
+
+	var received CommandMsg
+	data, _ := json.Marshal(entered)
+	json.Unmarshal(data, &received)
+	received.sendMessage(server)
+
+	if pending, _ := server.Store.PendingAcks("TEST"); len(pending) != 1 || pending[0].Message.ID != entered.MessageID {
+		t.Fatalf("Expected one pending ack with the recorded ID, instead %+v", pending)
+	}
+
+	broadcast := &CommandMsg{Command: map[string]string{"command": "message", "user": "TEST"}, Message: message, broadcast: true}
+	broadcast.sendMessage(server)
+
+	if pending, _ := server.Store.PendingAcks("TEST"); len(pending) != 1 {
+		t.Fatalf("Expected a node without the user's sockets to keep nothing, instead %+v", pending)
+	}
+
+	server.Store.Save(newSocket(nil, httptest.NewRecorder(), server, "TEST"))
+	broadcast.sendMessage(server)
+
+	if pending, _ := server.Store.PendingAcks("TEST"); len(pending) != 2 {
+		t.Fatalf("Expected the node delivering the message to keep it, instead %+v", pending)
+	}
+}
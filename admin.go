@@ -0,0 +1,216 @@
+package incus
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+type adminSocket struct {
+	SID        string    `json:"sid"`
+	UID        string    `json:"uid"`
+	Page       string    `json:"page,omitempty"`
+	Topics     []string  `json:"topics,omitempty"`
+	Transport  string    `json:"transport"`
+	RemoteAddr string    `json:"remote_addr"`
+	Connected  time.Time `json:"connected_at"`
+	Queued     int       `json:"queued"`
+	QueueSize  int       `json:"queue_size"`
+	Dropped    int64     `json:"dropped"`
+}
+
+type adminUser struct {
+	UID     string         `json:"uid"`
+	Sockets []*adminSocket `json:"sockets"`
+}
+
+// AdminHandler serves the admin API, which lists the users and sockets
+// connected to this node, disconnects them, sends them test messages, and
+// reloads the configuration:
+//
+//	GET    /users                 every connected user and their sockets
+//	GET    /users/<uid>           one user's sockets
+//	DELETE /users/<uid>           disconnect all of a user's sockets
+//	GET    /sockets/<sid>         one socket
+//	DELETE /sockets/<sid>         disconnect one socket
+//	POST   /sockets/<sid>/message send the Message in the body to one socket
+//	POST   /reload                re-read the config file; see Reload
+//	GET    /healthz               liveness, with uptime and goroutines
+//	GET    /readyz                readiness, with every check; see Readiness
+//
+// Every request must carry "Authorization: Bearer <token>". An empty token
+// rejects everything.
+func (this *Server) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users", this.adminUsers)
+	mux.HandleFunc("/users/", this.adminUser)
+	mux.HandleFunc("/sockets/", this.adminSocket)
+	mux.HandleFunc("/reload", this.adminReload)
+	mux.Handle("/healthz", this.LivenessHandler(true))
+	mux.Handle("/readyz", this.ReadinessHandler(this.healthThresholds, true))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !bearerTokenMatches(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, 401, "Unauthorized")
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (this *Server) adminUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, 405, "Method not allowed")
+		return
+	}
+
+	users := make(map[string]*adminUser)
+	for _, sock := range this.Store.Sockets() {
+		user, ok := users[sock.UID]
+		if !ok {
+			user = &adminUser{UID: sock.UID}
+			users[sock.UID] = user
+		}
+
+		user.Sockets = append(user.Sockets, newAdminSocket(sock))
+	}
+
+	list := make([]*adminUser, 0, len(users))
+	for _, user := range users {
+		sortAdminSockets(user.Sockets)
+		list = append(list, user)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UID < list[j].UID })
+
+	writeJSON(w, 200, list)
+}
+
+func (this *Server) adminUser(w http.ResponseWriter, r *http.Request) {
+	UID := strings.TrimPrefix(r.URL.Path, "/users/")
+
+	sockets, err := this.Store.Client(UID)
+	if err != nil || len(sockets) == 0 {
+		writeJSONError(w, 404, "User not connected")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		user := &adminUser{UID: UID}
+		for _, sock := range sockets {
+			user.Sockets = append(user.Sockets, newAdminSocket(sock))
+		}
+		sortAdminSockets(user.Sockets)
+
+		writeJSON(w, 200, user)
+
+	case "DELETE":
+		for _, sock := range sockets {
+			sock.Close()
+		}
+
+		writeJSON(w, 200, map[string]int{"disconnected": len(sockets)})
+
+	default:
+		writeJSONError(w, 405, "Method not allowed")
+	}
+}
+
+func (this *Server) adminSocket(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/sockets/")
+	SID, action := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		SID, action = path[:i], path[i+1:]
+	}
+
+	sock := this.Store.Socket(SID)
+	if sock == nil {
+		writeJSONError(w, 404, "Socket not connected")
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == "GET":
+		writeJSON(w, 200, newAdminSocket(sock))
+
+	case action == "" && r.Method == "DELETE":
+		sock.Close()
+		writeJSON(w, 200, map[string]int{"disconnected": 1})
+
+	case action == "message" && r.Method == "POST":
+		msg := new(Message)
+		if err := json.NewDecoder(r.Body).Decode(msg); err != nil || msg.Event == "" {
+			writeJSONError(w, 400, "Expected a message with an event")
+			return
+		}
+
+		if msg.Time == 0 {
+			msg.Time = time.Now().UTC().Unix()
+		}
+
+		if sock.isClosed() {
+			writeJSONError(w, 409, "Socket closed")
+			return
+		}
+
+		if !sock.send(msg) {
+			writeJSONError(w, 503, "Socket send queue full")
+			return
+		}
+
+		writeJSON(w, 200, map[string]int{"sent": 1})
+
+	case action == "" || action == "message":
+		writeJSONError(w, 405, "Method not allowed")
+
+	default:
+		writeJSONError(w, 404, "Not found")
+	}
+}
+
+func newAdminSocket(sock *Socket) *adminSocket {
+	return &adminSocket{
+		SID:        sock.SID,
+		UID:        sock.UID,
+		Page:       sock.Page,
+		Topics:     sock.Topics(),
+		Transport:  sock.Transport(),
+		RemoteAddr: sock.RemoteAddr,
+		Connected:  sock.Connected,
+		Queued:     sock.QueueLength(),
+		QueueSize:  sock.QueueSize(),
+		Dropped:    sock.Dropped(),
+	}
+}
+
+func sortAdminSockets(sockets []*adminSocket) {
+	sort.Slice(sockets, func(i, j int) bool { return sockets[i].Connected.Before(sockets[j].Connected) })
+}
+
+// bearerTokenMatches checks a request's "Authorization: Bearer <token>"
+// header against token. An empty token, or a header without the Bearer
+// scheme, matches nothing.
+func bearerTokenMatches(r *http.Request, token string) bool {
+	header := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+
+	given := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,102 @@
+package incus
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func adminRequest(t *testing.T, handler http.Handler, method, path, token, body string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	var decoded map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &decoded)
+
+	return w.Code, decoded
+}
+
+func TestAdminAPI(t *testing.T) {
+	server := &Server{Store: newTestHistoryStore(0), Stats: &DiscardStats{}}
+	handler := server.AdminHandler("sekrit")
+
+	sse := newSocket(nil, nil, server, "admin-test")
+	sse.sse = httptest.NewRecorder()
+	sse.RemoteAddr = "10.0.0.1:1234"
+	sse.Page = "/gallery"
+	sse.topics["comments"] = true
+	server.Store.Save(sse)
+
+	lp := newSocket(nil, httptest.NewRecorder(), server, "admin-test")
+	server.Store.Save(lp)
+
+	if code, _ := adminRequest(t, handler, "GET", "/users", "", ""); code != 401 {
+		t.Fatalf("Expected a request without a token to be rejected, instead %d", code)
+	}
+
+	if code, _ := adminRequest(t, handler, "GET", "/users", "not-sekrit", ""); code != 401 {
+		t.Fatalf("Expected a request with the wrong token to be rejected, instead %d", code)
+	}
+
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("Authorization", "sekrit")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != 401 {
+		t.Fatalf("Expected a token without the Bearer scheme to be rejected, instead %d", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("Authorization", "Bearer sekrit")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	var users []adminUser
+	json.Unmarshal(w.Body.Bytes(), &users)
+	if len(users) != 1 || users[0].UID != "admin-test" || len(users[0].Sockets) != 2 {
+		t.Fatalf("Expected one user with two sockets, instead %s", w.Body.String())
+	}
+
+	code, sock := adminRequest(t, handler, "GET", "/sockets/"+sse.SID, "sekrit", "")
+	if code != 200 || sock["page"] != "/gallery" || sock["remote_addr"] != "10.0.0.1:1234" || sock["transport"] != "sse" {
+		t.Fatalf("Unexpected socket %+v", sock)
+	}
+	if topics, _ := sock["topics"].([]interface{}); len(topics) != 1 || topics[0] != "comments" {
+		t.Fatalf("Expected the socket to be subscribed to comments, instead %+v", sock)
+	}
+
+	code, _ = adminRequest(t, handler, "POST", "/sockets/"+lp.SID+"/message", "sekrit", `{"event":"test","data":{"foo":"bar"}}`)
+	if code != 200 {
+		t.Fatalf("Expected the test message to be sent, instead %d", code)
+	}
+
+	msg := <-lp.buff
+	if msg.Event != "test" || msg.Data["foo"] != "bar" || msg.Time == 0 {
+		t.Fatalf("Unexpected test message %+v", msg)
+	}
+
+	if code, _ := adminRequest(t, handler, "POST", "/sockets/"+lp.SID+"/message", "sekrit", `{}`); code != 400 {
+		t.Fatalf("Expected a message without an event to be rejected, instead %d", code)
+	}
+
+	code, body := adminRequest(t, handler, "DELETE", "/sockets/"+lp.SID, "sekrit", "")
+	if code != 200 || !lp.isClosed() || sse.isClosed() {
+		t.Fatalf("Expected only the longpoll socket to be disconnected, instead %d %+v", code, body)
+	}
+
+	code, body = adminRequest(t, handler, "DELETE", "/users/admin-test", "sekrit", "")
+	if code != 200 || body["disconnected"] != float64(1) || !sse.isClosed() {
+		t.Fatalf("Expected the user's remaining socket to be disconnected, instead %d %+v", code, body)
+	}
+
+	if code, _ := adminRequest(t, handler, "GET", "/users/admin-test", "sekrit", ""); code != 404 {
+		t.Fatalf("Expected a disconnected user to be gone, instead %d", code)
+	}
+}
@@ -0,0 +1,218 @@
+package incus
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const apiMaxBodySize = 1 << 20
+
+// What came of a command: carried out, refused as invalid, or carried out
+// with a push notification failing.
+const (
+	CommandOK       = "ok"
+	CommandRejected = "rejected"
+	CommandFailed   = "failed"
+)
+
+var (
+	errMissingDeviceToken     = errors.New("Missing device_token")
+	errMissingBuild           = errors.New("Missing build")
+	errMissingRegistrationIDs = errors.New("Missing registration_ids")
+	errMissingWebPushEndpoint = errors.New("Missing webpush_endpoint")
+	errAPNSDisabled           = errors.New("APNS is not enabled")
+	errGCMDisabled            = errors.New("GCM is not enabled")
+	errWebPushDisabled        = errors.New("Web push is not enabled")
+)
+
+// CommandResult reports what came of one command on the node handling it.
+// Recipients counts the sockets on that node a message was sent to; messages
+// forwarded to the other nodes over the message bus are counted by them.
+type CommandResult struct {
+	Command    string            `json:"command"`
+	Status     string            `json:"status"`
+	Error      string            `json:"error,omitempty"`
+	Reason     string            `json:"reason,omitempty"`
+	Field      string            `json:"field,omitempty"`
+	Recipients int               `json:"recipients"`
+	Forwarded  bool              `json:"forwarded,omitempty"`
+	Push       map[string]string `json:"push,omitempty"`
+}
+
+func newRejectedResult(err *CommandError) *CommandResult {
+	return &CommandResult{
+		Command: err.Command,
+		Status:  CommandRejected,
+		Error:   err.Message,
+		Reason:  err.Reason,
+		Field:   err.Field,
+	}
+}
+
+// addPush records a push notification's outcome, "sent" or the error.
+func (this *CommandResult) addPush(platform string, err error) {
+	if this.Push == nil {
+		this.Push = make(map[string]string)
+	}
+
+	if err != nil {
+		this.Push[platform] = err.Error()
+		this.fail(err)
+		return
+	}
+
+	this.Push[platform] = "sent"
+}
+
+func (this *CommandResult) fail(err error) {
+	this.Status = CommandFailed
+	if this.Error == "" {
+		this.Error = err.Error()
+	}
+}
+
+// ListenFromAPI serves the command API on the main listener, if enabled.
+func (this *Server) ListenFromAPI() {
+	if !viper.GetBool("api_enabled") {
+		return
+	}
+
+	token := viper.GetString("api_token")
+	if token == "" {
+		this.Log.Warn("api_token is not set, the command API will reject every request")
+	}
+
+	http.Handle("/api/v1/commands", this.CommandsHandler(token, viper.GetInt("api_max_batch")))
+}
+
+// CommandsHandler accepts commands from applications over HTTP, as an
+// alternative to publishing them on the message bus:
+//
+//	POST /api/v1/commands   a command, or an array of up to maxBatch commands
+//
+// Each command has the same form as those published on the bus. A single
+// command is answered with its CommandResult, with status 400 if it was
+// rejected or 502 if a push notification failed; a batch with
+// {"results": [...]}, in order, and status 200.
+//
+// Every request must carry "Authorization: Bearer <token>". An empty token
+// rejects everything.
+func (this *Server) CommandsHandler(token string, maxBatch int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !bearerTokenMatches(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, 401, "Unauthorized")
+			return
+		}
+
+		if r.Method != "POST" {
+			writeJSONError(w, 405, "Method not allowed")
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, apiMaxBodySize))
+		if err != nil {
+			writeJSONError(w, 413, "Request body too large")
+			return
+		}
+
+		body = bytes.TrimSpace(body)
+		if len(body) > 0 && body[0] == '[' {
+			var cmds []*CommandMsg
+			if err := json.Unmarshal(body, &cmds); err != nil {
+				this.Stats.LogInvalidJSON()
+				this.Stats.LogCommandRejected(ReasonInvalidJSON)
+				writeJSON(w, 400, newRejectedResult(invalidJSON(err)))
+				return
+			}
+
+			if maxBatch > 0 && len(cmds) > maxBatch {
+				writeJSONError(w, 413, fmt.Sprintf("At most %d commands per request", maxBatch))
+				return
+			}
+
+			results := make([]*CommandResult, len(cmds))
+			for i, cmd := range cmds {
+				results[i] = this.ingest(cmd)
+			}
+
+			writeJSON(w, 200, map[string][]*CommandResult{"results": results})
+			return
+		}
+
+		cmd := new(CommandMsg)
+		if err := json.Unmarshal(body, cmd); err != nil {
+			this.Stats.LogInvalidJSON()
+			this.Stats.LogCommandRejected(ReasonInvalidJSON)
+			writeJSON(w, 400, newRejectedResult(invalidJSON(err)))
+			return
+		}
+
+		result := this.ingest(cmd)
+
+		switch result.Status {
+		case CommandRejected:
+			writeJSON(w, 400, result)
+		case CommandFailed:
+			writeJSON(w, 502, result)
+		default:
+			writeJSON(w, 200, result)
+		}
+	})
+}
+
+// ingest carries out a command from the API. With a message bus, messages
+// for sockets are sent across the cluster as if published on it, while push
+// notifications are sent from this node alone.
+func (this *Server) ingest(cmd *CommandMsg) *CommandResult {
+	this.commandStarted()
+	defer this.commandDone()
+
+	if cmd == nil {
+		cmd = new(CommandMsg)
+	}
+
+	parsed, err := cmd.parseAppCommand()
+	if err != nil {
+		this.Stats.LogCommandRejected(err.Reason)
+		return newRejectedResult(err)
+	}
+
+	command := strings.ToLower(cmd.Command["command"])
+
+	if this.Store.bus == nil || (command != "message" && command != "pushormessage") {
+		return cmd.Handle(this, "api")
+	}
+
+	this.Stats.LogCommand("api", command)
+
+	result := &CommandResult{Command: command, Status: CommandOK}
+
+	if pushOrMessage, ok := parsed.(*PushOrMessageCommand); ok {
+		active, err := this.Store.IsUserActive(pushOrMessage.User)
+		if err != nil {
+			this.Log.Error("Error fetching whether user was active", "uid", pushOrMessage.User, "error", err)
+			result.fail(err)
+			return result
+		}
+
+		if !active {
+			pushOrMessage.push(this, result)
+			return result
+		}
+
+		cmd = pushOrMessage.messageCommand()
+	}
+
+	cmd.forwardToRedis(this)
+	result.Forwarded = true
+
+	return result
+}
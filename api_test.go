@@ -0,0 +1,131 @@
+package incus
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCommandsAPI(t *testing.T) {
+	server := &Server{Store: newTestHistoryStore(0), Stats: &DiscardStats{}}
+	handler := server.CommandsHandler("sekrit", 3)
+
+	sock := newSocket(nil, httptest.NewRecorder(), server, "api-test")
+	server.Store.Save(sock)
+
+	request := func(method, token, body string) (int, []byte) {
+		req := httptest.NewRequest(method, "/api/v1/commands", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		return w.Code, w.Body.Bytes()
+	}
+
+	message := `{"command": {"command": "message", "user": "api-test"}, "message": {"event": "hi", "data": {}}}`
+
+	if code, _ := request("POST", "", message); code != 401 {
+		t.Fatalf("Expected a request without a token to be rejected, instead %d", code)
+	}
+
+	if code, _ := request("GET", "sekrit", ""); code != 405 {
+		t.Fatalf("Expected GET to be refused, instead %d", code)
+	}
+
+	code, body := request("POST", "sekrit", message)
+	var result CommandResult
+	json.Unmarshal(body, &result)
+	if code != 200 || result.Status != CommandOK || result.Recipients != 1 {
+		t.Fatalf("Expected the message to reach one socket, instead %d %s", code, body)
+	}
+
+	select {
+	case msg := <-sock.buff:
+		if msg.Event != "hi" {
+			t.Errorf("Expected event hi, got %s", msg.Event)
+		}
+	default:
+		t.Errorf("Expected the message to be queued for the socket")
+	}
+
+	code, body = request("POST", "sekrit", `{"command": {"command": "message", "user": "api-test"}, "message": {"data": {}}}`)
+	json.Unmarshal(body, &result)
+	if code != 400 || result.Status != CommandRejected || result.Reason != ReasonMissingField || result.Field != "event" {
+		t.Errorf("Expected a message without an event to be rejected, instead %d %s", code, body)
+	}
+
+	code, body = request("POST", "sekrit", `[
+		`+message+`,
+		{"command": {"command": "explode"}},
+		{"command": {"command": "pushios", "device_token": "abc", "build": "store"}, "message": {"event": "hi", "data": {}}}
+	]`)
+
+	var batch struct {
+		Results []*CommandResult `json:"results"`
+	}
+	json.Unmarshal(body, &batch)
+	if code != 200 || len(batch.Results) != 3 {
+		t.Fatalf("Expected three results, instead %d %s", code, body)
+	}
+
+	if batch.Results[0].Status != CommandOK || batch.Results[0].Recipients != 1 {
+		t.Errorf("Expected the message to be sent, got %+v", batch.Results[0])
+	}
+
+	if batch.Results[1].Status != CommandRejected || batch.Results[1].Reason != ReasonUnknownCommand {
+		t.Errorf("Expected the unknown command to be rejected, got %+v", batch.Results[1])
+	}
+
+	if batch.Results[2].Status != CommandFailed || batch.Results[2].Push["ios"] != errAPNSDisabled.Error() {
+		t.Errorf("Expected the push to fail with APNS disabled, got %+v", batch.Results[2])
+	}
+
+	if code, _ := request("POST", "sekrit", "["+strings.Repeat(message+",", 3)+message+"]"); code != 413 {
+		t.Errorf("Expected a batch over the limit to be refused, instead %d", code)
+	}
+
+	code, body = request("POST", "sekrit", "{")
+	result = CommandResult{}
+	json.Unmarshal(body, &result)
+	if code != 400 || result.Reason != ReasonInvalidJSON {
+		t.Errorf("Expected invalid JSON to be refused, instead %d %s", code, body)
+	}
+}
+
+func TestCommandsAPIPushOrMessage(t *testing.T) {
+	bus := &fakeBus{}
+	store := newTestHistoryStore(0)
+	store.bus = bus
+	server := &Server{Store: store, Stats: &DiscardStats{}}
+
+	command := `{"command": {"command": "pushormessage", "user": "api-test", "webpush_endpoint": "https://push.example.com/1"},
+		"message": {"websocket": {"event": "hi", "data": {}}, "push": {"web": {"event": "hi", "data": {}}}}}`
+
+	// An inactive user is sent push notifications from this node alone.
+	cmd := new(CommandMsg)
+	json.Unmarshal([]byte(command), cmd)
+	result := server.ingest(cmd)
+	if result.Forwarded || result.Push["web"] != errWebPushDisabled.Error() || len(bus.published) != 0 {
+		t.Fatalf("Expected the push to be sent here and fail, instead %+v, published %v", result, bus.published)
+	}
+
+	// An active user's websocket message is sent across the cluster.
+	store.Save(newSocket(nil, httptest.NewRecorder(), server, "api-test"))
+
+	cmd = new(CommandMsg)
+	json.Unmarshal([]byte(command), cmd)
+	result = server.ingest(cmd)
+	if !result.Forwarded || result.Push != nil || len(bus.published) != 1 {
+		t.Fatalf("Expected the message to be forwarded, instead %+v, published %v", result, bus.published)
+	}
+
+	var forwarded CommandMsg
+	json.Unmarshal([]byte(bus.published[0]), &forwarded)
+	if forwarded.Command["command"] != "message" || forwarded.Command["user"] != "api-test" || forwarded.Message["event"] != "hi" {
+		t.Fatalf("Expected a message command for the user, instead %s", bus.published[0])
+	}
+}
@@ -0,0 +1,213 @@
+package incus
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	apns "github.com/anachronistic/apns"
+)
+
+const (
+	// Apple rejects provider tokens older than an hour, and throttles
+	// providers that refresh them more often than every 20 minutes.
+	apnsTokenLifetime  = 50 * time.Minute
+	apnsRequestTimeout = 10 * time.Second
+)
+
+// APNSHeaders are the per-notification options of the APNs HTTP/2 API that
+// don't fit in a legacy apns.PushNotification.
+type APNSHeaders struct {
+	Topic      string // apns-topic, usually the app's bundle id
+	PushType   string // apns-push-type: alert, background, voip, ...
+	CollapseID string // apns-collapse-id
+}
+
+// APNSTokenSigner mints the ES256 provider tokens used to authenticate with
+// APNs, from a .p8 key downloaded from Apple's developer portal.
+type APNSTokenSigner struct {
+	keyID  string
+	teamID string
+	key    *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	token  string
+	issued time.Time
+	now    func() time.Time
+}
+
+func NewAPNSTokenSigner(keyFile, keyID, teamID string) (*APNSTokenSigner, error) {
+	contents, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in APNs auth key %s", keyFile)
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse APNs auth key %s: %s", keyFile, err.Error())
+	}
+
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("APNs auth key %s is not an ECDSA key", keyFile)
+	}
+
+	return &APNSTokenSigner{keyID: keyID, teamID: teamID, key: key, now: time.Now}, nil
+}
+
+// Token returns the current provider token, minting a new one when it is
+// close to expiring.
+func (this *APNSTokenSigner) Token() (string, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := this.now()
+	if this.token != "" && now.Sub(this.issued) < apnsTokenLifetime {
+		return this.token, nil
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": this.keyID})
+	claims, _ := json.Marshal(map[string]interface{}{"iss": this.teamID, "iat": now.Unix()})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, this.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	// JWS wants the raw, fixed width r || s rather than ASN.1.
+	size := (this.key.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*size)
+	r.FillBytes(signature[:size])
+	s.FillBytes(signature[size:])
+
+	this.token = signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	this.issued = now
+
+	return this.token, nil
+}
+
+// APNSHTTP2Client sends notifications through the APNs HTTP/2 provider API
+// using token authentication. It satisfies apns.APNSClient, so it can be
+// returned from the server's apnsProvider in place of the legacy client.
+type APNSHTTP2Client struct {
+	url    string
+	topic  string
+	signer *APNSTokenSigner
+	client *http.Client
+}
+
+type apnsErrorResponse struct {
+	Reason    string `json:"reason"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// NewAPNSHTTP2Client returns a client for the APNs server at url, such as
+// https://api.push.apple.com. If client is nil a default HTTP/2 capable
+// client is used.
+func NewAPNSHTTP2Client(url, topic string, signer *APNSTokenSigner, client *http.Client) *APNSHTTP2Client {
+	if client == nil {
+		client = &http.Client{
+			Timeout:   apnsRequestTimeout,
+			Transport: &http.Transport{ForceAttemptHTTP2: true},
+		}
+	}
+
+	return &APNSHTTP2Client{url: url, topic: topic, signer: signer, client: client}
+}
+
+func (this *APNSHTTP2Client) Send(pn *apns.PushNotification) *apns.PushNotificationResponse {
+	return this.SendWithHeaders(pn, APNSHeaders{})
+}
+
+// ConnectAndWrite belongs to the legacy binary protocol, which has no
+// equivalent over HTTP/2.
+func (this *APNSHTTP2Client) ConnectAndWrite(resp *apns.PushNotificationResponse, payload []byte) error {
+	return errors.New("ConnectAndWrite is not supported by the APNs HTTP/2 client")
+}
+
+func (this *APNSHTTP2Client) SendWithHeaders(pn *apns.PushNotification, headers APNSHeaders) *apns.PushNotificationResponse {
+	resp := &apns.PushNotificationResponse{}
+
+	payload, err := pn.PayloadJSON()
+	if err != nil {
+		resp.Error = err
+		return resp
+	}
+
+	token, err := this.signer.Token()
+	if err != nil {
+		resp.Error = err
+		return resp
+	}
+
+	req, err := http.NewRequest("POST", this.url+"/3/device/"+pn.DeviceToken, bytes.NewReader(payload))
+	if err != nil {
+		resp.Error = err
+		return resp
+	}
+
+	topic := headers.Topic
+	if topic == "" {
+		topic = this.topic
+	}
+
+	pushType := headers.PushType
+	if pushType == "" {
+		pushType = "alert"
+	}
+
+	req.Header.Set("authorization", "bearer "+token)
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("apns-push-type", pushType)
+	req.Header.Set("apns-priority", strconv.Itoa(int(pn.Priority)))
+	req.Header.Set("apns-expiration", strconv.FormatUint(uint64(pn.Expiry), 10))
+	if topic != "" {
+		req.Header.Set("apns-topic", topic)
+	}
+	if headers.CollapseID != "" {
+		req.Header.Set("apns-collapse-id", headers.CollapseID)
+	}
+
+	httpResp, err := this.client.Do(req)
+	if err != nil {
+		resp.Error = err
+		return resp
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode == http.StatusOK {
+		resp.Success = true
+		resp.AppleResponse = httpResp.Header.Get("apns-id")
+		return resp
+	}
+
+	var apnsErr apnsErrorResponse
+	json.NewDecoder(httpResp.Body).Decode(&apnsErr)
+	if apnsErr.Reason == "" {
+		apnsErr.Reason = httpResp.Status
+	}
+
+	resp.AppleResponse = apnsErr.Reason
+	resp.Error = fmt.Errorf("APNs rejected notification (%d): %s", httpResp.StatusCode, apnsErr.Reason)
+
+	return resp
+}
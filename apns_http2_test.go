@@ -0,0 +1,175 @@
+package incus
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	apns "github.com/anachronistic/apns"
+)
+
+func newTestAPNSSigner(t *testing.T) (*APNSTokenSigner, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	keyFile, _ := ioutil.TempFile("", "incus-apns")
+	defer os.Remove(keyFile.Name())
+	pem.Encode(keyFile, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	keyFile.Close()
+
+	signer, err := NewAPNSTokenSigner(keyFile.Name(), "KEYID12345", "TEAMID1234")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	return signer, key
+}
+
+func verifyTestAPNSToken(t *testing.T, key *ecdsa.PrivateKey, authorization string) {
+	parts := strings.Split(strings.TrimPrefix(authorization, "bearer "), ".")
+	if len(parts) != 3 {
+		t.Fatalf("Expected a bearer JWT, instead %q", authorization)
+	}
+
+	var header map[string]string
+	headerJSON, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	json.Unmarshal(headerJSON, &header)
+	if header["alg"] != "ES256" || header["kid"] != "KEYID12345" {
+		t.Fatalf("Unexpected token header %+v", header)
+	}
+
+	var claims map[string]interface{}
+	claimsJSON, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(claimsJSON, &claims)
+	if claims["iss"] != "TEAMID1234" {
+		t.Fatalf("Unexpected token claims %+v", claims)
+	}
+
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+		t.Fatalf("Provider token signature did not verify")
+	}
+}
+
+func TestAPNSHTTP2(t *testing.T) {
+	signer, key := newTestAPNSSigner(t)
+
+	var requests []*http.Request
+	var bodies []map[string]interface{}
+
+	// A stand-in for api.push.apple.com
+	apple := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, r)
+		bodies = append(bodies, body)
+
+		if r.URL.Path == "/3/device/baddevice" {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"reason":"BadDeviceToken"}`))
+			return
+		}
+
+		w.Header().Set("apns-id", "eabeae54-14a8-11e5-b60b-1697f925ec7b")
+	}))
+	apple.EnableHTTP2 = true
+	apple.StartTLS()
+	defer apple.Close()
+
+	client := NewAPNSHTTP2Client(apple.URL, "com.example.app", signer, apple.Client())
+
+	server := &Server{
+		Stats:        &DiscardStats{},
+		apnsProvider: func(build string) apns.APNSClient { return client },
+	}
+
+	msg := new(CommandMsg)
+	json.Unmarshal([]byte(`{
+		"command": {
+			"command": "push",
+			"push_type": "ios",
+			"build": "store",
+			"device_token": "123456",
+			"apns_priority": "5",
+			"apns_expiration": "1700000000",
+			"apns_collapse_id": "gallery-abc",
+			"apns_push_type": "background"
+		},
+		"message": {
+			"event": "foobaz",
+			"data": {
+				"message_text": "foobar"
+			},
+			"time": 1234
+		}
+	}`), &msg)
+
+	msg.FromRedis(server)
+
+	if len(requests) != 1 {
+		t.Fatalf("Expected one request to APNs, instead %d", len(requests))
+	}
+
+	req := requests[0]
+	if req.ProtoMajor != 2 {
+		t.Fatalf("Expected an HTTP/2 request, instead %s", req.Proto)
+	}
+
+	if req.URL.Path != "/3/device/123456" {
+		t.Fatalf("Expected path /3/device/123456, instead %s", req.URL.Path)
+	}
+
+	for header, expected := range map[string]string{
+		"apns-topic":       "com.example.app",
+		"apns-priority":    "5",
+		"apns-expiration":  "1700000000",
+		"apns-collapse-id": "gallery-abc",
+		"apns-push-type":   "background",
+	} {
+		if req.Header.Get(header) != expected {
+			t.Fatalf("Expected %s to be %q, instead %q", header, expected, req.Header.Get(header))
+		}
+	}
+
+	verifyTestAPNSToken(t, key, req.Header.Get("authorization"))
+
+	aps, _ := bodies[0]["aps"].(map[string]interface{})
+	if aps["alert"] != "foobar" {
+		t.Fatalf("Expected push alert to be \"foobar\", instead %+v", bodies[0])
+	}
+
+	pn := apns.NewPushNotification()
+	pn.DeviceToken = "baddevice"
+	pn.AddPayload(apns.NewPayload())
+
+	resp := client.Send(pn)
+	if resp.Success || resp.Error == nil || resp.AppleResponse != "BadDeviceToken" {
+		t.Fatalf("Expected BadDeviceToken error, instead %+v", resp)
+	}
+
+	if requests[1].Header.Get("apns-push-type") != "alert" || requests[1].Header.Get("apns-priority") != "10" {
+		t.Fatalf("Expected default alert push type and priority 10, instead %+v", requests[1].Header)
+	}
+
+	if requests[0].Header.Get("authorization") != requests[1].Header.Get("authorization") {
+		t.Fatalf("Expected the provider token to be reused between requests")
+	}
+}
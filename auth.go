@@ -0,0 +1,368 @@
+package incus
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Tokens are accepted for this long past their expiry to absorb clock drift
+// between the application minting them and Incus.
+const authClockSkew = 30 * time.Second
+
+var (
+	errMissingUser   = errors.New("Error on Authenticate: Bad Input.\n")
+	errMissingToken  = errors.New("Error on Authenticate: Token Expected.\n")
+	errInvalidToken  = errors.New("Error on Authenticate: Invalid Token.\n")
+	errExpiredToken  = errors.New("Error on Authenticate: Token Expired.\n")
+	errUserMismatch  = errors.New("Error on Authenticate: Token does not match user.\n")
+	errUnknownSigner = errors.New("Error on Authenticate: Unknown signing key.\n")
+)
+
+// An Authenticator turns the credentials a client presents on connect into
+// the UID its socket will be registered under. The user argument is the
+// optional UID the client claims; implementations that verify tokens must
+// reject a claimed user that does not match the token.
+type Authenticator interface {
+	Authenticate(user, token string) (string, error)
+}
+
+// NewAuthenticator builds the Authenticator selected by the auth_type config option.
+func NewAuthenticator() (Authenticator, error) {
+	switch strings.ToLower(viper.GetString("auth_type")) {
+	case "", "uid":
+		return &UIDAuthenticator{}, nil
+
+	case "hmac":
+		return NewHMACAuthenticator(viper.GetString("auth_hmac_secret"))
+
+	case "jwt":
+		return NewJWTAuthenticator(
+			viper.GetString("auth_jwt_secret"),
+			viper.GetString("auth_jwt_jwks_file"),
+			viper.GetString("auth_jwt_user_claim"),
+			viper.GetString("auth_jwt_issuer"),
+			viper.GetString("auth_jwt_audience"),
+		)
+	}
+
+	return nil, fmt.Errorf("Unknown auth_type %q", viper.GetString("auth_type"))
+}
+
+// UIDAuthenticator trusts whatever UID the client sends. This is the
+// historical behaviour, where the UID itself acts as a shared secret.
+type UIDAuthenticator struct{}
+
+func (this *UIDAuthenticator) Authenticate(user, token string) (string, error) {
+	if user == "" {
+		return "", errMissingUser
+	}
+
+	return user, nil
+}
+
+// HMACAuthenticator verifies tokens of the form
+//
+//	base64url(UID) "." expiry "." hex(HMAC-SHA256(secret, base64url(UID) "." expiry))
+//
+// where expiry is a unix timestamp in seconds.
+type HMACAuthenticator struct {
+	secret []byte
+	now    func() time.Time
+}
+
+func NewHMACAuthenticator(secret string) (*HMACAuthenticator, error) {
+	if secret == "" {
+		return nil, errors.New("auth_hmac_secret must be set when auth_type is hmac")
+	}
+
+	return &HMACAuthenticator{secret: []byte(secret), now: time.Now}, nil
+}
+
+// Sign mints a token for UID that expires at expiry. It is the reference
+// implementation for applications issuing tokens to their clients.
+func (this *HMACAuthenticator) Sign(UID string, expiry time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(UID)) + "." + strconv.FormatInt(expiry.Unix(), 10)
+
+	return payload + "." + hex.EncodeToString(this.mac(payload))
+}
+
+func (this *HMACAuthenticator) Authenticate(user, token string) (string, error) {
+	if token == "" {
+		return "", errMissingToken
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errInvalidToken
+	}
+
+	signature, err := hex.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, this.mac(parts[0]+"."+parts[1])) {
+		return "", errInvalidToken
+	}
+
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", errInvalidToken
+	}
+
+	if this.now().After(time.Unix(expiry, 0).Add(authClockSkew)) {
+		return "", errExpiredToken
+	}
+
+	UID, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(UID) == 0 {
+		return "", errInvalidToken
+	}
+
+	return checkClaimedUser(user, string(UID))
+}
+
+func (this *HMACAuthenticator) mac(payload string) []byte {
+	mac := hmac.New(sha256.New, this.secret)
+	mac.Write([]byte(payload))
+
+	return mac.Sum(nil)
+}
+
+// JWTAuthenticator verifies compact JWS tokens signed with HS256 using a
+// shared secret, or RS256 using a key from a local JWKS file.
+type JWTAuthenticator struct {
+	secret    []byte
+	keys      map[string]*rsa.PublicKey
+	userClaim string
+	issuer    string
+	audience  string
+	now       func() time.Time
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwks struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		Alg string `json:"alg"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+func NewJWTAuthenticator(secret, jwksFile, userClaim, issuer, audience string) (*JWTAuthenticator, error) {
+	if secret == "" && jwksFile == "" {
+		return nil, errors.New("auth_jwt_secret or auth_jwt_jwks_file must be set when auth_type is jwt")
+	}
+
+	if userClaim == "" {
+		userClaim = "sub"
+	}
+
+	auth := &JWTAuthenticator{
+		secret:    []byte(secret),
+		keys:      make(map[string]*rsa.PublicKey),
+		userClaim: userClaim,
+		issuer:    issuer,
+		audience:  audience,
+		now:       time.Now,
+	}
+
+	if jwksFile != "" {
+		if err := auth.loadJWKS(jwksFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return auth, nil
+}
+
+func (this *JWTAuthenticator) loadJWKS(path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var set jwks
+	if err := json.Unmarshal(contents, &set); err != nil {
+		return fmt.Errorf("Could not parse JWKS file %s: %s", path, err.Error())
+	}
+
+	for _, key := range set.Keys {
+		if key.Kty != "RSA" || (key.Use != "" && key.Use != "sig") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return fmt.Errorf("Bad modulus for key %q in %s", key.Kid, path)
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return fmt.Errorf("Bad exponent for key %q in %s", key.Kid, path)
+		}
+
+		this.keys[key.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	if len(this.keys) == 0 {
+		return fmt.Errorf("No RSA signing keys found in %s", path)
+	}
+
+	return nil
+}
+
+func (this *JWTAuthenticator) Authenticate(user, token string) (string, error) {
+	if token == "" {
+		return "", errMissingToken
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errInvalidToken
+	}
+
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return "", errInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errInvalidToken
+	}
+
+	if err := this.verify(header, parts[0]+"."+parts[1], signature); err != nil {
+		return "", err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return "", errInvalidToken
+	}
+
+	if err := this.validateClaims(claims); err != nil {
+		return "", err
+	}
+
+	UID, ok := claims[this.userClaim].(string)
+	if !ok || UID == "" {
+		return "", errInvalidToken
+	}
+
+	return checkClaimedUser(user, UID)
+}
+
+func (this *JWTAuthenticator) verify(header jwtHeader, signed string, signature []byte) error {
+	switch header.Alg {
+	case "HS256":
+		if len(this.secret) == 0 {
+			return errUnknownSigner
+		}
+
+		mac := hmac.New(sha256.New, this.secret)
+		mac.Write([]byte(signed))
+		if subtle.ConstantTimeCompare(signature, mac.Sum(nil)) != 1 {
+			return errInvalidToken
+		}
+
+		return nil
+
+	case "RS256":
+		key, ok := this.keys[header.Kid]
+		if !ok {
+			return errUnknownSigner
+		}
+
+		digest := sha256.Sum256([]byte(signed))
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return errInvalidToken
+		}
+
+		return nil
+	}
+
+	return errInvalidToken
+}
+
+func (this *JWTAuthenticator) validateClaims(claims map[string]interface{}) error {
+	now := this.now()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errInvalidToken
+	}
+
+	if now.After(time.Unix(int64(exp), 0).Add(authClockSkew)) {
+		return errExpiredToken
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(authClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return errInvalidToken
+	}
+
+	if this.issuer != "" && claims["iss"] != this.issuer {
+		return errInvalidToken
+	}
+
+	if this.audience != "" && !jwtHasAudience(claims["aud"], this.audience) {
+		return errInvalidToken
+	}
+
+	return nil
+}
+
+func jwtHasAudience(aud interface{}, audience string) bool {
+	switch audT := aud.(type) {
+	case string:
+		return audT == audience
+	case []interface{}:
+		for _, a := range audT {
+			if a == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(decoded, v)
+}
+
+// checkClaimedUser allows a client to omit its UID when presenting a token,
+// but not to present someone else's token under its own UID.
+func checkClaimedUser(claimed, UID string) (string, error) {
+	if claimed != "" && claimed != UID {
+		return "", errUserMismatch
+	}
+
+	return UID, nil
+}
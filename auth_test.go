@@ -0,0 +1,171 @@
+package incus
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHMACAuthenticator(t *testing.T) {
+	auth, err := NewHMACAuthenticator("sekrit")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	token := auth.Sign("foo.bar", time.Now().Add(time.Minute))
+
+	UID, err := auth.Authenticate("", token)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if UID != "foo.bar" {
+		t.Fatalf("Expected UID to be foo.bar, instead %s", UID)
+	}
+
+	if _, err := auth.Authenticate("baz", token); err != errUserMismatch {
+		t.Fatalf("Expected a token for foo.bar to be rejected for baz, instead %v", err)
+	}
+
+	forged, _ := NewHMACAuthenticator("not-sekrit")
+	if _, err := auth.Authenticate("", forged.Sign("foo.bar", time.Now().Add(time.Minute))); err != errInvalidToken {
+		t.Fatalf("Expected a forged token to be rejected, instead %v", err)
+	}
+
+	if _, err := auth.Authenticate("", auth.Sign("foo.bar", time.Now().Add(-time.Hour))); err != errExpiredToken {
+		t.Fatalf("Expected an expired token to be rejected, instead %v", err)
+	}
+
+	if _, err := auth.Authenticate("foo.bar", ""); err != errMissingToken {
+		t.Fatalf("Expected a bare UID to be rejected, instead %v", err)
+	}
+}
+
+func TestUIDAuthenticator(t *testing.T) {
+	auth := &UIDAuthenticator{}
+
+	if UID, err := auth.Authenticate("foo", ""); err != nil || UID != "foo" {
+		t.Fatalf("Expected UID to be foo, instead %s (%v)", UID, err)
+	}
+
+	if _, err := auth.Authenticate("", ""); err == nil {
+		t.Fatalf("Expected an empty UID to be rejected")
+	}
+}
+
+func encodeTestJWT(t *testing.T, header, claims map[string]interface{}, sign func(string) []byte) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(signed))
+}
+
+func TestJWTAuthenticatorHS256(t *testing.T) {
+	auth, err := NewJWTAuthenticator("sekrit", "", "", "incus-test", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	sign := func(secret string) func(string) []byte {
+		return func(signed string) []byte {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write([]byte(signed))
+			return mac.Sum(nil)
+		}
+	}
+
+	header := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	claims := map[string]interface{}{"sub": "foo", "iss": "incus-test", "exp": time.Now().Add(time.Minute).Unix()}
+
+	UID, err := auth.Authenticate("foo", encodeTestJWT(t, header, claims, sign("sekrit")))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if UID != "foo" {
+		t.Fatalf("Expected UID to be foo, instead %s", UID)
+	}
+
+	if _, err := auth.Authenticate("", encodeTestJWT(t, header, claims, sign("not-sekrit"))); err != errInvalidToken {
+		t.Fatalf("Expected a forged token to be rejected, instead %v", err)
+	}
+
+	claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	if _, err := auth.Authenticate("", encodeTestJWT(t, header, claims, sign("sekrit"))); err != errExpiredToken {
+		t.Fatalf("Expected an expired token to be rejected, instead %v", err)
+	}
+
+	claims["exp"] = time.Now().Add(time.Minute).Unix()
+	claims["iss"] = "someone-else"
+	if _, err := auth.Authenticate("", encodeTestJWT(t, header, claims, sign("sekrit"))); err != errInvalidToken {
+		t.Fatalf("Expected a token from another issuer to be rejected, instead %v", err)
+	}
+
+	header["alg"] = "none"
+	delete(claims, "iss")
+	if _, err := auth.Authenticate("", encodeTestJWT(t, header, claims, func(string) []byte { return nil })); err == nil {
+		t.Fatalf("Expected an unsigned token to be rejected")
+	}
+}
+
+func TestJWTAuthenticatorRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	set := map[string]interface{}{
+		"keys": []map[string]interface{}{{
+			"kty": "RSA",
+			"kid": "key1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	}
+
+	jwksFile, _ := ioutil.TempFile("", "incus-jwks")
+	defer os.Remove(jwksFile.Name())
+	json.NewEncoder(jwksFile).Encode(set)
+	jwksFile.Close()
+
+	auth, err := NewJWTAuthenticator("", jwksFile.Name(), "uid", "", "incus")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	sign := func(signed string) []byte {
+		digest := sha256.Sum256([]byte(signed))
+		signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		return signature
+	}
+
+	header := map[string]interface{}{"alg": "RS256", "kid": "key1"}
+	claims := map[string]interface{}{"uid": "bar", "aud": []string{"incus"}, "exp": time.Now().Add(time.Minute).Unix()}
+
+	UID, err := auth.Authenticate("", encodeTestJWT(t, header, claims, sign))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if UID != "bar" {
+		t.Fatalf("Expected UID to be bar, instead %s", UID)
+	}
+
+	header["kid"] = "key2"
+	if _, err := auth.Authenticate("", encodeTestJWT(t, header, claims, sign)); err != errUnknownSigner {
+		t.Fatalf("Expected a token signed by an unknown key to be rejected, instead %v", err)
+	}
+
+	header["alg"] = "HS256"
+	if _, err := auth.Authenticate("", encodeTestJWT(t, header, claims, sign)); err != errUnknownSigner {
+		t.Fatalf("Expected an HS256 token to be rejected without a secret, instead %v", err)
+	}
+}
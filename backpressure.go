@@ -0,0 +1,115 @@
+package incus
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// What to do with a message for a socket whose send queue is full, because
+// its client isn't reading as fast as messages arrive.
+const (
+	SlowConsumerDropOldest = "drop_oldest" // discard the oldest queued message to make room
+	SlowConsumerDropNewest = "drop_newest" // discard the new message
+	SlowConsumerDisconnect = "disconnect"  // close the socket, so the client reconnects and catches up
+
+	defaultSendQueueSize = 1000
+
+	// How many times drop_oldest makes room before giving up on a message,
+	// when other senders keep filling the queue.
+	dropOldestAttempts = 3
+)
+
+func checkSlowConsumerPolicy(policy string) error {
+	switch policy {
+	case SlowConsumerDropOldest, SlowConsumerDropNewest, SlowConsumerDisconnect:
+		return nil
+	}
+
+	return fmt.Errorf("slow_consumer_policy must be %s, %s or %s, not %q", SlowConsumerDropOldest, SlowConsumerDropNewest, SlowConsumerDisconnect, policy)
+}
+
+// send queues msg for the client without blocking, applying the server's
+// slow consumer policy if the queue is full. It returns whether msg was queued.
+func (this *Socket) send(msg *Message) bool {
+	if this.isClosed() {
+		if this.debugEnabled() {
+			this.logger().Sampled().Debug("Skipping message for closed socket")
+		}
+		return false
+	}
+
+	select {
+	case this.buff <- msg:
+		return true
+	default:
+	}
+
+	switch this.Server.slowConsumerPolicy {
+	case SlowConsumerDropNewest:
+		this.dropMessage(SlowConsumerDropNewest)
+		return false
+
+	case SlowConsumerDropOldest:
+		for i := 0; i < dropOldestAttempts; i++ {
+			select {
+			case <-this.buff:
+				this.dropMessage(SlowConsumerDropOldest)
+			default:
+			}
+
+			select {
+			case this.buff <- msg:
+				return true
+			default:
+			}
+		}
+
+		this.dropMessage(SlowConsumerDropOldest)
+		return false
+
+	default:
+		this.dropMessage(SlowConsumerDisconnect)
+
+		this.logger().Info("Disconnecting slow consumer", "queued", len(this.buff))
+
+		code := this.Server.slowConsumerCloseCode
+		if code == 0 {
+			code = closeCodeTryAgainLater
+		}
+
+		this.Server.Stats.LogSlowConsumerDisconnect()
+		go this.disconnect(code)
+		return false
+	}
+}
+
+func (this *Socket) dropMessage(policy string) {
+	atomic.AddInt64(&this.dropped, 1)
+	this.Server.Stats.LogDroppedMessage(policy)
+}
+
+// disconnect closes the socket, telling a websocket client why with code.
+func (this *Socket) disconnect(code int) {
+	this.lock.Lock()
+	if !this.isClosed() {
+		this.closeCode = code
+	}
+	this.lock.Unlock()
+
+	this.Close()
+}
+
+// QueueLength is the number of messages waiting to be written to the client.
+func (this *Socket) QueueLength() int {
+	return len(this.buff)
+}
+
+// QueueSize is the most messages that can wait to be written to the client.
+func (this *Socket) QueueSize() int {
+	return cap(this.buff)
+}
+
+// Dropped counts the messages never sent to the client because its queue was full.
+func (this *Socket) Dropped() int64 {
+	return atomic.LoadInt64(&this.dropped)
+}
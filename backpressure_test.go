@@ -0,0 +1,79 @@
+package incus
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newSlowConsumer(policy string) *Socket {
+	server := &Server{Store: newTestHistoryStore(0), Stats: &DiscardStats{}, sendQueueSize: 2, slowConsumerPolicy: policy}
+
+	sock := newSocket(nil, httptest.NewRecorder(), server, "slow")
+	server.Store.Save(sock)
+
+	for _, event := range []string{"one", "two", "three"} {
+		sock.send(&Message{Event: event})
+	}
+
+	return sock
+}
+
+func TestSlowConsumerDropOldest(t *testing.T) {
+	sock := newSlowConsumer(SlowConsumerDropOldest)
+
+	if first, second := <-sock.buff, <-sock.buff; first.Event != "two" || second.Event != "three" {
+		t.Fatalf("Expected the oldest message to be dropped, instead %s, %s", first.Event, second.Event)
+	}
+	if sock.Dropped() != 1 || sock.isClosed() {
+		t.Fatalf("Expected one dropped message on an open socket, instead %d", sock.Dropped())
+	}
+}
+
+func TestSlowConsumerDropNewest(t *testing.T) {
+	sock := newSlowConsumer(SlowConsumerDropNewest)
+
+	if first, second := <-sock.buff, <-sock.buff; first.Event != "one" || second.Event != "two" {
+		t.Fatalf("Expected the newest message to be dropped, instead %s, %s", first.Event, second.Event)
+	}
+	if sock.Dropped() != 1 || sock.isClosed() {
+		t.Fatalf("Expected one dropped message on an open socket, instead %d", sock.Dropped())
+	}
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	sock := newSlowConsumer(SlowConsumerDisconnect)
+
+	select {
+	case <-sock.done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the slow consumer to be disconnected")
+	}
+
+	if sock.closeCode != closeCodeTryAgainLater || sock.QueueLength() != 2 || sock.QueueSize() != 2 {
+		t.Fatalf("Unexpected close code %d with %d/%d queued", sock.closeCode, sock.QueueLength(), sock.QueueSize())
+	}
+	if sock.send(&Message{Event: "four"}) {
+		t.Fatalf("Expected nothing to be queued for a closed socket")
+	}
+}
+
+// Run with -race: sending must not race with the socket closing.
+func TestSendWhileClosing(t *testing.T) {
+	sock := newSlowConsumer(SlowConsumerDropNewest)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			sock.send(&Message{Event: "racing"})
+		}
+	}()
+
+	sock.Close()
+	<-done
+
+	if !sock.isClosed() || sock.send(&Message{Event: "late"}) {
+		t.Fatal("Expected nothing to be sent once the socket closed")
+	}
+}
@@ -0,0 +1,33 @@
+package incus
+
+import "time"
+
+// MessageBus carries commands between Incus nodes, and from and to the
+// applications using Incus. It is Redis, or NATS if nats_enabled.
+type MessageBus interface {
+	// Subscribe sends everything published on channel to c, every node
+	// subscribed getting a copy.
+	Subscribe(c chan []byte, channel string) error
+
+	// Poll sends what is pushed onto queue to c, each message going to only
+	// one of the nodes polling it.
+	Poll(c chan []byte, queue string) error
+
+	// StopPolling stops taking messages off the queues being polled,
+	// returning once nothing more will be sent on for them.
+	StopPolling()
+
+	Publish(channel string, message string)
+	Push(queue string, message string)
+
+	Health() BusHealth
+}
+
+// BusHealth describes how a message bus is doing, for readiness checks.
+type BusHealth struct {
+	Subscriptions int // channels subscribed to
+	Subscribed    int // of those, how many are currently receiving
+
+	Polling  bool      // whether the queue is being polled
+	LastPoll time.Time // when it was last polled, if it's polled periodically
+}
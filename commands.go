@@ -0,0 +1,391 @@
+package incus
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Why a command was rejected, as reported to its sender and counted in stats.
+const (
+	ReasonInvalidJSON    = "invalid_json"
+	ReasonMissingCommand = "missing_command"
+	ReasonUnknownCommand = "unknown_command"
+	ReasonMissingField   = "missing_field"
+	ReasonInvalidField   = "invalid_field"
+)
+
+// The event of the message sent to a client whose command was rejected.
+const commandErrorEvent = "command_error"
+
+// CommandError describes a command rejected before being carried out.
+type CommandError struct {
+	Command string `json:"command,omitempty"`
+	Reason  string `json:"reason"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+func (this *CommandError) Error() string {
+	return this.Message
+}
+
+func missingField(command, field string) *CommandError {
+	return &CommandError{Command: command, Reason: ReasonMissingField, Field: field, Message: "Missing " + field}
+}
+
+func invalidField(command, field, expected string) *CommandError {
+	return &CommandError{Command: command, Reason: ReasonInvalidField, Field: field, Message: field + " must be " + expected}
+}
+
+func invalidJSON(err error) *CommandError {
+	return &CommandError{Reason: ReasonInvalidJSON, Message: "Invalid JSON: " + err.Error()}
+}
+
+// withPrefix places err under field, e.g. websocket.event for the event of
+// a pushormessage command's websocket message.
+func (this *CommandError) withPrefix(prefix string) *CommandError {
+	field := prefix
+	if this.Field != "" {
+		field = prefix + "." + this.Field
+	}
+
+	return &CommandError{Command: this.Command, Reason: this.Reason, Field: field, Message: prefix + ": " + this.Message}
+}
+
+// MessageCommand sends Message to the sockets of User, or those on Page or
+// subscribed to Topic, or else every socket.
+type MessageCommand struct {
+	User    string
+	Page    string
+	Topic   string
+	Message *Message
+}
+
+// PushCommand sends Message as a push notification on Platform: ios, android
+// or web.
+type PushCommand struct {
+	Platform string
+	Message  *Message
+}
+
+// PushOrMessageCommand sends Websocket to User if they are active, or else
+// the push notifications in Push, by platform.
+type PushOrMessageCommand struct {
+	User      string
+	Websocket *CommandMsg
+	Push      map[string]*CommandMsg
+}
+
+// SetPageCommand moves a socket to Page.
+type SetPageCommand struct {
+	Page string
+}
+
+// TopicCommand subscribes a socket to Topic, or unsubscribes it.
+type TopicCommand struct {
+	Topic       string
+	Unsubscribe bool
+}
+
+// AckCommand acknowledges the messages with IDs.
+type AckCommand struct {
+	IDs []int64
+}
+
+// PresenceCommand marks a socket as active or inactive.
+type PresenceCommand struct {
+	Active bool
+}
+
+// parseSocketCommand checks a command from a client, returning it as one of
+// the command types a socket accepts.
+func (this *CommandMsg) parseSocketCommand() (interface{}, *CommandError) {
+	command, err := this.name()
+	if err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case "message":
+		return this.parseMessageCommand(command)
+
+	case "setpage":
+		page := this.Command["page"]
+		if page == "" {
+			return nil, missingField(command, "page")
+		}
+
+		return &SetPageCommand{Page: page}, nil
+
+	case "subscribe", "unsubscribe":
+		topic := this.Command["topic"]
+		if topic == "" {
+			return nil, missingField(command, "topic")
+		}
+
+		return &TopicCommand{Topic: topic, Unsubscribe: command == "unsubscribe"}, nil
+
+	case "ack":
+		if strings.TrimSpace(this.Command["id"]) == "" {
+			return nil, missingField(command, "id")
+		}
+
+		ack := &AckCommand{}
+		for _, id := range strings.Split(this.Command["id"], ",") {
+			ID, err := strconv.ParseInt(strings.TrimSpace(id), 10, 64)
+			if err != nil {
+				return nil, invalidField(command, "id", "a comma-separated list of message IDs")
+			}
+
+			ack.IDs = append(ack.IDs, ID)
+		}
+
+		return ack, nil
+
+	case "setpresence":
+		presence, ok := this.Message["presence"]
+		if !ok {
+			return nil, missingField(command, "presence")
+		}
+
+		active, ok := presence.(bool)
+		if !ok {
+			return nil, invalidField(command, "presence", "a boolean")
+		}
+
+		return &PresenceCommand{Active: active}, nil
+	}
+
+	return nil, &CommandError{Command: command, Reason: ReasonUnknownCommand, Message: "Unknown command"}
+}
+
+// parseAppCommand checks a command from an application, returning it as one
+// of the command types applications send.
+func (this *CommandMsg) parseAppCommand() (interface{}, *CommandError) {
+	command, err := this.name()
+	if err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case "message":
+		return this.parseMessageCommand(command)
+
+	case "pushios":
+		return this.parsePushCommand(command, "ios")
+
+	case "pushandroid":
+		return this.parsePushCommand(command, "android")
+
+	case "pushweb":
+		return this.parsePushCommand(command, "web")
+
+	case "push":
+		platform := strings.ToLower(this.Command["push_type"])
+		if platform == "" {
+			return nil, missingField(command, "push_type")
+		}
+		if platform != "ios" && platform != "android" && platform != "web" {
+			return nil, invalidField(command, "push_type", "ios, android or web")
+		}
+
+		return this.parsePushCommand(command, platform)
+
+	case "pushormessage":
+		user := this.Command["user"]
+		if user == "" {
+			return nil, missingField(command, "user")
+		}
+
+		parsed := &PushOrMessageCommand{User: user, Push: make(map[string]*CommandMsg)}
+
+		websocketMessage, ok := this.Message["websocket"].(map[string]interface{})
+		if !ok {
+			return nil, invalidField(command, "websocket", "an object")
+		}
+
+		parsed.Websocket = &CommandMsg{Command: this.Command, Message: websocketMessage}
+		if _, err := parsed.Websocket.parseMessage(command); err != nil {
+			return nil, err.withPrefix("websocket")
+		}
+
+		pushData, ok := this.Message["push"]
+		if !ok {
+			return parsed, nil
+		}
+
+		pushMessages, ok := pushData.(map[string]interface{})
+		if !ok {
+			return nil, invalidField(command, "push", "an object")
+		}
+
+		for _, platform := range []string{"ios", "android", "web"} {
+			pushMessage, ok := pushMessages[platform]
+			if !ok {
+				continue
+			}
+
+			message, ok := pushMessage.(map[string]interface{})
+			if !ok {
+				return nil, invalidField(command, "push."+platform, "an object")
+			}
+
+			pushCommand := &CommandMsg{Command: this.Command, Message: message}
+			if _, err := pushCommand.parsePushCommand(command, platform); err != nil {
+				return nil, err.withPrefix("push." + platform)
+			}
+
+			parsed.Push[platform] = pushCommand
+		}
+
+		return parsed, nil
+	}
+
+	return nil, &CommandError{Command: command, Reason: ReasonUnknownCommand, Message: "Unknown command"}
+}
+
+func (this *CommandMsg) name() (string, *CommandError) {
+	command := strings.ToLower(this.Command["command"])
+	if command == "" {
+		return "", &CommandError{Reason: ReasonMissingCommand, Field: "command", Message: "Missing command"}
+	}
+
+	return command, nil
+}
+
+func (this *CommandMsg) parseMessageCommand(command string) (*MessageCommand, *CommandError) {
+	msg, err := this.parseMessage(command)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MessageCommand{
+		User:    this.Command["user"],
+		Page:    this.Command["page"],
+		Topic:   this.Command["topic"],
+		Message: msg,
+	}, nil
+}
+
+func (this *CommandMsg) parsePushCommand(command, platform string) (*PushCommand, *CommandError) {
+	switch platform {
+	case "ios":
+		if this.Command["device_token"] == "" {
+			return nil, missingField(command, "device_token")
+		}
+		if this.Command["build"] == "" {
+			return nil, missingField(command, "build")
+		}
+
+	case "android":
+		if this.Command["registration_ids"] == "" {
+			return nil, missingField(command, "registration_ids")
+		}
+
+	case "web":
+		if this.Command["webpush_endpoint"] == "" {
+			return nil, missingField(command, "webpush_endpoint")
+		}
+	}
+
+	msg, err := this.parseMessage(command)
+	if err != nil {
+		return nil, err
+	}
+
+	if badge, ok := msg.Data["badge_count"]; ok && platform == "ios" {
+		if _, ok := badge.(float64); !ok {
+			return nil, invalidField(command, "data.badge_count", "a number")
+		}
+	}
+
+	return &PushCommand{Platform: platform, Message: msg}, nil
+}
+
+// parseMessage checks the message of a command, which must have a string
+// event and an object of data.
+func (this *CommandMsg) parseMessage(command string) (*Message, *CommandError) {
+	event, ok := this.Message["event"]
+	if !ok {
+		return nil, missingField(command, "event")
+	}
+
+	eventName, ok := event.(string)
+	if !ok || eventName == "" {
+		return nil, invalidField(command, "event", "a non-empty string")
+	}
+
+	data, ok := this.Message["data"]
+	if !ok {
+		return nil, missingField(command, "data")
+	}
+
+	dataMap, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, invalidField(command, "data", "an object")
+	}
+
+	msg := &Message{
+		Event: eventName,
+		Data:  dataMap,
+		Time:  time.Now().UTC().Unix(),
+	}
+
+	// hack for bad version of Imgur iOS client
+	if url, ok := dataMap["internal_url"].(string); ok {
+		msg.Url = url
+	}
+
+	return msg, nil
+}
+
+// rejectCommand tells a client why its command was rejected.
+func (this *Socket) rejectCommand(err *CommandError) {
+	this.Server.Stats.LogCommandRejected(err.Reason)
+
+	this.logger().Sampled().Debug("Rejected command", "command", err.Command, "reason", err.Reason, "error", err.Message)
+
+	data := map[string]interface{}{"reason": err.Reason, "message": err.Message}
+	if err.Command != "" {
+		data["command"] = err.Command
+	}
+	if err.Field != "" {
+		data["field"] = err.Field
+	}
+
+	this.send(&Message{Event: commandErrorEvent, Data: data, Time: time.Now().UTC().Unix()})
+}
+
+// rejectCommand reports a command from an application that was rejected on
+// the command error queue, with the command as it was received.
+func (this *Server) rejectCommand(err *CommandError, received interface{}) {
+	this.Stats.LogCommandRejected(err.Reason)
+	this.Log.Warn("Rejected command", "command", err.Command, "reason", err.Reason, "error", err.Message)
+
+	if this.Store.bus == nil {
+		return
+	}
+
+	payload := map[string]interface{}{
+		"reason":   err.Reason,
+		"message":  err.Message,
+		"received": received,
+	}
+	if err.Command != "" {
+		payload["command"] = err.Command
+	}
+	if err.Field != "" {
+		payload["field"] = err.Field
+	}
+
+	msg_str, _ := json.Marshal(payload)
+	this.Store.bus.Push(this.runtimeOptions().CommandErrorQueue, string(msg_str))
+}
+
+// rejectJSON reports a command that isn't valid JSON.
+func (this *Server) rejectJSON(err error, received []byte) {
+	this.Stats.LogInvalidJSON()
+	this.rejectCommand(invalidJSON(err), string(received))
+}
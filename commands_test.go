@@ -0,0 +1,114 @@
+package incus
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseAppCommand(t *testing.T) {
+	tests := []struct {
+		json   string
+		reason string
+		field  string
+	}{
+		{`{"command": {"command": "message"}, "message": {"event": "hi", "data": {}}}`, "", ""},
+		{`{"command": {}}`, ReasonMissingCommand, "command"},
+		{`{"command": {"command": "explode"}}`, ReasonUnknownCommand, ""},
+		{`{"command": {"command": "message"}, "message": {"data": {}}}`, ReasonMissingField, "event"},
+		{`{"command": {"command": "message"}, "message": {"event": 1, "data": {}}}`, ReasonInvalidField, "event"},
+		{`{"command": {"command": "message"}, "message": {"event": "hi", "data": "nope"}}`, ReasonInvalidField, "data"},
+		{`{"command": {"command": "pushios", "build": "store"}, "message": {"event": "hi", "data": {}}}`, ReasonMissingField, "device_token"},
+		{`{"command": {"command": "pushios", "build": "store", "device_token": "abc"}, "message": {"event": "hi", "data": {"badge_count": "1"}}}`, ReasonInvalidField, "data.badge_count"},
+		{`{"command": {"command": "push", "push_type": "fax"}, "message": {"event": "hi", "data": {}}}`, ReasonInvalidField, "push_type"},
+		{`{"command": {"command": "pushormessage", "user": "u"}, "message": {"websocket": {"event": "hi", "data": {}}}}`, "", ""},
+		{`{"command": {"command": "pushormessage", "user": "u"}, "message": {"websocket": "hi"}}`, ReasonInvalidField, "websocket"},
+		{`{"command": {"command": "pushormessage", "user": "u"}, "message": {"websocket": {"data": {}}}}`, ReasonMissingField, "websocket.event"},
+		{`{"command": {"command": "pushormessage", "user": "u"}, "message": {"websocket": {"event": "hi", "data": {}}, "push": {"android": {"event": "hi", "data": {}}}}}`, ReasonMissingField, "push.android.registration_ids"},
+	}
+
+	for _, test := range tests {
+		cmd := new(CommandMsg)
+		if err := json.Unmarshal([]byte(test.json), cmd); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := cmd.parseAppCommand()
+		if test.reason == "" {
+			if err != nil {
+				t.Errorf("Expected %s to be accepted, got %+v", test.json, err)
+			}
+			continue
+		}
+
+		if err == nil || err.Reason != test.reason || err.Field != test.field {
+			t.Errorf("Expected %s to be rejected with %s on %q, got %+v", test.json, test.reason, test.field, err)
+		}
+	}
+}
+
+func TestParseSocketCommand(t *testing.T) {
+	cmd := &CommandMsg{Command: map[string]string{"command": "ack", "id": "1, 2"}}
+	parsed, err := cmd.parseSocketCommand()
+	if ack, ok := parsed.(*AckCommand); err != nil || !ok || len(ack.IDs) != 2 || ack.IDs[1] != 2 {
+		t.Errorf("Expected an ack of two IDs, got %+v %+v", parsed, err)
+	}
+
+	cmd = &CommandMsg{Command: map[string]string{"command": "ack", "id": "1,two"}}
+	if _, err := cmd.parseSocketCommand(); err == nil || err.Reason != ReasonInvalidField {
+		t.Errorf("Expected an invalid ID to be rejected, got %+v", err)
+	}
+
+	cmd = &CommandMsg{Command: map[string]string{"command": "setpresence"}, Message: map[string]interface{}{"presence": "yes"}}
+	if _, err := cmd.parseSocketCommand(); err == nil || err.Reason != ReasonInvalidField || err.Field != "presence" {
+		t.Errorf("Expected a non-boolean presence to be rejected, got %+v", err)
+	}
+
+	cmd = &CommandMsg{Command: map[string]string{"command": "pushios"}}
+	if _, err := cmd.parseSocketCommand(); err == nil || err.Reason != ReasonUnknownCommand {
+		t.Errorf("Expected clients to be refused application commands, got %+v", err)
+	}
+}
+
+func TestSocketCommandRejected(t *testing.T) {
+	server := &Server{Store: newTestHistoryStore(0), Stats: &DiscardStats{}}
+	sock := newSocket(nil, httptest.NewRecorder(), server, "rejected-test")
+
+	cmd := &CommandMsg{Command: map[string]string{"command": "subscribe"}}
+	cmd.FromSocket(sock)
+
+	select {
+	case msg := <-sock.buff:
+		if msg.Event != commandErrorEvent || msg.Data["reason"] != ReasonMissingField || msg.Data["field"] != "topic" || msg.Data["command"] != "subscribe" {
+			t.Errorf("Expected a command error for the missing topic, got %+v", msg)
+		}
+	default:
+		t.Errorf("Expected the socket to be told its command was rejected")
+	}
+}
+
+func TestAppCommandRejectedOnce(t *testing.T) {
+	bus := &fakeBus{}
+	store := newTestHistoryStore(0)
+	store.bus = bus
+	server := &Server{Store: store, Stats: &DiscardStats{}, Log: NewLogger(ioutil.Discard, "logfmt", LevelInfo, 0, 0)}
+
+	// Every node receives a command published to the message channel, so none
+	// of them reports it.
+	broadcast := &CommandMsg{Command: map[string]string{"command": "explode"}, broadcast: true}
+	if result := broadcast.Handle(server, "redis"); result.Status != CommandRejected || len(bus.pushed) != 0 {
+		t.Fatalf("Expected a broadcast command to be rejected without reporting it, instead %+v, pushed %v", result, bus.pushed)
+	}
+
+	queued := &CommandMsg{Command: map[string]string{"command": "explode"}}
+	if result := server.fromQueue(queued); result.Status != CommandRejected || len(bus.pushed) != 1 {
+		t.Fatalf("Expected a queued command to be rejected and reported, instead %+v, pushed %v", result, bus.pushed)
+	}
+
+	store.targetedRouting = true
+	queued = &CommandMsg{Command: map[string]string{"command": "message"}}
+	if result := server.fromQueue(queued); result.Status != CommandRejected || len(bus.pushed) != 2 {
+		t.Fatalf("Expected a queued message to be checked before it's routed, instead %+v, pushed %v", result, bus.pushed)
+	}
+}
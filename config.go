@@ -16,68 +16,222 @@ func NewConfig(configFilePath string) {
 		panic(fmt.Errorf("Fatal error config file: %s \n", err))
 	}
 
-	ConfigOption("client_broadcasts", true)
-	ConfigOption("listening_port", "4000")
-	ConfigOption("connection_timeout", 60000)
-	ConfigOption("log_level", "debug")
+	configDefaults(viper.GetViper())
+}
+
+// configDefaults sets the default of each option in v, some of which depend
+// on the values of others. Options naming files that don't exist panic.
+func configDefaults(v *viper.Viper) {
+	option := func(key string, default_value interface{}) string {
+		v.SetDefault(key, default_value)
+
+		return key
+	}
+
+	option("client_broadcasts", true)
+	option("listening_port", "4000")
+	option("connection_timeout", 60000)
+	option("log_level", "debug")
+	option("log_format", "logfmt")
+	option("log_sample_initial", 100)
+	option("log_sample_thereafter", 100)
+
+	option("rate_limit_enabled", false)
+	option("rate_limit_close_code", closeCodePolicyViolation)
+	option("rate_limit_connections_per_ip", 20)
+	option("rate_limit_connections_per_ip_burst", 100)
+	option("rate_limit_trusted_proxies", []string{})
+	option("rate_limit_connections_per_user", 2)
+	option("rate_limit_connections_per_user_burst", 10)
+	option("rate_limit_commands_per_socket", 10)
+	option("rate_limit_commands_per_socket_burst", 50)
+	option("rate_limit_messages_per_user", 20)
+	option("rate_limit_messages_per_user_burst", 100)
+
+	option("datadog_enabled", false)
+
+	if v.GetBool("datadog_enabled") {
+		option("datadog_host", "127.0.0.1")
+	}
+
+	option("prometheus_enabled", false)
+
+	if v.GetBool("prometheus_enabled") {
+		option("prometheus_path", "/metrics")
+		option("prometheus_port", "")
+	}
 
-	ConfigOption("datadog_enabled", false)
+	option("allowed_origins", []string{})
 
-	if viper.GetBool("datadog_enabled") {
-		ConfigOption("datadog_host", "127.0.0.1")
+	option("send_queue_size", 1000)
+	option("slow_consumer_policy", "disconnect")
+	option("slow_consumer_close_code", 1013)
+
+	option("api_enabled", false)
+
+	if v.GetBool("api_enabled") {
+		option("api_token", "")
+		option("api_max_batch", 100)
 	}
 
-	ConfigOption("longpoll_killswitch", "longpoll_killswitch")
-	ConfigOption("redis_enabled", false)
+	option("admin_enabled", false)
 
-	if viper.GetBool("redis_enabled") {
-		ConfigOption("redis_port_6379_tcp_addr", "127.0.0.1")
-		ConfigOption("redis_port_6379_tcp_port", 6379)
-		ConfigOption("redis_message_channel", "Incus")
-		ConfigOption("redis_message_queue", "Incus_Queue")
-		ConfigOption("redis_activity_consumers", 8)
-		ConfigOption("redis_connection_pool_size", 20)
+	if v.GetBool("admin_enabled") {
+		option("admin_port", "4001")
+		option("admin_token", "")
 	}
 
-	ConfigOption("tls_enabled", false)
+	option("longpoll_killswitch", "longpoll_killswitch")
+
+	option("history_enabled", false)
+	option("history_size", 100)
+	option("history_ttl", 3600)
 
-	if viper.GetBool("tls_enabled") {
-		ConfigOption("tls_port", "443")
-		fileOption(ConfigOption("cert_file", "cert.pem"))
-		fileOption(ConfigOption("key_file", "key.pem"))
+	option("acks_enabled", false)
+
+	if v.GetBool("acks_enabled") {
+		option("ack_timeout", 300)
+		option("ack_callback", "")
+		option("ack_callback_queue", "Incus_Ack_Queue")
+		option("ack_callback_url", "")
 	}
 
-	ConfigOption("apns_enabled", false)
+	option("auth_type", "uid")
 
-	if viper.GetBool("apns_enabled") {
-		fileOption(ConfigOption("apns_store_cert", "myapnsappcert.pem"))
-		fileOption(ConfigOption("apns_store_private_key", "myapnsappprivatekey.pem"))
+	if v.GetString("auth_type") == "jwt" {
+		option("auth_jwt_user_claim", "sub")
+	}
 
-		fileOption(ConfigOption("apns_enterprise_cert", "myapnsappcert.pem"))
-		fileOption(ConfigOption("apns_enterprise_private_key", "myapnsappprivatekey.pem"))
+	option("redis_enabled", false)
+
+	if v.GetBool("redis_enabled") {
+		option("redis_port_6379_tcp_addr", "127.0.0.1")
+		option("redis_port_6379_tcp_port", 6379)
+		option("redis_mode", "single")
+
+		if v.GetString("redis_mode") == "sentinel" {
+			option("redis_sentinel_addrs", "127.0.0.1:26379")
+			option("redis_sentinel_master", "mymaster")
+		}
+
+		if v.GetString("redis_mode") == "cluster" {
+			option("redis_cluster_addrs", "127.0.0.1:7000")
+		}
+		option("redis_message_channel", "Incus")
+		option("redis_message_queue", "Incus_Queue")
+		option("redis_targeted_routing", false)
+		option("redis_queue_type", "list")
+
+		if v.GetString("redis_queue_type") == "stream" {
+			option("redis_stream_group", "incus")
+			option("redis_stream_consumer", "")
+			option("redis_stream_claim_idle", 60)
+			option("redis_stream_max_deliveries", 5)
+			option("redis_stream_dead_letter", "Incus_Queue_Dead")
+		}
+		option("redis_activity_consumers", 8)
+		option("redis_connection_pool_size", 20)
+		option("redis_pool_max_active", 100)
+		option("redis_pool_wait_timeout", 1000)
+		option("redis_pool_idle_timeout", 240)
+	}
+
+	option("nats_enabled", false)
+
+	if v.GetBool("nats_enabled") {
+		option("nats_url", "nats://127.0.0.1:4222")
+		option("nats_message_subject", "Incus")
+		option("nats_message_queue", "Incus_Queue")
+		option("nats_stream", "INCUS")
+		option("nats_consumer", "incus")
+		option("nats_ack_wait", 30)
+	}
 
-		fileOption(ConfigOption("apns_beta_cert", "myapnsappcert.pem"))
-		fileOption(ConfigOption("apns_beta_private_key", "myapnsappprivatekey.pem"))
+	option("command_error_queue", "Incus_Command_Error_Queue")
+
+	option("health_redis_timeout", 1000)
+	option("health_redis_pool_usage", 0.9)
+	option("health_queue_max_age", 30)
+	option("health_max_connections", 0)
+	option("health_apns_cert_warn_days", 30)
+
+	option("drain_timeout", 10)
+	option("drain_reconnect_min", 1000)
+	option("drain_reconnect_max", 10000)
+
+	option("tls_enabled", false)
+
+	if v.GetBool("tls_enabled") {
+		option("tls_port", "443")
+		fileOption(v, option("cert_file", "cert.pem"))
+		fileOption(v, option("key_file", "key.pem"))
+	}
+
+	option("apns_enabled", false)
+
+	if v.GetBool("apns_enabled") {
+		option("apns_provider", "certificate")
+
+		if v.GetString("apns_provider") == "token" {
+			fileOption(v, option("apns_auth_key_file", "AuthKey.p8"))
+			option("apns_key_id", "")
+			option("apns_team_id", "")
+
+			option("apns_store_host", "https://api.push.apple.com")
+			option("apns_enterprise_host", "https://api.push.apple.com")
+			option("apns_beta_host", "https://api.push.apple.com")
+			option("apns_development_host", "https://api.sandbox.push.apple.com")
+
+			option("apns_store_topic", "")
+			option("apns_enterprise_topic", "")
+			option("apns_beta_topic", "")
+			option("apns_development_topic", "")
+		} else {
+			fileOption(v, option("apns_store_cert", "myapnsappcert.pem"))
+			fileOption(v, option("apns_store_private_key", "myapnsappprivatekey.pem"))
+
+			fileOption(v, option("apns_enterprise_cert", "myapnsappcert.pem"))
+			fileOption(v, option("apns_enterprise_private_key", "myapnsappprivatekey.pem"))
+
+			fileOption(v, option("apns_beta_cert", "myapnsappcert.pem"))
+			fileOption(v, option("apns_beta_private_key", "myapnsappprivatekey.pem"))
+
+			fileOption(v, option("apns_development_cert", "myapnsappcert.pem"))
+			fileOption(v, option("apns_development_private_key", "myapnsappprivatekey.pem"))
+
+			option("apns_store_url", "gateway.push.apple.com:2195")
+			option("apns_enterprise_url", "gateway.push.apple.com:2195")
+			option("apns_beta_url", "gateway.push.apple.com:2195")
+			option("apns_development_url", "gateway.sandbox.push.apple.com:2195")
+
+			option("apns_production_url", "gateway.push.apple.com:2195")
+			option("apns_sandbox_url", "gateway.sandbox.push.apple.com:2195")
+		}
+
+		option("ios_push_sound", "bingbong.aiff")
+	}
 
-		fileOption(ConfigOption("apns_development_cert", "myapnsappcert.pem"))
-		fileOption(ConfigOption("apns_development_private_key", "myapnsappprivatekey.pem"))
+	option("gcm_enabled", false)
 
-		ConfigOption("apns_store_url", "gateway.push.apple.com:2195")
-		ConfigOption("apns_enterprise_url", "gateway.push.apple.com:2195")
-		ConfigOption("apns_beta_url", "gateway.push.apple.com:2195")
-		ConfigOption("apns_development_url", "gateway.sandbox.push.apple.com:2195")
+	if v.GetBool("gcm_enabled") {
+		option("gcm_provider", "legacy")
 
-		ConfigOption("apns_production_url", "gateway.push.apple.com:2195")
-		ConfigOption("apns_sandbox_url", "gateway.sandbox.push.apple.com:2195")
+		if v.GetString("gcm_provider") == "fcm" {
+			fileOption(v, option("fcm_service_account_file", "service-account.json"))
+			option("fcm_endpoint", "https://fcm.googleapis.com")
+		} else {
+			option("gcm_api_key", "foobar")
+		}
 
-		ConfigOption("ios_push_sound", "bingbong.aiff")
+		option("android_error_queue", "Incus_Android_Error_Queue")
 	}
 
-	ConfigOption("gcm_enabled", false)
+	option("webpush_enabled", false)
 
-	if viper.GetBool("gcm_enabled") {
-		ConfigOption("gcm_api_key", "foobar")
-		ConfigOption("android_error_queue", "Incus_Android_Error_Queue")
+	if v.GetBool("webpush_enabled") {
+		option("webpush_vapid_private_key", "")
+		option("webpush_subject", "")
+		option("webpush_error_queue", "Incus_WebPush_Error_Queue")
 	}
 }
 
@@ -88,8 +242,8 @@ func ConfigOption(key string, default_value interface{}) string {
 }
 
 // Asserts that the chosen value exists on the local file system by panicking if it doesn't
-func fileOption(key string) {
-	chosenValue := viper.GetString(key)
+func fileOption(v *viper.Viper, key string) {
+	chosenValue := v.GetString(key)
 
 	if _, err := os.Stat(chosenValue); err != nil {
 		panic(fmt.Errorf("Chosen option %s does not exist!", chosenValue))
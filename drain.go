@@ -0,0 +1,158 @@
+package incus
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	drainPollInterval = 50 * time.Millisecond
+
+	// The event telling clients to reconnect, to another node, after
+	// retry_after milliseconds.
+	reconnectEvent = "reconnect"
+)
+
+func (this *Server) isDraining() bool {
+	return atomic.LoadInt32(&this.draining) == 1
+}
+
+// refuseWhileDraining turns away new connections once the server is
+// draining, so that clients retry on another node.
+func (this *Server) refuseWhileDraining(w http.ResponseWriter) bool {
+	if !this.isDraining() {
+		return false
+	}
+
+	w.Header().Set("Connection", "close")
+	w.Header().Set("Retry-After", strconv.Itoa(int(this.reconnectDelay()/time.Second)+1))
+	http.Error(w, "Server is shutting down", 503)
+
+	return true
+}
+
+// reconnectDelay spreads out the clients of a draining node, so that they
+// don't all reconnect elsewhere at once.
+func (this *Server) reconnectDelay() time.Duration {
+	this.settings.RLock()
+	min, max := this.drainReconnectMin, this.drainReconnectMax
+	this.settings.RUnlock()
+
+	if max <= min {
+		return min
+	}
+
+	return min + time.Duration(rand.Int63n(int64(max-min)))
+}
+
+// commandStarted and commandDone count the commands being handled, which
+// Drain waits for.
+func (this *Server) commandStarted() {
+	atomic.AddInt64(&this.inflight, 1)
+}
+
+func (this *Server) commandDone() {
+	atomic.AddInt64(&this.inflight, -1)
+}
+
+// setQueue records how to stop taking commands off the message queue, and
+// how many commands taken are yet to be handled, for Drain.
+func (this *Server) setQueue(stop func(), backlog func() int) {
+	this.queueLock.Lock()
+	defer this.queueLock.Unlock()
+
+	this.stopQueue = stop
+	this.queueBacklog = backlog
+}
+
+func (this *Server) queue() (stop func(), backlog func() int) {
+	this.queueLock.Lock()
+	defer this.queueLock.Unlock()
+
+	return this.stopQueue, this.queueBacklog
+}
+
+// Drain shuts the server down gracefully, taking up to timeout. It refuses
+// new connections and fails /ping so load balancers move on, stops taking
+// commands off the message queue, and tells every client to reconnect
+// elsewhere after a jittered delay. Once the commands already taken are
+// handled and every socket's queued messages are written, or timeout has
+// passed, the remaining sockets are closed with 1001 (going away).
+func (this *Server) Drain(timeout time.Duration) {
+	if !atomic.CompareAndSwapInt32(&this.draining, 0, 1) {
+		return
+	}
+
+	deadline := time.Now().Add(timeout)
+	this.Log.Info("Draining", "timeout", timeout)
+
+	stop, backlog := this.queue()
+	if stop != nil {
+		stopped := make(chan struct{})
+		go func() {
+			stop()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-time.After(time.Until(deadline)):
+			this.Log.Warn("Timed out waiting to stop polling the message queue")
+		}
+	}
+
+	this.Store.EachSocket(func(sock *Socket) {
+		delay := this.reconnectDelay()
+		sock.send(&Message{
+			Event: reconnectEvent,
+			Data:  map[string]interface{}{"retry_after": int64(delay / time.Millisecond)},
+			Time:  time.Now().UTC().Unix(),
+		})
+	})
+
+	idle := func() bool {
+		if atomic.LoadInt64(&this.inflight) > 0 {
+			return false
+		}
+
+		if backlog != nil && backlog() > 0 {
+			return false
+		}
+
+		flushed := true
+		this.Store.EachSocket(func(sock *Socket) {
+			if len(sock.buff) > 0 {
+				flushed = false
+			}
+		})
+
+		return flushed
+	}
+
+	for !idle() && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+
+	if inflight := atomic.LoadInt64(&this.inflight); inflight > 0 {
+		this.Log.Warn("Closing sockets with commands still being handled", "inflight", inflight)
+	}
+
+	if this.closing != nil {
+		close(this.closing)
+	}
+
+	for time.Now().Before(deadline) {
+		open := 0
+		this.Store.EachSocket(func(sock *Socket) { open++ })
+		if open == 0 {
+			break
+		}
+
+		time.Sleep(drainPollInterval)
+	}
+
+	this.Log.Info("Drained")
+}
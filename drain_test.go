@@ -0,0 +1,65 @@
+package incus
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	server := &Server{
+		Store:             newTestHistoryStore(0),
+		Stats:             &DiscardStats{},
+		closing:           make(chan struct{}),
+		drainReconnectMin: 100 * time.Millisecond,
+		drainReconnectMax: 200 * time.Millisecond,
+	}
+
+	sock := newSocket(nil, httptest.NewRecorder(), server, "drain-test")
+	server.Store.Save(sock)
+
+	server.commandStarted()
+
+	drained := make(chan struct{})
+	go func() {
+		server.Drain(5 * time.Second)
+		close(drained)
+	}()
+
+	select {
+	case msg := <-sock.buff:
+		delay, _ := msg.Data["retry_after"].(int64)
+		if msg.Event != reconnectEvent || delay < 100 || delay >= 200 {
+			t.Errorf("Expected to be told to reconnect in 100-200ms, got %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the socket to be told to reconnect")
+	}
+
+	w := httptest.NewRecorder()
+	if !server.refuseWhileDraining(w) || w.Code != 503 || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected new connections to be refused, instead %d", w.Code)
+	}
+
+	select {
+	case <-server.closing:
+		t.Fatal("Expected sockets to stay open while a command was being handled")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	server.commandDone()
+
+	select {
+	case <-server.closing:
+	case <-time.After(time.Second):
+		t.Fatal("Expected sockets to be closed once the command was handled")
+	}
+
+	server.Store.Remove(sock)
+
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Drain to return once every socket was closed")
+	}
+}
@@ -0,0 +1,284 @@
+package incus
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexjlockwood/gcm"
+)
+
+const (
+	fcmScope          = "https://www.googleapis.com/auth/firebase.messaging"
+	fcmRequestTimeout = 10 * time.Second
+)
+
+// Backoff before the first retry of a send FCM reports as temporarily failed.
+var fcmRetryBackoff = time.Second
+
+// FCM v1 error codes, and the legacy GCM errors they replace, so failures
+// reach android_error_queue in the shape applications already handle.
+var fcmLegacyErrors = map[string]string{
+	"UNREGISTERED":           "NotRegistered",
+	"NOT_FOUND":              "NotRegistered",
+	"INVALID_ARGUMENT":       "InvalidRegistration",
+	"SENDER_ID_MISMATCH":     "MismatchSenderId",
+	"QUOTA_EXCEEDED":         "MessageRateExceeded",
+	"UNAVAILABLE":            "Unavailable",
+	"INTERNAL":               "InternalServerError",
+	"THIRD_PARTY_AUTH_ERROR": "InvalidApnsCredential",
+}
+
+// FCMOptions are the per-message options of the FCM v1 API that don't fit in
+// a legacy gcm.Message.
+type FCMOptions struct {
+	Priority     string // "high" or "normal"
+	Notification *FCMNotification
+}
+
+type FCMNotification struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+}
+
+type fcmServiceAccount struct {
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+type fcmAndroidConfig struct {
+	CollapseKey  string           `json:"collapse_key,omitempty"`
+	Priority     string           `json:"priority,omitempty"`
+	TTL          string           `json:"ttl,omitempty"`
+	Notification *FCMNotification `json:"notification,omitempty"`
+}
+
+type fcmMessage struct {
+	Token   string            `json:"token"`
+	Data    map[string]string `json:"data,omitempty"`
+	Android *fcmAndroidConfig `json:"android,omitempty"`
+}
+
+type fcmErrorResponse struct {
+	Error struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+		Details []struct {
+			Type      string `json:"@type"`
+			ErrorCode string `json:"errorCode"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+// FCMClient sends Android pushes through the FCM HTTP v1 API, authenticated
+// with a service account. It satisfies GCMClient, sending one request per
+// registration id and reporting the outcomes as a gcm.Response.
+type FCMClient struct {
+	account  fcmServiceAccount
+	key      *rsa.PrivateKey
+	endpoint string
+	client   *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	expires     time.Time
+}
+
+// NewFCMClient reads the service account JSON key at keyFile. endpoint is
+// the FCM API base, https://fcm.googleapis.com in production.
+func NewFCMClient(keyFile, endpoint string, client *http.Client) (*FCMClient, error) {
+	contents, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var account fcmServiceAccount
+	if err := json.Unmarshal(contents, &account); err != nil {
+		return nil, fmt.Errorf("Could not parse FCM service account %s: %s", keyFile, err.Error())
+	}
+
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("No private key found in FCM service account %s", keyFile)
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse FCM service account key %s: %s", keyFile, err.Error())
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("FCM service account key %s is not an RSA key", keyFile)
+	}
+
+	if client == nil {
+		client = &http.Client{Timeout: fcmRequestTimeout}
+	}
+
+	return &FCMClient{account: account, key: key, endpoint: endpoint, client: client}, nil
+}
+
+func (this *FCMClient) Send(msg *gcm.Message, retries int) (*gcm.Response, error) {
+	return this.SendWithOptions(msg, FCMOptions{}, retries)
+}
+
+func (this *FCMClient) SendWithOptions(msg *gcm.Message, options FCMOptions, retries int) (*gcm.Response, error) {
+	token, err := this.token()
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]string, len(msg.Data))
+	for key, value := range msg.Data {
+		if str, ok := value.(string); ok {
+			data[key] = str
+		} else {
+			// FCM only carries string values, so anything else is sent as JSON.
+			json_str, _ := json.Marshal(value)
+			data[key] = string(json_str)
+		}
+	}
+
+	android := &fcmAndroidConfig{
+		CollapseKey:  msg.CollapseKey,
+		Priority:     options.Priority,
+		Notification: options.Notification,
+	}
+	if msg.TimeToLive > 0 {
+		android.TTL = fmt.Sprintf("%ds", msg.TimeToLive)
+	}
+
+	response := &gcm.Response{}
+	for _, registrationID := range msg.RegistrationIDs {
+		result := this.sendOne(token, &fcmMessage{Token: registrationID, Data: data, Android: android}, retries)
+
+		if result.Error == "" {
+			response.Success++
+		} else {
+			response.Failure++
+		}
+		response.Results = append(response.Results, result)
+	}
+
+	return response, nil
+}
+
+func (this *FCMClient) sendOne(token string, message *fcmMessage, retries int) gcm.Result {
+	body, _ := json.Marshal(map[string]interface{}{"message": message})
+	sendURL := this.endpoint + "/v1/projects/" + this.account.ProjectID + "/messages:send"
+	backoff := fcmRetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		req, _ := http.NewRequest("POST", sendURL, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+
+		var legacyError string
+
+		resp, err := this.client.Do(req)
+		if err != nil {
+			legacyError = "Unavailable"
+		} else {
+			if resp.StatusCode == http.StatusOK {
+				var sent struct {
+					Name string `json:"name"`
+				}
+				json.NewDecoder(resp.Body).Decode(&sent)
+				resp.Body.Close()
+
+				return gcm.Result{MessageID: sent.Name}
+			}
+
+			var fcmErr fcmErrorResponse
+			json.NewDecoder(resp.Body).Decode(&fcmErr)
+			resp.Body.Close()
+
+			code := fcmErr.Error.Status
+			for _, detail := range fcmErr.Error.Details {
+				if strings.HasSuffix(detail.Type, "FcmError") && detail.ErrorCode != "" {
+					code = detail.ErrorCode
+				}
+			}
+
+			legacyError = fcmLegacyErrors[code]
+			if legacyError == "" {
+				legacyError = code
+			}
+		}
+
+		if attempt >= retries || (legacyError != "Unavailable" && legacyError != "InternalServerError" && legacyError != "MessageRateExceeded") {
+			return gcm.Result{Error: legacyError}
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// token returns an OAuth2 access token for the service account, exchanging a
+// signed JWT for a new one when the current token is about to expire.
+func (this *FCMClient) token() (string, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := time.Now()
+	if this.accessToken != "" && now.Add(time.Minute).Before(this.expires) {
+		return this.accessToken, nil
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": this.account.PrivateKeyID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   this.account.ClientEmail,
+		"scope": fcmScope,
+		"aud":   this.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, this.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := this.client.PostForm(this.account.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {signed + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var granted struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&granted); err != nil || resp.StatusCode != http.StatusOK || granted.AccessToken == "" {
+		return "", errors.New("Could not obtain an FCM access token: " + resp.Status)
+	}
+
+	this.accessToken = granted.AccessToken
+	this.expires = now.Add(time.Duration(granted.ExpiresIn) * time.Second)
+
+	return this.accessToken, nil
+}
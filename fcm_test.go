@@ -0,0 +1,151 @@
+package incus
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/alexjlockwood/gcm"
+)
+
+func TestFCM(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	var sends []map[string]interface{}
+	tokenRequests := 0
+
+	// A stand-in for both oauth2.googleapis.com and fcm.googleapis.com
+	google := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			tokenRequests++
+
+			parts := strings.Split(r.FormValue("assertion"), ".")
+			digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature) != nil {
+				w.WriteHeader(400)
+				return
+			}
+
+			w.Write([]byte(`{"access_token":"ya29.test","expires_in":3600,"token_type":"Bearer"}`))
+			return
+		}
+
+		if r.URL.Path != "/v1/projects/incus-test/messages:send" || r.Header.Get("Authorization") != "Bearer ya29.test" {
+			w.WriteHeader(401)
+			return
+		}
+
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		message := body["message"].(map[string]interface{})
+		sends = append(sends, message)
+
+		if message["token"] == "baddevice" {
+			w.WriteHeader(404)
+			w.Write([]byte(`{"error":{"code":404,"status":"NOT_FOUND","details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"UNREGISTERED"}]}}`))
+			return
+		}
+
+		w.Write([]byte(`{"name":"projects/incus-test/messages/1"}`))
+	}))
+	defer google.Close()
+
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	account, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "incus-test",
+		"private_key_id": "key1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   "incus@incus-test.iam.gserviceaccount.com",
+		"token_uri":      google.URL + "/token",
+	})
+
+	accountFile, _ := ioutil.TempFile("", "incus-fcm")
+	defer os.Remove(accountFile.Name())
+	accountFile.Write(account)
+	accountFile.Close()
+
+	client, err := NewFCMClient(accountFile.Name(), google.URL, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	server := &Server{
+		Stats:       &DiscardStats{},
+		gcmProvider: func() GCMClient { return client },
+	}
+
+	msg := new(CommandMsg)
+	json.Unmarshal([]byte(`{
+		"command": {
+			"command": "push",
+			"push_type": "android",
+			"registration_ids": "123456,654321",
+			"android_priority": "high",
+			"android_ttl": "60",
+			"android_collapse_key": "gallery-abc",
+			"android_message_type": "notification"
+		},
+		"message": {
+			"event": "foobaz",
+			"data": {
+				"title": "foo",
+				"message_text": "foobar"
+			},
+			"time": 1234
+		}
+	}`), &msg)
+
+	msg.FromRedis(server)
+
+	if len(sends) != 2 || sends[0]["token"] != "123456" || sends[1]["token"] != "654321" {
+		t.Fatalf("Expected one send per registration id, instead %+v", sends)
+	}
+
+	android := sends[0]["android"].(map[string]interface{})
+	if android["priority"] != "high" || android["ttl"] != "60s" || android["collapse_key"] != "gallery-abc" {
+		t.Fatalf("Unexpected android options %+v", android)
+	}
+
+	notification, _ := android["notification"].(map[string]interface{})
+	if notification["title"] != "foo" || notification["body"] != "foobar" {
+		t.Fatalf("Expected a notification message, instead %+v", android)
+	}
+
+	data := sends[0]["data"].(map[string]interface{})
+	if data["event"] != "foobaz" || data["data"] != `{"message_text":"foobar","title":"foo"}` {
+		t.Fatalf("Expected string data values, instead %+v", data)
+	}
+
+	resp, err := client.Send(gcm.NewMessage(map[string]interface{}{"event": "foobaz"}, "123456", "baddevice"), 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if resp.Success != 1 || resp.Failure != 1 || resp.Results[1].Error != "NotRegistered" {
+		t.Fatalf("Expected the bad registration id to fail as NotRegistered, instead %+v", resp)
+	}
+
+	if _, ok := sends[2]["android"].(map[string]interface{})["notification"]; ok {
+		t.Fatalf("Expected a data message by default, instead %+v", sends[2])
+	}
+
+	if tokenRequests != 1 {
+		t.Fatalf("Expected the access token to be reused between sends, instead %d token requests", tokenRequests)
+	}
+}
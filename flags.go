@@ -1,6 +0,0 @@
-package incus
-
-var (
-	DEBUG        bool = false
-	CLIENT_BROAD bool = false
-)
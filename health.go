@@ -0,0 +1,364 @@
+package incus
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// The status of each readiness check. Only failures make the node unready;
+// warnings are for people to act on.
+const (
+	HealthOK   = "ok"
+	HealthWarn = "warn"
+	HealthFail = "fail"
+)
+
+// When the process started, for the uptime reported by /healthz.
+var processStarted = time.Now()
+
+// HealthThresholds are the limits past which readiness checks fail, or warn.
+type HealthThresholds struct {
+	RedisTimeout     time.Duration // to PING Redis
+	RedisPoolUsage   float64       // of redis_pool_max_active in use
+	QueueMaxAge      time.Duration // since the message queue was last polled
+	MaxConnections   int           // sockets on this node, 0 for no limit
+	APNSCertWarnDays int           // before an APNS certificate expires
+}
+
+func NewHealthThresholds(v *viper.Viper) HealthThresholds {
+	return HealthThresholds{
+		RedisTimeout:     time.Duration(v.GetInt("health_redis_timeout")) * time.Millisecond,
+		RedisPoolUsage:   v.GetFloat64("health_redis_pool_usage"),
+		QueueMaxAge:      time.Duration(v.GetInt("health_queue_max_age")) * time.Second,
+		MaxConnections:   v.GetInt("health_max_connections"),
+		APNSCertWarnDays: v.GetInt("health_apns_cert_warn_days"),
+	}
+}
+
+type HealthReport struct {
+	Status string                  `json:"status"`
+	Checks map[string]*HealthCheck `json:"checks"`
+}
+
+type HealthCheck struct {
+	Status string                 `json:"status"`
+	Error  string                 `json:"error,omitempty"`
+	Info   map[string]interface{} `json:"info,omitempty"`
+}
+
+func newHealthCheck() *HealthCheck {
+	return &HealthCheck{Status: HealthOK, Info: make(map[string]interface{})}
+}
+
+// fail marks the check failed, keeping the first reason.
+func (this *HealthCheck) fail(err error) {
+	this.Status = HealthFail
+	if this.Error == "" {
+		this.Error = err.Error()
+	}
+}
+
+func (this *HealthCheck) warn(err error) {
+	if this.Status == HealthOK {
+		this.Status = HealthWarn
+		this.Error = err.Error()
+	}
+}
+
+// pushStatus is what came of the last push notifications on a platform.
+type pushStatus struct {
+	lastSuccess time.Time
+	lastError   error
+	lastErrorAt time.Time
+}
+
+type pushHealth struct {
+	mu        sync.Mutex
+	platforms map[string]*pushStatus
+}
+
+func (this *Server) recordPush(platform string, err error) {
+	this.pushes.mu.Lock()
+	defer this.pushes.mu.Unlock()
+
+	if this.pushes.platforms == nil {
+		this.pushes.platforms = make(map[string]*pushStatus)
+	}
+
+	status, ok := this.pushes.platforms[platform]
+	if !ok {
+		status = &pushStatus{}
+		this.pushes.platforms[platform] = status
+	}
+
+	if err != nil {
+		status.lastError = err
+		status.lastErrorAt = time.Now()
+	} else {
+		status.lastSuccess = time.Now()
+	}
+}
+
+func (this *Server) pushStatus(platform string) (pushStatus, bool) {
+	this.pushes.mu.Lock()
+	defer this.pushes.mu.Unlock()
+
+	status, ok := this.pushes.platforms[platform]
+	if !ok {
+		return pushStatus{}, false
+	}
+
+	return *status, true
+}
+
+// LivenessHandler serves /healthz, answering as long as the process is able
+// to serve requests at all. Unless detailed, which is only for the admin
+// listener, it says nothing more than its status.
+func (this *Server) LivenessHandler(detailed bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !detailed {
+			writeJSON(w, 200, map[string]string{"status": HealthOK})
+			return
+		}
+
+		writeJSON(w, 200, map[string]interface{}{
+			"status":     HealthOK,
+			"uptime":     int64(time.Since(processStarted) / time.Second),
+			"goroutines": runtime.NumGoroutine(),
+		})
+	})
+}
+
+// ReadinessHandler serves /readyz, reporting whether this node should be
+// sent clients: 200 if no check failed, 503 otherwise. thresholds is called
+// on every request, so that reloaded thresholds apply. The checks are only
+// included if detailed, as they are no business of the public listener.
+func (this *Server) ReadinessHandler(thresholds func() HealthThresholds, detailed bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := this.Readiness(thresholds())
+
+		status := 200
+		if report.Status == HealthFail {
+			status = 503
+		}
+
+		if !detailed {
+			writeJSON(w, status, map[string]string{"status": report.Status})
+			return
+		}
+
+		writeJSON(w, status, report)
+	})
+}
+
+// Readiness checks Redis, the message bus, push notifications and the
+// number of connections against thresholds.
+func (this *Server) Readiness(thresholds HealthThresholds) *HealthReport {
+	report := &HealthReport{Status: HealthOK, Checks: make(map[string]*HealthCheck)}
+
+	if this.isDraining() {
+		check := newHealthCheck()
+		check.fail(errors.New("Shutting down"))
+		report.Checks["draining"] = check
+	}
+
+	if this.Store.redis != nil {
+		report.Checks["redis"] = this.checkRedis(thresholds)
+	}
+
+	if this.Store.bus != nil {
+		report.Checks["subscriptions"], report.Checks["queue"] = this.checkBus(thresholds)
+	}
+
+	report.Checks["push"] = this.checkPush(thresholds)
+	report.Checks["connections"] = this.checkConnections(thresholds)
+
+	for _, check := range report.Checks {
+		if check.Status == HealthFail {
+			report.Status = HealthFail
+		} else if check.Status == HealthWarn && report.Status == HealthOK {
+			report.Status = HealthWarn
+		}
+	}
+
+	return report
+}
+
+func (this *Server) checkRedis(thresholds HealthThresholds) *HealthCheck {
+	check := newHealthCheck()
+
+	started := time.Now()
+	pinged := make(chan error, 1)
+	go func() {
+		conn, err := this.Store.redis.GetConn()
+		if err != nil {
+			pinged <- err
+			return
+		}
+		defer this.Store.redis.CloseConn(conn)
+
+		_, err = conn.Do("PING")
+		pinged <- err
+	}()
+
+	select {
+	case err := <-pinged:
+		check.Info["latency_ms"] = int64(time.Since(started) / time.Millisecond)
+		if err != nil {
+			check.fail(err)
+		}
+	case <-time.After(thresholds.RedisTimeout):
+		check.fail(fmt.Errorf("No reply to PING within %s", thresholds.RedisTimeout))
+	}
+
+	active, idle := this.Store.redis.PoolStats()
+	maxActive := this.Store.redis.pool.maxActive
+	check.Info["pool_active"] = active
+	check.Info["pool_idle"] = idle
+	check.Info["pool_max_active"] = maxActive
+
+	if maxActive > 0 && float64(active) >= thresholds.RedisPoolUsage*float64(maxActive) {
+		check.fail(fmt.Errorf("%d of %d pool connections in use", active, maxActive))
+	}
+
+	return check
+}
+
+func (this *Server) checkBus(thresholds HealthThresholds) (subscriptions, queue *HealthCheck) {
+	health := this.Store.bus.Health()
+
+	subscriptions = newHealthCheck()
+	subscriptions.Info["subscriptions"] = health.Subscriptions
+	subscriptions.Info["subscribed"] = health.Subscribed
+	if health.Subscribed < health.Subscriptions {
+		subscriptions.fail(fmt.Errorf("%d of %d subscriptions not receiving", health.Subscriptions-health.Subscribed, health.Subscriptions))
+	}
+
+	queue = newHealthCheck()
+	queue.Info["polling"] = health.Polling
+	if !health.LastPoll.IsZero() {
+		age := time.Since(health.LastPoll)
+		queue.Info["last_poll_seconds"] = int64(age / time.Second)
+
+		if age > thresholds.QueueMaxAge {
+			queue.fail(fmt.Errorf("Queue last polled %s ago", age/time.Second*time.Second))
+		}
+	}
+
+	if !health.Polling {
+		queue.fail(errors.New("Queue is not being polled"))
+	}
+
+	return subscriptions, queue
+}
+
+func (this *Server) checkPush(thresholds HealthThresholds) *HealthCheck {
+	check := newHealthCheck()
+	push := this.runtimeOptions().Push
+
+	platforms := map[string]bool{
+		"ios":     push.APNSEnabled,
+		"android": push.GCMEnabled,
+		"web":     push.WebPushEnabled,
+	}
+
+	for platform, enabled := range platforms {
+		info := map[string]interface{}{"enabled": enabled}
+		check.Info[platform] = info
+
+		if !enabled {
+			continue
+		}
+
+		status, ok := this.pushStatus(platform)
+		if !ok {
+			continue
+		}
+
+		if !status.lastSuccess.IsZero() {
+			info["last_success"] = status.lastSuccess.Unix()
+		}
+
+		if status.lastError != nil {
+			info["last_error"] = status.lastError.Error()
+			info["last_error_at"] = status.lastErrorAt.Unix()
+		}
+	}
+
+	if platforms["ios"] && push.APNSProvider != "token" {
+		certificates := make(map[string]interface{})
+		check.Info["ios"].(map[string]interface{})["certificates"] = certificates
+
+		for _, build := range apnsBuilds {
+			expires, err := certificateExpiry(push.APNSCerts[build])
+			if err != nil {
+				check.fail(fmt.Errorf("APNS %s certificate: %s", build, err.Error()))
+				continue
+			}
+
+			days := int(time.Until(expires).Hours() / 24)
+			certificates[build] = map[string]interface{}{"expires": expires.Unix(), "days_left": days}
+
+			if time.Now().After(expires) {
+				check.fail(fmt.Errorf("APNS %s certificate expired on %s", build, expires.Format("2006-01-02")))
+			} else if days < thresholds.APNSCertWarnDays {
+				check.warn(fmt.Errorf("APNS %s certificate expires in %d days", build, days))
+			}
+		}
+	}
+
+	return check
+}
+
+func (this *Server) checkConnections(thresholds HealthThresholds) *HealthCheck {
+	check := newHealthCheck()
+
+	count, _ := this.Store.memory.Count()
+
+	check.Info["count"] = count
+	if thresholds.MaxConnections > 0 {
+		check.Info["max"] = thresholds.MaxConnections
+
+		if count >= int64(thresholds.MaxConnections) {
+			check.fail(fmt.Errorf("%d connections, at most %d", count, thresholds.MaxConnections))
+		}
+	}
+
+	return check
+}
+
+// certificateExpiry returns when the first certificate in a PEM file expires.
+func certificateExpiry(file string) (time.Time, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	for {
+		var block *pem.Block
+		block, contents = pem.Decode(contents)
+		if block == nil {
+			return time.Time{}, errors.New("No certificate in " + file)
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		return cert.NotAfter, nil
+	}
+}
@@ -0,0 +1,121 @@
+package incus
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeBus struct {
+	health    BusHealth
+	published []string
+	pushed    []string
+}
+
+func (this *fakeBus) Subscribe(c chan []byte, channel string) error { return nil }
+func (this *fakeBus) Poll(c chan []byte, queue string) error        { return nil }
+func (this *fakeBus) StopPolling()                                  {}
+func (this *fakeBus) Health() BusHealth                             { return this.health }
+
+func (this *fakeBus) Publish(channel string, message string) {
+	this.published = append(this.published, message)
+}
+
+func (this *fakeBus) Push(queue string, message string) {
+	this.pushed = append(this.pushed, message)
+}
+
+func TestReadiness(t *testing.T) {
+	bus := &fakeBus{health: BusHealth{Subscriptions: 1, Subscribed: 1, Polling: true, LastPoll: time.Now()}}
+
+	server := &Server{Store: newTestHistoryStore(0), Stats: &DiscardStats{}}
+	server.Store.bus = bus
+
+	thresholds := HealthThresholds{QueueMaxAge: time.Minute, MaxConnections: 2}
+	handler := server.ReadinessHandler(func() HealthThresholds { return thresholds }, true)
+
+	ready := func() (int, *HealthReport) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+
+		report := new(HealthReport)
+		json.Unmarshal(w.Body.Bytes(), report)
+
+		return w.Code, report
+	}
+
+	server.Store.Save(newSocket(nil, httptest.NewRecorder(), server, "health-test"))
+
+	if code, report := ready(); code != 200 || report.Status != HealthOK {
+		t.Fatalf("Expected to be ready, instead %d %+v", code, report)
+	}
+
+	public := httptest.NewRecorder()
+	server.ReadinessHandler(func() HealthThresholds { return thresholds }, false).ServeHTTP(public, httptest.NewRequest("GET", "/readyz", nil))
+	if public.Code != 200 || strings.TrimSpace(public.Body.String()) != `{"status":"ok"}` {
+		t.Fatalf("Expected the public report to carry only the status, instead %d %s", public.Code, public.Body.String())
+	}
+
+	server.Store.Save(newSocket(nil, httptest.NewRecorder(), server, "health-test"))
+	if code, report := ready(); code != 503 || report.Checks["connections"].Status != HealthFail {
+		t.Errorf("Expected too many connections to make the node unready, instead %d %+v", code, report.Checks["connections"])
+	}
+
+	thresholds.MaxConnections = 0
+	handler = server.ReadinessHandler(func() HealthThresholds { return thresholds }, true)
+
+	bus.health.Subscribed = 0
+	if code, report := ready(); code != 503 || report.Checks["subscriptions"].Status != HealthFail {
+		t.Errorf("Expected a dead subscription to make the node unready, instead %d %+v", code, report.Checks["subscriptions"])
+	}
+
+	bus.health.Subscribed = 1
+	bus.health.LastPoll = time.Now().Add(-2 * time.Minute)
+	if code, report := ready(); code != 503 || report.Checks["queue"].Status != HealthFail {
+		t.Errorf("Expected a stalled poller to make the node unready, instead %d %+v", code, report.Checks["queue"])
+	}
+
+	bus.health.LastPoll = time.Now()
+	server.draining = 1
+	if code, report := ready(); code != 503 || report.Checks["draining"] == nil {
+		t.Errorf("Expected a draining node to be unready, instead %d %+v", code, report)
+	}
+}
+
+func TestCertificateExpiry(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notAfter := time.Now().Add(72 * time.Hour).Truncate(time.Second)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now(), NotAfter: notAfter}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "cert.pem")
+	keyBlock := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("not a key")})
+	certBlock := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	ioutil.WriteFile(file, append(keyBlock, certBlock...), 0600)
+
+	expires, err := certificateExpiry(file)
+	if err != nil || !expires.Equal(notAfter) {
+		t.Errorf("Expected the certificate to expire at %s, got %s %v", notAfter, expires, err)
+	}
+
+	if _, err := certificateExpiry(filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Errorf("Expected a missing certificate to be an error")
+	}
+}
@@ -1,12 +1,17 @@
-function Incus(url, UID, page) {
+function Incus(url, UID, page, token) {
     this.MAXRETRIES   = 6;
     
-    this.socketRetries = 0;
-    this.pollRetries   = 0;
+    this.socketRetries  = 0;
+    this.pollRetries    = 0;
+    this.reconnectDelay = null;
 
     this.url          = url;
     this.UID          = UID;
     this.page         = page;
+    this.token        = token;
+    this.topics       = [];
+    this.autoAck      = false;
+    this.lastID       = null;
     
     this.onMessageCbs = {};
     this.connectedCb  = false;
@@ -29,9 +34,18 @@ Incus.prototype.longpoll = function(command) {
     this.poll = new XMLHttpRequest();
     
     var data = {'user': this.UID};
+    if(this.token) {
+        data['token'] = this.token;
+    }
+    if(this.topics.length > 0) {
+        data['topics'] = this.topics.join(',');
+    }
     if(this.page) {
         data['page'] = this.page;
     }
+    if(this.lastID !== null) {
+        data['last_id'] = this.lastID;
+    }
     
     if(typeof command != 'undefined') {
         data['command'] = command;
@@ -106,10 +120,26 @@ Incus.prototype.authenticate = function() {
     this.socketConnected = true;
     this.poll.abort();
     
-    var message = this.newCommand({'command': "authenticate", 'user': this.UID}, {});
+    var command = {'command': "authenticate", 'user': this.UID};
+    if(this.token) {
+        command['token'] = this.token;
+    }
+    // Replays the user and page messages missed while disconnected.
+    if(this.lastID !== null) {
+        command['last_id'] = String(this.lastID);
+        if(this.page) {
+            command['page'] = this.page;
+        }
+    }
+
+    var message = this.newCommand(command, {});
     
     this.socket.send(message);
     
+    for(var i = 0; i < this.topics.length; i++) {
+        this.socket.send(this.newCommand({'command': 'subscribe', 'topic': this.topics[i]}, {}));
+    }
+    
     if(this.page) {
         this.setPage(this.page);
     }
@@ -139,11 +169,26 @@ Incus.prototype.onMessage = function(e) {
 
     var msg = JSON.parse(e.data);
 
+    // Message IDs increase, and are sent back as last_id on reconnect.
+    // EventSource does the same on its own with Last-Event-ID.
+    if("id" in msg && (this.lastID === null || msg.id > this.lastID)) {
+        this.lastID = msg.id;
+    }
+
+    // The server is shutting down, and says when to reconnect to another.
+    if(msg.event == "reconnect" && msg.data) {
+        this.reconnectDelay = msg.data.retry_after;
+    }
+
     if("event" in msg && msg.event in this.onMessageCbs) {
         if(typeof this.onMessageCbs[msg.event] == "function") {
             this.onMessageCbs[msg.event].call(null, msg.data);
         }
     }
+    
+    if(this.autoAck && "id" in msg) {
+        this.ack(msg.id);
+    }
 }
 
 Incus.prototype.onClose = function() {
@@ -154,12 +199,15 @@ Incus.prototype.onClose = function() {
     this.socketRetries++;
     this.connected = false;
     
+    var delay = this.reconnectDelay || 1000;
+    this.reconnectDelay = null;
+    
     var self = this;
     window.setTimeout(function() {
         console.log("Connection closed, retrying");
         
         self.connectSocket();
-    }, 1000);
+    }, delay);
 }
 
 Incus.prototype.MessageUser = function(event, UID, data) {
@@ -199,6 +247,49 @@ Incus.prototype.setPage = function(page) {
     this.send();
 }
 
+Incus.prototype.MessageTopic = function(event, topic, data) {
+    var command = {"command": "message", "topic": topic};
+    var message = {"event": event, "data": data};
+    
+    var msg = this.newCommand(command, message);
+    return this.send(msg);
+}
+
+Incus.prototype.subscribe = function(topic) {
+    if(this.topics.indexOf(topic) == -1) {
+        this.topics.push(topic);
+    }
+    
+    if(this.socketConnected) {
+        var command = {'command': 'subscribe', 'topic': topic};
+        
+        return this.send(this.newCommand(command, {}));
+    }
+    
+    this.send();
+}
+
+Incus.prototype.unsubscribe = function(topic) {
+    var index = this.topics.indexOf(topic);
+    if(index != -1) {
+        this.topics.splice(index, 1);
+    }
+    
+    if(this.socketConnected) {
+        var command = {'command': 'unsubscribe', 'topic': topic};
+        
+        return this.send(this.newCommand(command, {}));
+    }
+    
+    this.send();
+}
+
+Incus.prototype.ack = function(id) {
+    var command = {'command': 'ack', 'id': String(id)};
+    
+    return this.send(this.newCommand(command, {}));
+}
+
 Incus.prototype.serialize = function(obj) {
    var str = [];
    
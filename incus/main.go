@@ -3,7 +3,6 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
@@ -18,13 +17,12 @@ import (
 const (
 	defaultConfigFilePath = "./"
 	configFilePathUsage   = "config file directory (eg. '/etc/incus/'). Config file must be named 'config.yml'."
-
-	gracefulShutdownTimeout = 5
 )
 
 var (
 	configFilePath string
 	store          *incus.Storage
+	logger         *incus.Logger
 )
 
 // Inserted at compile time by -ldflags "-X main.BUILD foo"
@@ -45,40 +43,48 @@ func main() {
 
 	defer func() {
 		if err := recover(); err != nil {
-			log.Printf("Caught panic in the main thread: %s", err)
+			logger.Error("Caught panic in the main thread", "error", err)
 			shutdown()
 		}
 	}()
 
 	incus.NewConfig(configFilePath)
-	initLogger()
-	log.Printf("Incus built on %s", BUILD)
-
-	InstallSignalHandlers()
+	logger = incus.NewConfigLogger()
+	logger.Info("Starting", "build", BUILD)
 
 	var stats incus.RuntimeStats
 
 	if viper.GetBool("datadog_enabled") {
 		stats, _ = incus.NewDatadogStats(viper.GetString("datadog_host"))
+	} else if viper.GetBool("prometheus_enabled") {
+		prometheusStats := incus.NewPrometheusStats()
+		go listenAndServeMetrics(prometheusStats.Handler())
+		stats = prometheusStats
 	} else {
 		stats = &incus.DiscardStats{}
 	}
 
 	stats.LogStartup()
 
-	store = incus.NewStore(stats)
+	store = incus.NewStore(stats, logger)
 
-	incus.CLIENT_BROAD = viper.GetBool("client_broadcasts")
-	server := incus.NewServer(store, stats)
+	server := incus.NewServer(store, stats, logger)
+
+	InstallSignalHandlers(server)
 
 	go server.RecordStats(1 * time.Second)
 	go server.LogConnectedClientsPeriodically(20 * time.Second)
+	go server.ExpireHistoryPeriodically(time.Minute, time.Duration(viper.GetInt("history_ttl"))*time.Second)
+	go server.ExpireAcksPeriodically(5 * time.Second)
 	go server.ListenFromRedis()
 	go server.ListenFromSockets()
 	go server.ListenFromLongpoll()
+	go server.ListenFromSSE()
 	go server.MonitorLongpollKillswitch()
 
 	go server.ListenForHTTPPings()
+	go server.ListenFromAPI()
+	go listenAndServeAdmin(server)
 	go server.SendHeartbeatsPeriodically(20 * time.Second)
 
 	go listenAndServeTLS()
@@ -89,7 +95,44 @@ func listenAndServe() {
 	listenAddr := fmt.Sprintf(":%s", viper.GetString("listening_port"))
 	err := http.ListenAndServe(listenAddr, nil)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("Error listening", "addr", listenAddr, "error", err)
+	}
+}
+
+// Serves metrics on the main listener, or on their own port if prometheus_port is set.
+func listenAndServeMetrics(handler http.Handler) {
+	path := viper.GetString("prometheus_path")
+	port := viper.GetString("prometheus_port")
+
+	if port == "" {
+		http.Handle(path, handler)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, handler)
+
+	err := http.ListenAndServe(fmt.Sprintf(":%s", port), mux)
+	if err != nil {
+		logger.Fatal("Error serving metrics", "port", port, "error", err)
+	}
+}
+
+// Serves the admin API on its own port, so it can be kept off the public network.
+func listenAndServeAdmin(server *incus.Server) {
+	if !viper.GetBool("admin_enabled") {
+		return
+	}
+
+	token := viper.GetString("admin_token")
+	if token == "" {
+		logger.Warn("admin_token is not set, the admin API will reject every request")
+	}
+
+	listenAddr := fmt.Sprintf(":%s", viper.GetString("admin_port"))
+	err := http.ListenAndServe(listenAddr, server.AdminHandler(token))
+	if err != nil {
+		logger.Fatal("Error serving the admin API", "addr", listenAddr, "error", err)
 	}
 }
 
@@ -98,38 +141,44 @@ func listenAndServeTLS() {
 		tlsListenAddr := fmt.Sprintf(":%s", viper.GetString("tls_port"))
 		err := http.ListenAndServeTLS(tlsListenAddr, viper.GetString("cert_file"), viper.GetString("key_file"), nil)
 		if err != nil {
-			log.Println(err)
-			log.Fatal(err)
+			logger.Fatal("Error listening for TLS", "addr", tlsListenAddr, "error", err)
 		}
 	}
 }
 
-func InstallSignalHandlers() {
+func InstallSignalHandlers(server *incus.Server) {
+	go func() {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		for range reload {
+			logger.Info("Reloading config", "signal", "SIGHUP")
+			server.Reload()
+		}
+	}()
+
 	go func() {
 		signals := make(chan os.Signal, 1)
 		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 		sig := <-signals
-		log.Printf("%v caught, incus is going down...", sig)
-		log.Printf("Waiting %d seconds for goroutines to shut down...", gracefulShutdownTimeout)
+		logger.Info("Going down", "signal", sig)
+
+		drained := make(chan struct{})
+		go func() {
+			server.Drain(server.DrainTimeout())
+			close(drained)
+		}()
 
 		select {
-		case <-time.After(gracefulShutdownTimeout * time.Second):
+		case <-drained:
 			shutdown()
 		case sig := <-signals:
-			log.Printf("%v caught again. Exiting immediately...", sig)
+			logger.Warn("Caught again, exiting immediately", "signal", sig)
 			shutdown()
 		}
 	}()
 }
 
-func initLogger() {
-	incus.DEBUG = false
-	if viper.GetString("log_level") == "debug" {
-		incus.DEBUG = true
-	}
-}
-
 func shutdown() {
-	log.Println("Terminated")
+	logger.Info("Terminated")
 	os.Exit(0)
 }
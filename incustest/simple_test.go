@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"github.com/Imgur/incus"
@@ -11,6 +12,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -155,6 +157,147 @@ func TestReceivingMessageFromLongpollViaRedis(t *testing.T) {
 	}
 }
 
+func streamEvents(c chan string, user string) {
+	resp, err := http.Get("http://" + INCUSHOST + "/sse?user=" + url.QueryEscape(user))
+	if err != nil {
+		log.Printf("Error GETing: %s", err.Error())
+		close(c)
+		return
+	}
+	defer resp.Body.Close()
+
+	lines := bufio.NewScanner(resp.Body)
+	for lines.Scan() {
+		line := lines.Text()
+		if strings.HasPrefix(line, "id: ") || strings.HasPrefix(line, "data: ") {
+			c <- line
+		}
+	}
+	close(c)
+}
+
+func TestReceivingMessagesFromSSEViaRedis(t *testing.T) {
+	lineChan := make(chan string)
+	go streamEvents(lineChan, "sseuser")
+	// Give it a little time to set up the stream
+	time.Sleep(250 * time.Millisecond)
+
+	var lastID int64
+	for _, event := range []string{"first", "second"} {
+		go doredis("PUBLISH", "Incus", `{"command":{"command":"message","user":"sseuser"},"message":{"event":"`+event+`","data":{},"time":1}}`)
+
+		for _, prefix := range []string{"id: ", "data: "} {
+			select {
+			case line, ok := <-lineChan:
+				if !ok {
+					t.Fatalf("Stream unexpectedly closed!")
+				}
+
+				if !strings.HasPrefix(line, prefix) {
+					t.Fatalf("Expected line starting with %q, instead %q", prefix, line)
+				}
+
+				if prefix == "id: " {
+					var id int64
+					fmt.Sscanf(line, "id: %d", &id)
+					if id <= lastID {
+						t.Fatalf("Expected event id to increase past %d, instead %q", lastID, line)
+					}
+					lastID = id
+				}
+
+				if prefix == "data: " {
+					var msg incus.Message
+					if err := json.Unmarshal([]byte(strings.TrimPrefix(line, prefix)), &msg); err != nil {
+						t.Fatalf("Unexpected error unmarshalling %s: %s", line, err.Error())
+					}
+
+					if msg.Event != event {
+						t.Fatalf("Expected event to be %q, instead %s", event, msg.Event)
+					}
+				}
+			case <-time.After(20 * time.Second):
+				t.Fatalf("Timed out waiting for message")
+			}
+		}
+	}
+}
+
+func TestReceivingTopicMessageFromLongpollViaRedis(t *testing.T) {
+	msgChan := make(chan []byte)
+
+	lpParams := url.Values{}
+	lpParams.Set("user", "topicuser")
+	lpParams.Set("topics", "gallery:abc, notifications:topicuser")
+	go func() {
+		resp, err := http.PostForm("http://"+INCUSHOST+"/lp", lpParams)
+		if err != nil {
+			close(msgChan)
+			return
+		}
+		defer resp.Body.Close()
+		respBytes, _ := ioutil.ReadAll(resp.Body)
+		msgChan <- respBytes
+	}()
+	// Give it a little time to set up LP
+	time.Sleep(250 * time.Millisecond)
+
+	go doredis("PUBLISH", "Incus", `{"command":{"command":"message","topic":"notifications:topicuser"},"message":{"event":"topical","data":{},"time":1}}`)
+	select {
+	case msgBytes, ok := <-msgChan:
+		if !ok {
+			t.Fatalf("Channel unexpectedly closed!")
+		}
+
+		var msg incus.Message
+		if err := json.Unmarshal(msgBytes, &msg); err != nil {
+			t.Fatalf("Unexpected error unmarshalling %s: %s", msgBytes, err.Error())
+		}
+
+		if msg.Event != "topical" {
+			t.Fatalf("Expected event to be 'topical', instead %s", msg.Event)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatalf("Timed out waiting for message")
+	}
+}
+
+func TestLongpollReplaysMissedMessages(t *testing.T) {
+	for _, event := range []string{"missed1", "missed2"} {
+		<-doredis("PUBLISH", "Incus", `{"command":{"command":"message","user":"replayuser"},"message":{"event":"`+event+`","data":{},"time":1}}`)
+	}
+
+	// Give incus a little time to record both messages
+	time.Sleep(250 * time.Millisecond)
+
+	// Commands are handled concurrently, so the two may be recorded in either order.
+	seen := make(map[string]bool)
+	lastID := "0"
+	for i := 0; i < 2; i++ {
+		lpParams := url.Values{}
+		lpParams.Set("user", "replayuser")
+		lpParams.Set("last_id", lastID)
+		resp, err := http.PostForm("http://"+INCUSHOST+"/lp", lpParams)
+		if err != nil {
+			t.Fatalf("Error POSTing: %s", err.Error())
+		}
+
+		var msg incus.Message
+		err = json.NewDecoder(resp.Body).Decode(&msg)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Unexpected error unmarshalling response: %s", err.Error())
+		}
+
+		if msg.Event != "missed1" && msg.Event != "missed2" || seen[msg.Event] {
+			t.Fatalf("Expected a replayed event not seen yet, instead %q", msg.Event)
+		}
+
+		seen[msg.Event] = true
+		lastID = fmt.Sprintf("%d", msg.ID)
+	}
+}
+
 func TestSurvivesRedisDisconnect(t *testing.T) {
 	msgChan := make(chan []byte)
 	go pullMessage(msgChan, "", "baz", "")
@@ -0,0 +1,283 @@
+package incus
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (this Level) String() string {
+	if this < LevelDebug || this > LevelError {
+		return "unknown"
+	}
+
+	return levelNames[this]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.ToLower(name) == levelName {
+			return Level(level), nil
+		}
+	}
+
+	return LevelDebug, fmt.Errorf("Unknown log level %q, must be debug, info, warn or error", name)
+}
+
+// Logs written before a Logger is configured, and by code given a nil
+// *Logger, go here.
+var defaultLogger = NewLogger(os.Stderr, "logfmt", LevelInfo, 0, 0)
+
+// Logger writes leveled, structured logs: a message and pairs of fields, as
+// logfmt or JSON lines. Loggers made by With share their parent's output,
+// so SetLevel applies to all of them.
+type Logger struct {
+	out     *logOutput
+	fields  []interface{} // key, value, key, value...
+	sampled bool
+}
+
+type logOutput struct {
+	mu     sync.Mutex
+	w      io.Writer
+	json   bool
+	level  int32 // a Level, updated atomically
+	counts map[string]*logCount
+
+	// Of sampled logs with the same message, the first sampleInitial each
+	// second are written, then every sampleThereafter-th. 0 writes all.
+	sampleInitial    int
+	sampleThereafter int
+}
+
+type logCount struct {
+	second int64
+	n      int
+}
+
+func NewLogger(w io.Writer, format string, level Level, sampleInitial, sampleThereafter int) *Logger {
+	return &Logger{
+		out: &logOutput{
+			w:      w,
+			json:   format == "json",
+			level:  int32(level),
+			counts: make(map[string]*logCount),
+
+			sampleInitial:    sampleInitial,
+			sampleThereafter: sampleThereafter,
+		},
+	}
+}
+
+// NewConfigLogger makes the Logger configured by the log_* options, writing
+// to standard error.
+func NewConfigLogger() *Logger {
+	level, err := ParseLevel(viper.GetString("log_level"))
+	if err != nil {
+		panic(err)
+	}
+
+	format := viper.GetString("log_format")
+	if format != "logfmt" && format != "json" {
+		panic(errors.New("Unknown log_format " + format + ", must be logfmt or json"))
+	}
+
+	return NewLogger(os.Stderr, format, level, viper.GetInt("log_sample_initial"), viper.GetInt("log_sample_thereafter"))
+}
+
+func (this *Logger) orDefault() *Logger {
+	if this == nil {
+		return defaultLogger
+	}
+
+	return this
+}
+
+// With returns a Logger adding fields, given as pairs of keys and values,
+// to everything it writes.
+func (this *Logger) With(keyvals ...interface{}) *Logger {
+	this = this.orDefault()
+
+	fields := make([]interface{}, 0, len(this.fields)+len(keyvals))
+	fields = append(fields, this.fields...)
+	fields = append(fields, keyvals...)
+
+	return &Logger{out: this.out, fields: fields, sampled: this.sampled}
+}
+
+// Sampled returns a Logger for high-volume events, which writes only some of
+// the logs with the same message; see log_sample_initial.
+func (this *Logger) Sampled() *Logger {
+	this = this.orDefault()
+
+	return &Logger{out: this.out, fields: this.fields, sampled: true}
+}
+
+func (this *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&this.orDefault().out.level, int32(level))
+}
+
+func (this *Logger) Level() Level {
+	return Level(atomic.LoadInt32(&this.orDefault().out.level))
+}
+
+// Enabled is whether logs at level are written, for skipping work that only
+// logging needs.
+func (this *Logger) Enabled(level Level) bool {
+	return level >= this.Level()
+}
+
+func (this *Logger) Debug(msg string, keyvals ...interface{}) {
+	this.write(LevelDebug, msg, keyvals)
+}
+
+func (this *Logger) Info(msg string, keyvals ...interface{}) {
+	this.write(LevelInfo, msg, keyvals)
+}
+
+func (this *Logger) Warn(msg string, keyvals ...interface{}) {
+	this.write(LevelWarn, msg, keyvals)
+}
+
+func (this *Logger) Error(msg string, keyvals ...interface{}) {
+	this.write(LevelError, msg, keyvals)
+}
+
+// Fatal logs at error level and exits.
+func (this *Logger) Fatal(msg string, keyvals ...interface{}) {
+	this.write(LevelError, msg, keyvals)
+	os.Exit(1)
+}
+
+func (this *Logger) write(level Level, msg string, keyvals []interface{}) {
+	this = this.orDefault()
+	if !this.Enabled(level) {
+		return
+	}
+
+	now := time.Now().UTC()
+	if this.sampled && !this.out.sample(msg, now) {
+		return
+	}
+
+	fields := make([]interface{}, 0, 6+len(this.fields)+len(keyvals))
+	fields = append(fields, "time", now.Format(time.RFC3339Nano), "level", level.String(), "msg", msg)
+	fields = append(fields, this.fields...)
+	fields = append(fields, keyvals...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "")
+	}
+
+	var line bytes.Buffer
+	if this.out.json {
+		encodeJSON(&line, fields)
+	} else {
+		encodeLogfmt(&line, fields)
+	}
+	line.WriteByte('\n')
+
+	this.out.mu.Lock()
+	defer this.out.mu.Unlock()
+
+	this.out.w.Write(line.Bytes())
+}
+
+func (this *logOutput) sample(msg string, now time.Time) bool {
+	if this.sampleInitial <= 0 && this.sampleThereafter <= 0 {
+		return true
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	count, ok := this.counts[msg]
+	if !ok || count.second != now.Unix() {
+		count = &logCount{second: now.Unix()}
+		this.counts[msg] = count
+	}
+	count.n++
+
+	if count.n <= this.sampleInitial {
+		return true
+	}
+
+	return this.sampleThereafter > 0 && (count.n-this.sampleInitial)%this.sampleThereafter == 0
+}
+
+func encodeLogfmt(line *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			line.WriteByte(' ')
+		}
+
+		line.WriteString(fmt.Sprint(fields[i]))
+		line.WriteByte('=')
+
+		value := logValue(fields[i+1])
+		if value == "" || strings.ContainsAny(value, " =\"\\\t\n") {
+			value = strconv.Quote(value)
+		}
+		line.WriteString(value)
+	}
+}
+
+func encodeJSON(line *bytes.Buffer, fields []interface{}) {
+	line.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			line.WriteByte(',')
+		}
+
+		key, _ := json.Marshal(fmt.Sprint(fields[i]))
+		line.Write(key)
+		line.WriteByte(':')
+
+		var value []byte
+		var err error
+		switch v := fields[i+1].(type) {
+		case error, fmt.Stringer:
+			value, err = json.Marshal(logValue(v))
+		default:
+			value, err = json.Marshal(v)
+		}
+		if err != nil {
+			value, _ = json.Marshal(logValue(fields[i+1]))
+		}
+		line.Write(value)
+	}
+	line.WriteByte('}')
+}
+
+func logValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case nil:
+		return ""
+	}
+
+	return fmt.Sprint(value)
+}
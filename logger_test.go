@@ -0,0 +1,101 @@
+package incus
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLoggerLevels(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewLogger(&out, "logfmt", LevelWarn, 0, 0)
+
+	logger.Info("hidden")
+	logger.With("sid", "abc").Warn("Slow consumer", "queued", 3, "error", errors.New("queue full"))
+
+	line := strings.TrimSpace(out.String())
+	if strings.Contains(line, "hidden") || strings.Count(out.String(), "\n") != 1 {
+		t.Fatalf("Expected only the warning to be written, got %q", out.String())
+	}
+
+	for _, field := range []string{"level=warn", `msg="Slow consumer"`, "sid=abc", "queued=3", `error="queue full"`} {
+		if !strings.Contains(line, field) {
+			t.Errorf("Expected %s in %q", field, line)
+		}
+	}
+
+	out.Reset()
+	logger.SetLevel(LevelDebug)
+	logger.Debug("shown")
+	if !strings.Contains(out.String(), "msg=shown") {
+		t.Errorf("Expected debug logs once the level is lowered, got %q", out.String())
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	var out bytes.Buffer
+	NewLogger(&out, "json", LevelDebug, 0, 0).With("uid", "u1").Error("Failed", "count", 2, "error", errors.New("boom"))
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &fields); err != nil {
+		t.Fatalf("Expected a JSON line, got %q: %s", out.String(), err)
+	}
+
+	if fields["level"] != "error" || fields["msg"] != "Failed" || fields["uid"] != "u1" || fields["count"] != float64(2) || fields["error"] != "boom" {
+		t.Errorf("Unexpected fields %+v", fields)
+	}
+}
+
+func TestLoggerSampling(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewLogger(&out, "logfmt", LevelDebug, 2, 3)
+
+	for i := 0; i < 11; i++ {
+		logger.Sampled().Debug("Sending message")
+		logger.Debug("Not sampled")
+	}
+
+	// The first 2, then the 5th, 8th and 11th.
+	if sent := strings.Count(out.String(), "Sending message"); sent != 5 {
+		t.Errorf("Expected 5 of 11 sampled logs to be written, got %d", sent)
+	}
+
+	if notSampled := strings.Count(out.String(), "Not sampled"); notSampled != 11 {
+		t.Errorf("Expected every log not sampled to be written, got %d", notSampled)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if level, err := ParseLevel("WARN"); err != nil || level != LevelWarn {
+		t.Errorf("Expected warn, got %s %v", level, err)
+	}
+
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("Expected an unknown level to be an error")
+	}
+}
+
+func TestSocketDebugEnabled(t *testing.T) {
+	var out bytes.Buffer
+	server := &Server{Log: NewLogger(&out, "logfmt", LevelInfo, 0, 0)}
+	sock := &Socket{Server: server}
+
+	if sock.debugEnabled() {
+		t.Fatalf("Expected debug logs to be off at info level")
+	}
+
+	if allocs := testing.AllocsPerRun(100, func() {
+		if sock.debugEnabled() {
+			sock.logger().Sampled().Debug("Sending message")
+		}
+	}); allocs != 0 {
+		t.Errorf("Expected skipped debug logs not to allocate, got %v allocations", allocs)
+	}
+
+	server.Log.SetLevel(LevelDebug)
+	if !sock.debugEnabled() {
+		t.Errorf("Expected debug logs to be on at debug level")
+	}
+}
@@ -1,108 +1,230 @@
 package incus
 
-import "errors"
-
+import (
+	"errors"
+	"time"
+)
+
+// MemoryStore keeps the sockets connected to this node, and, without Redis,
+// message history and pending acks. Its socket registries are safe for
+// concurrent use; Storage guards the rest.
 type MemoryStore struct {
-	clients map[string]map[string]*Socket
-	pages   map[string]map[string]*Socket
-
-	clientCount int64
-}
+	clients *socketRegistry // by UID
+	sockets *socketRegistry // by SID
+	pages   *socketRegistry // by page
+	topics  *socketRegistry // by topic
 
-func (this *MemoryStore) Save(sock *Socket) error {
-	user, exists := this.clients[sock.UID]
-
-	if !exists {
-		this.clientCount++
+	userHistory map[string]*messageHistory
+	pageHistory map[string]*messageHistory
+	historySize int
 
-		userMap := make(map[string]*Socket)
-		userMap[sock.SID] = sock
-		this.clients[sock.UID] = userMap
+	pendingAcks map[string]map[int64]*pendingAck
+}
 
-		return nil
+func newMemoryStore(historySize int) *MemoryStore {
+	return &MemoryStore{
+		clients:     newSocketRegistry(),
+		sockets:     newSocketRegistry(),
+		pages:       newSocketRegistry(),
+		topics:      newSocketRegistry(),
+		userHistory: make(map[string]*messageHistory),
+		pageHistory: make(map[string]*messageHistory),
+		historySize: historySize,
+		pendingAcks: make(map[string]map[int64]*pendingAck),
 	}
+}
 
-	_, exists = user[sock.SID]
-	user[sock.SID] = sock
-	if !exists {
-		this.clientCount++
-	}
+// A bounded, oldest-first list of recent messages for one user or page.
+type messageHistory struct {
+	entries []*historyEntry
+	updated time.Time
+}
+
+func (this *MemoryStore) Save(sock *Socket) error {
+	this.clients.Add(sock.UID, sock)
+	this.sockets.Add(sock.SID, sock)
 
 	return nil
 }
 
 func (this *MemoryStore) Remove(sock *Socket) error {
-	user, exists := this.clients[sock.UID]
-	if !exists { // only subtract if the client was in the store in the first place.
-		return nil
-	}
-
-	_, exists = user[sock.SID]
-	delete(user, sock.SID)
-	if exists {
-		this.clientCount--
-	}
-
-	if len(user) == 0 {
-		delete(this.clients, sock.UID)
-	}
+	this.clients.Remove(sock.UID, sock.SID)
+	this.sockets.Remove(sock.SID, sock.SID)
 
 	return nil
 }
 
 func (this *MemoryStore) Client(UID string) (map[string]*Socket, error) {
-	var client, exists = this.clients[UID]
+	var client = this.clients.Get(UID)
 
-	if !exists {
+	if client == nil {
 		return nil, errors.New("ClientID doesn't exist")
 	}
 	return client, nil
 }
 
+// Socket returns the connected socket SID, or nil.
+func (this *MemoryStore) Socket(SID string) *Socket {
+	return this.sockets.Get(SID)[SID]
+}
+
+// Clients returns a copy of every connected user's sockets, by UID.
 func (this *MemoryStore) Clients() map[string]map[string]*Socket {
-	return this.clients
+	clients := make(map[string]map[string]*Socket, this.clients.Len())
+
+	this.clients.Each(func(UID string, sock *Socket) {
+		user, exists := clients[UID]
+		if !exists {
+			user = make(map[string]*Socket)
+			clients[UID] = user
+		}
+
+		user[sock.SID] = sock
+	})
+
+	return clients
+}
+
+// Sockets returns every connected socket.
+func (this *MemoryStore) Sockets() []*Socket {
+	sockets := make([]*Socket, 0, this.clients.Size())
+
+	this.clients.Each(func(UID string, sock *Socket) {
+		sockets = append(sockets, sock)
+	})
+
+	return sockets
 }
 
 func (this *MemoryStore) Count() (int64, error) {
-	return this.clientCount, nil
+	return this.clients.Size(), nil
 }
 
 func (this *MemoryStore) SetPage(sock *Socket) error {
-	page, exists := this.pages[sock.Page]
-	if !exists {
-		pageMap := make(map[string]*Socket)
-		pageMap[sock.SID] = sock
-		this.pages[sock.Page] = pageMap
+	this.pages.Add(sock.Page, sock)
 
-		return nil
+	return nil
+}
+
+func (this *MemoryStore) UnsetPage(sock *Socket) error {
+	this.pages.Remove(sock.Page, sock.SID)
+
+	return nil
+}
+
+func (this *MemoryStore) getPage(page string) map[string]*Socket {
+	return this.pages.Get(page)
+}
+
+// PageCount returns how many sockets are on page.
+func (this *MemoryStore) PageCount(page string) int {
+	return this.pages.Count(page)
+}
+
+func (this *MemoryStore) SubscribeTopic(sock *Socket, topic string) error {
+	this.topics.Add(topic, sock)
+
+	return nil
+}
+
+func (this *MemoryStore) UnsubscribeTopic(sock *Socket, topic string) error {
+	this.topics.Remove(topic, sock.SID)
+
+	return nil
+}
+
+func (this *MemoryStore) getTopic(topic string) map[string]*Socket {
+	return this.topics.Get(topic)
+}
+
+func (this *MemoryStore) RecordHistory(histories map[string]*messageHistory, name string, entry *historyEntry) error {
+	history, exists := histories[name]
+	if !exists {
+		history = &messageHistory{}
+		histories[name] = history
 	}
 
-	page[sock.SID] = sock
+	history.entries = append(history.entries, entry)
+	if len(history.entries) > this.historySize {
+		history.entries = history.entries[len(history.entries)-this.historySize:]
+	}
+	history.updated = time.Now()
 
 	return nil
 }
 
-func (this *MemoryStore) UnsetPage(sock *Socket) error {
-	page, exists := this.pages[sock.Page]
+func (this *MemoryStore) History(histories map[string]*messageHistory, name string) []*historyEntry {
+	history, exists := histories[name]
 	if !exists {
 		return nil
 	}
 
-	delete(page, sock.SID)
+	entries := make([]*historyEntry, len(history.entries))
+	copy(entries, history.entries)
 
-	if len(page) == 0 {
-		delete(this.pages, sock.Page)
-	}
+	return entries
+}
 
-	return nil
+func (this *MemoryStore) ExpireHistory(histories map[string]*messageHistory, before time.Time) {
+	for name, history := range histories {
+		if history.updated.Before(before) {
+			delete(histories, name)
+		}
+	}
 }
 
-func (this *MemoryStore) getPage(page string) map[string]*Socket {
-	var p, exists = this.pages[page]
+func (this *MemoryStore) AddPendingAck(ack *pendingAck) {
+	user, exists := this.pendingAcks[ack.UID]
+	if !exists {
+		user = make(map[int64]*pendingAck)
+		this.pendingAcks[ack.UID] = user
+	}
+
+	user[ack.Message.ID] = ack
+}
 
+func (this *MemoryStore) Ack(UID string, id int64) *pendingAck {
+	user, exists := this.pendingAcks[UID]
 	if !exists {
 		return nil
 	}
 
-	return p
+	ack := user[id]
+	delete(user, id)
+
+	if len(user) == 0 {
+		delete(this.pendingAcks, UID)
+	}
+
+	return ack
+}
+
+func (this *MemoryStore) PendingAcks(UID string) []*pendingAck {
+	user := this.pendingAcks[UID]
+
+	acks := make([]*pendingAck, 0, len(user))
+	for _, ack := range user {
+		acks = append(acks, ack)
+	}
+
+	return acks
+}
+
+func (this *MemoryStore) ExpireAcks(now time.Time) []*pendingAck {
+	var expired []*pendingAck
+
+	for UID, user := range this.pendingAcks {
+		for id, ack := range user {
+			if ack.Expires <= now.Unix() {
+				expired = append(expired, ack)
+				delete(user, id)
+			}
+		}
+
+		if len(user) == 0 {
+			delete(this.pendingAcks, UID)
+		}
+	}
+
+	return expired
 }
@@ -1,12 +1,14 @@
 package incus
 
 import (
+	"strings"
 	"testing"
+	"time"
 )
 
 var Stats = &DiscardStats{}
 var ConfigFilePath = "./"
-var MemStore = NewStore(Stats).memory
+var MemStore = NewStore(Stats, nil).memory
 var Socket1 *Socket
 var Socket2 *Socket
 var Socket3 *Socket
@@ -22,62 +24,67 @@ func init() {
 func TestSave(t *testing.T) {
 	MemStore.Save(Socket1)
 
-	_, exists := MemStore.clients["TEST"]
-	if !exists {
+	if MemStore.clients.Get("TEST") == nil {
 		t.Errorf("Save Test failed, Client not found")
 	}
 
-	if MemStore.clientCount != 1 {
-		t.Errorf("Save Test failed, clientCount = %v, want %v", MemStore.clientCount, 1)
+	if MemStore.clients.Size() != 1 {
+		t.Errorf("Save Test failed, clientCount = %v, want %v", MemStore.clients.Size(), 1)
+	}
+
+	if MemStore.Socket(Socket1.SID) != Socket1 {
+		t.Errorf("Save Test failed, socket not found by SID")
 	}
 
 	MemStore.Save(Socket2)
-	if MemStore.clientCount != 2 {
-		t.Errorf("Save Test failed, clientCount = %v, want %v", MemStore.clientCount, 2)
+	if MemStore.clients.Size() != 2 {
+		t.Errorf("Save Test failed, clientCount = %v, want %v", MemStore.clients.Size(), 2)
 	}
 
 	MemStore.Save(Socket3)
-	if MemStore.clientCount != 3 {
-		t.Errorf("Save Test failed, clientCount = %v, want %v", MemStore.clientCount, 3)
+	if MemStore.clients.Size() != 3 {
+		t.Errorf("Save Test failed, clientCount = %v, want %v", MemStore.clients.Size(), 3)
 	}
 }
 
 func TestRemove(t *testing.T) {
-	if MemStore.clientCount != 3 {
-		t.Errorf("Remove Test is invalid, clientCount = %v, want %v", MemStore.clientCount, 3)
+	if MemStore.clients.Size() != 3 {
+		t.Errorf("Remove Test is invalid, clientCount = %v, want %v", MemStore.clients.Size(), 3)
 	}
 
 	MemStore.Remove(Socket1)
-	_, exists := MemStore.clients["TEST"]
-
-	if exists {
+	if MemStore.clients.Get("TEST") != nil {
 		t.Errorf("Remove Test failed, Client was not removed")
 	}
 
-	if MemStore.clientCount != 2 {
-		t.Errorf("Remove Test failed, clientCount = %v, want %v", MemStore.clientCount, 2)
+	if MemStore.Socket(Socket1.SID) != nil {
+		t.Errorf("Remove Test failed, socket still found by SID")
+	}
+
+	if MemStore.clients.Size() != 2 {
+		t.Errorf("Remove Test failed, clientCount = %v, want %v", MemStore.clients.Size(), 2)
 	}
 
 	MemStore.Remove(Socket1)
-	if MemStore.clientCount != 2 {
-		t.Errorf("Remove Test failed, clientCount = %v, want %v", MemStore.clientCount, 2)
+	if MemStore.clients.Size() != 2 {
+		t.Errorf("Remove Test failed, clientCount = %v, want %v", MemStore.clients.Size(), 2)
 	}
 
 	MemStore.Remove(Socket2)
-	if MemStore.clientCount != 1 {
-		t.Errorf("Remove Test failed, clientCount = %v, want %v", MemStore.clientCount, 1)
+	if MemStore.clients.Size() != 1 {
+		t.Errorf("Remove Test failed, clientCount = %v, want %v", MemStore.clients.Size(), 1)
 	}
 
-	if len(MemStore.clients) != 1 {
+	if MemStore.clients.Len() != 1 {
 		t.Errorf("Remove Test failed, clients map expected to be empty")
 	}
 
 	MemStore.Remove(Socket3)
-	if MemStore.clientCount != 0 {
-		t.Errorf("Remove Test failed, clientCount = %v, want %v", MemStore.clientCount, 0)
+	if MemStore.clients.Size() != 0 {
+		t.Errorf("Remove Test failed, clientCount = %v, want %v", MemStore.clients.Size(), 0)
 	}
 
-	if len(MemStore.clients) != 0 {
+	if MemStore.clients.Len() != 0 {
 		t.Errorf("Remove Test failed, clients map expected to be empty")
 	}
 }
@@ -116,3 +123,72 @@ func TestGetCount(t *testing.T) {
 	}
 
 }
+
+func TestTopics(t *testing.T) {
+	MemStore.SubscribeTopic(Socket1, "gallery")
+	MemStore.SubscribeTopic(Socket2, "gallery")
+	MemStore.SubscribeTopic(Socket2, "comments")
+
+	if len(MemStore.getTopic("gallery")) != 2 {
+		t.Errorf("Topic Test failed, gallery has %v subscribers, want %v", len(MemStore.getTopic("gallery")), 2)
+	}
+
+	MemStore.UnsubscribeTopic(Socket1, "gallery")
+	if _, exists := MemStore.getTopic("gallery")[Socket1.SID]; exists {
+		t.Errorf("Topic Test failed, Socket1 still subscribed to gallery")
+	}
+
+	MemStore.UnsubscribeTopic(Socket2, "gallery")
+	if MemStore.getTopic("gallery") != nil {
+		t.Errorf("Topic Test failed, empty topic was not removed")
+	}
+
+	if len(MemStore.getTopic("comments")) != 1 {
+		t.Errorf("Topic Test failed, unsubscribing from gallery affected comments")
+	}
+	MemStore.UnsubscribeTopic(Socket2, "comments")
+}
+
+func newTestHistoryStore(size int) *Storage {
+	return &Storage{
+		memory:         newMemoryStore(size),
+		StorageType:    "memory",
+		historyEnabled: true,
+	}
+}
+
+func TestHistory(t *testing.T) {
+	store := newTestHistoryStore(3)
+
+	for _, event := range []string{"one", "two", "three", "four"} {
+		store.RecordUserMessage("TEST", "", &Message{Event: event}, "")
+	}
+	store.RecordUserMessage("TEST", "/other", &Message{Event: "elsewhere"}, "")
+	store.RecordPageMessage("/gallery", &Message{Event: "page"}, "")
+
+	last, _ := store.LastMessageID()
+	if last != 6 {
+		t.Fatalf("Expected last message ID to be 6, instead %d", last)
+	}
+
+	entries, _ := store.History("TEST", "/gallery", 0, last)
+	events := make([]string, 0)
+	for _, entry := range entries {
+		events = append(events, entry.Message.Event)
+	}
+
+	// "one" fell out of the bounded history and "elsewhere" was scoped to another page.
+	if strings.Join(events, ",") != "three,four,page" {
+		t.Fatalf("Expected history to be three,four,page, instead %v", events)
+	}
+
+	entries, _ = store.History("TEST", "/gallery", 3, 5)
+	if len(entries) != 1 || entries[0].ID != 4 || entries[0].Message.ID != 4 {
+		t.Fatalf("Expected only message 4 after 3 up to 5, instead %+v", entries)
+	}
+
+	store.ExpireHistory(time.Now().Add(time.Minute))
+	if entries, _ := store.History("TEST", "/gallery", 0, last); len(entries) != 0 {
+		t.Fatalf("Expected expired history to be empty, instead %+v", entries)
+	}
+}
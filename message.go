@@ -2,22 +2,38 @@ package incus
 
 import (
 	"encoding/json"
-	"errors"
-	"log"
+	"fmt"
+	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/alexjlockwood/gcm"
 	apns "github.com/anachronistic/apns"
-	"github.com/spf13/viper"
 )
 
 type CommandMsg struct {
 	Command map[string]string      `json:"command"`
 	Message map[string]interface{} `json:"message,omitempty"`
+
+	// PublishID is unique to each publish of a command on the message bus,
+	// so that the nodes receiving it record it once. Commands without one
+	// aren't deduplicated.
+	PublishID string `json:"publish_id,omitempty"`
+
+	// Recorded is set by the node a message command entered Incus on, once
+	// it has recorded the message for the cluster and given it MessageID,
+	// so that the nodes it's sent on to don't record it again.
+	Recorded  bool  `json:"recorded,omitempty"`
+	MessageID int64 `json:"message_id,omitempty"`
+
+	// broadcast is set on commands every node received from the message
+	// channel without being recorded.
+	broadcast bool
 }
 
 type Message struct {
+	ID    int64                  `json:"id,omitempty"`
 	Event string                 `json:"event"`
 	Data  map[string]interface{} `json:"data"`
 	Time  int64                  `json:"time"`
@@ -25,207 +41,233 @@ type Message struct {
 }
 
 func (this *CommandMsg) FromSocket(sock *Socket) {
-	command, ok := this.Command["command"]
-	if !ok {
+	parsed, err := this.parseSocketCommand()
+	if err != nil {
+		sock.rejectCommand(err)
 		return
 	}
 
-	if DEBUG {
-		log.Printf("Handling socket message of type %s\n", command)
+	command := strings.ToLower(this.Command["command"])
+
+	if sock.debugEnabled() {
+		sock.logger().Sampled().Debug("Handling command", "command", command)
 	}
 
-	sock.Server.Stats.LogCommand("websocket", strings.ToLower(command))
+	sock.Server.Stats.LogCommand("websocket", command)
 
-	switch strings.ToLower(command) {
-	case "message":
-		if !CLIENT_BROAD {
+	switch cmd := parsed.(type) {
+	case *MessageCommand:
+		if !sock.Server.runtimeOptions().ClientBroadcasts {
 			return
 		}
 
-		if sock.Server.Store.StorageType == "redis" {
+		if sock.Server.Store.bus != nil {
 			this.forwardToRedis(sock.Server)
 			return
 		}
 
 		this.sendMessage(sock.Server)
 
-	case "setpage":
-		page, ok := this.Command["page"]
-		if !ok || page == "" {
-			return
-		}
-
+	case *SetPageCommand:
 		if sock.Page != "" {
 			sock.Server.Store.UnsetPage(sock) //remove old page if it exists
 		}
 
-		sock.Page = page
+		sock.Page = cmd.Page
 		sock.Server.Store.SetPage(sock) // set new page
-	case "setpresence":
-		active, ok := this.Message["presence"]
 
-		if !ok {
-			if DEBUG {
-				log.Printf("Ignoring presence command with no boolean presence")
+	case *AckCommand:
+		for _, ID := range cmd.IDs {
+			ack, err := sock.Server.Store.Ack(sock.UID, ID)
+			if err != nil {
+				sock.logger().Error("Error acking message", "id", ID, "error", err)
+			} else if ack != nil {
+				sock.Server.reportAck(ack, AckDelivered)
 			}
+		}
+
+	case *TopicCommand:
+		if cmd.Unsubscribe {
+			sock.Unsubscribe(cmd.Topic)
+		} else {
+			sock.Subscribe(cmd.Topic)
+		}
+
+	case *PresenceCommand:
+		if sock.Server.Store.redis == nil {
+			sock.logger().Debug("Ignoring presence command since redis is not enabled")
 
 			return
 		}
 
-		switch activeT := active.(type) {
-		case bool:
-			if activeT {
-				sock.Server.Store.redis.MarkActive(sock.UID, sock.SID, time.Now().Unix())
-			} else {
-				sock.Server.Store.redis.MarkInactive(sock.UID, sock.SID)
-			}
-		default:
-			if DEBUG {
-				log.Printf("Ignoring presence command with invalid (non-boolean) type")
-			}
+		if cmd.Active {
+			sock.Server.Store.redis.MarkActive(sock.UID, sock.SID, time.Now().Unix())
+		} else {
+			sock.Server.Store.redis.MarkInactive(sock.UID, sock.SID)
 		}
 	}
 }
 
 func (this *CommandMsg) FromRedis(server *Server) {
-	command, ok := this.Command["command"]
-	if !ok {
-		return
-	}
+	this.Handle(server, "redis")
+}
 
-	server.Stats.LogCommand("redis", strings.ToLower(command))
+// Handle carries out a command from an application, received from from,
+// reporting what came of it on this node. Commands that don't validate are
+// rejected, and reported on the command error queue by the node they entered
+// Incus on.
+func (this *CommandMsg) Handle(server *Server, from string) *CommandResult {
+	parsed, err := this.parseAppCommand()
+	if err != nil {
+		if this.broadcast {
+			server.Log.Sampled().Debug("Ignoring invalid command from the message channel", "command", err.Command, "reason", err.Reason)
+		} else if from != "api" {
+			server.rejectCommand(err, this)
+		}
 
-	if DEBUG {
-		log.Printf("Handling redis message of type %s\n", command)
+		return newRejectedResult(err)
 	}
 
-	switch strings.ToLower(command) {
+	command := strings.ToLower(this.Command["command"])
+	result := &CommandResult{Command: command, Status: CommandOK}
 
-	case "message":
-		this.sendMessage(server)
+	server.Stats.LogCommand(from, command)
 
-	case "pushios":
-		if viper.GetBool("apns_enabled") {
-			this.pushiOS(server)
-		}
+	server.Log.Sampled().Debug("Handling command", "from", from, "command", command)
 
-	case "pushandroid":
-		if viper.GetBool("gcm_enabled") {
-			this.pushAndroid(server)
-		}
+	switch cmd := parsed.(type) {
+	case *MessageCommand:
+		result.Recipients = this.sendMessage(server)
+
+	case *PushCommand:
+		result.addPush(cmd.Platform, this.push(server, cmd.Platform, command != "push"))
 
-	case "push":
-		if strings.ToLower(this.Command["push_type"]) == "ios" {
-			this.pushiOS(server)
+	case *PushOrMessageCommand:
+		active, err := server.Store.IsUserActive(cmd.User)
+		if err != nil {
+			server.Log.Error("Error fetching whether user was active", "uid", cmd.User, "error", err)
+			result.fail(err)
+			return result
 		}
 
-		if strings.ToLower(this.Command["push_type"]) == "android" {
-			this.pushAndroid(server)
+		if active {
+			result.Recipients = cmd.Websocket.sendMessage(server)
+			return result
 		}
-	case "pushormessage":
 
-		active, err := server.Store.redis.QueryIsUserActive(this.Command["user"], time.Now().Unix())
+		cmd.push(server, result)
+	}
 
-		if err == nil {
-			if active {
-				websocketMessage := &CommandMsg{
-					Command: this.Command,
-					Message: this.Message["websocket"].(map[string]interface{}),
-				}
+	return result
+}
 
-				websocketMessage.sendMessage(server)
-			} else {
+// push sends the push notifications for a user who isn't active, recording
+// what came of each in result.
+func (this *PushOrMessageCommand) push(server *Server, result *CommandResult) {
+	for _, platform := range []string{"ios", "android", "web"} {
+		if pushCommand, ok := this.Push[platform]; ok {
+			result.addPush(platform, pushCommand.push(server, platform, false))
+		}
+	}
+}
 
-				pushData, ok := this.Message["push"].(map[string]interface{})
+// messageCommand is the message command delivering the websocket message of
+// a pushormessage command, for sending across the cluster.
+func (this *PushOrMessageCommand) messageCommand() *CommandMsg {
+	command := map[string]string{"command": "message", "user": this.User}
+	if page, ok := this.Websocket.Command["page"]; ok {
+		command["page"] = page
+	}
 
-				if !ok {
-					return
-				}
+	return &CommandMsg{Command: command, Message: this.Websocket.Message}
+}
 
-				iosMessage, ok := pushData["ios"]
+// push sends a push notification on platform. If checkEnabled, it fails
+// rather than trying when the platform isn't enabled.
+func (this *CommandMsg) push(server *Server, platform string, checkEnabled bool) error {
+	var err error
+	enabled := server.runtimeOptions().Push
 
-				if ok {
-					iosCommand := &CommandMsg{
-						Command: this.Command,
-						Message: iosMessage.(map[string]interface{}),
-					}
-					iosCommand.pushiOS(server)
-				}
+	switch platform {
+	case "ios":
+		if checkEnabled && !enabled.APNSEnabled {
+			return errAPNSDisabled
+		}
 
-				androidMessage, ok := pushData["android"]
-				if ok {
-					androidCommand := &CommandMsg{
-						Command: this.Command,
-						Message: androidMessage.(map[string]interface{}),
-					}
-					androidCommand.pushAndroid(server)
-				}
+		err = this.pushiOS(server)
 
-			}
-		} else {
-			log.Printf("Error fetching whether %s was active: %s", this.Command["user"], err.Error())
+	case "android":
+		if checkEnabled && !enabled.GCMEnabled {
+			return errGCMDisabled
 		}
-	}
-}
 
-func (this *CommandMsg) formatMessage() (*Message, error) {
-	event, e_ok := this.Message["event"].(string)
-	data, b_ok := this.Message["data"].(map[string]interface{})
+		err = this.pushAndroid(server)
 
-	if !b_ok || !e_ok {
-		return nil, errors.New("Could not format message")
-	}
+	case "web":
+		if checkEnabled && !enabled.WebPushEnabled {
+			return errWebPushDisabled
+		}
 
-	msg := &Message{
-		Event: event,
-		Data:  data,
-		Time:  time.Now().UTC().Unix(),
+		err = this.pushWeb(server)
+
+	default:
+		return nil
 	}
 
-	// hack for bad version of Imgur iOS client
-	url, url_ok := data["internal_url"].(string)
-	if url_ok {
-		msg.Url = url
+	server.recordPush(platform, err)
+
+	return err
+}
+
+func (this *CommandMsg) formatMessage() (*Message, error) {
+	msg, err := this.parseMessage(strings.ToLower(this.Command["command"]))
+	if err != nil {
+		return nil, err
 	}
 
 	return msg, nil
 }
 
-func (this *CommandMsg) sendMessage(server *Server) {
+// sendMessage delivers a message command to the sockets on this node,
+// returning how many it was sent to.
+func (this *CommandMsg) sendMessage(server *Server) int {
 	user, userok := this.Command["user"]
 	page, pageok := this.Command["page"]
+	topic, topicok := this.Command["topic"]
 
 	if userok {
-		this.messageUser(user, page, server)
+		return this.messageUser(user, page, server)
+	} else if topicok {
+		return this.messageTopic(topic, server)
 	} else if pageok {
-		this.messagePage(page, server)
-	} else {
-		this.messageAll(server)
+		return this.messagePage(page, server)
 	}
+
+	return this.messageAll(server)
 }
 
-func (this *CommandMsg) pushiOS(server *Server) {
+func (this *CommandMsg) pushiOS(server *Server) error {
 	deviceToken, deviceTokenOkay := this.Command["device_token"]
 	build, buildOkay := this.Command["build"]
 
 	if !deviceTokenOkay {
-		log.Println("Device token not provided!")
-		return
+		server.Log.Warn("Device token not provided")
+		return errMissingDeviceToken
 	}
 
 	if !buildOkay {
-		log.Println("Build type not provided!")
-		return
+		server.Log.Warn("Build type not provided")
+		return errMissingBuild
 	}
 
 	msg, err := this.formatMessage()
 	if err != nil {
-		log.Println("Could not format message")
-		return
+		server.Log.Warn("Could not format message", "error", err)
+		return err
 	}
 
 	payload := apns.NewPayload()
-	payload.Sound = viper.GetString("ios_push_sound")
+	payload.Sound = server.runtimeOptions().IOSPushSound
 
 	// allow message or message_text to trigger Alert
 	if _, messageExists := msg.Data["message"]; messageExists {
@@ -235,9 +277,8 @@ func (this *CommandMsg) pushiOS(server *Server) {
 		payload.Alert = msg.Data["message_text"]
 	}
 
-	badgeAmt, hasBadge := msg.Data["badge_count"]
-	if hasBadge {
-		payload.Badge = int(badgeAmt.(float64))
+	if badgeAmt, ok := msg.Data["badge_count"].(float64); ok {
+		payload.Badge = int(badgeAmt)
 	}
 
 	pn := apns.NewPushNotification()
@@ -245,142 +286,380 @@ func (this *CommandMsg) pushiOS(server *Server) {
 	pn.AddPayload(payload)
 	pn.Set("payload", msg)
 
+	if priority, err := strconv.ParseUint(this.Command["apns_priority"], 10, 8); err == nil {
+		pn.Priority = uint8(priority)
+	}
+
+	if expiration, err := strconv.ParseUint(this.Command["apns_expiration"], 10, 32); err == nil {
+		pn.Expiry = uint32(expiration)
+	}
+
 	client := server.GetAPNSClient(build)
-	resp := client.Send(pn)
+
+	var resp *apns.PushNotificationResponse
+	if http2Client, ok := client.(*APNSHTTP2Client); ok {
+		resp = http2Client.SendWithHeaders(pn, APNSHeaders{
+			Topic:      this.Command["apns_topic"],
+			PushType:   this.Command["apns_push_type"],
+			CollapseID: this.Command["apns_collapse_id"],
+		})
+	} else {
+		resp = client.Send(pn)
+	}
+
 	alert, _ := pn.PayloadString()
 	server.Stats.LogAPNSPush()
 
 	if resp.Error != nil {
 		server.Stats.LogAPNSError()
-		log.Printf("Alert (iOS): %s\n", alert)
-		log.Printf("Error (iOS): %s\n", resp.Error)
+		server.Log.Warn("Error sending push notification", "platform", "ios", "build", build, "alert", alert, "error", resp.Error)
 	}
+
+	return resp.Error
 }
 
-func (this *CommandMsg) pushAndroid(server *Server) {
+func (this *CommandMsg) pushAndroid(server *Server) error {
 	registration_ids, registration_ids_ok := this.Command["registration_ids"]
 
 	if !registration_ids_ok {
-		log.Println("Registration ID(s) not provided!")
-		return
+		server.Log.Warn("Registration IDs not provided")
+		return errMissingRegistrationIDs
 	}
 
 	msg, err := this.formatMessage()
 	if err != nil {
-		log.Println("Could not format message")
-		return
+		server.Log.Warn("Could not format message", "error", err)
+		return err
 	}
 
 	data := map[string]interface{}{"event": msg.Event, "data": msg.Data, "time": msg.Time}
 
 	regIDs := strings.Split(registration_ids, ",")
 	gcmMessage := gcm.NewMessage(data, regIDs...)
+	gcmMessage.CollapseKey = this.Command["android_collapse_key"]
+	if ttl, err := strconv.Atoi(this.Command["android_ttl"]); err == nil {
+		gcmMessage.TimeToLive = ttl
+	}
 
 	sender := server.GetGCMClient()
 
 	server.Stats.LogGCMPush()
-	gcmResponse, gcmErr := sender.Send(gcmMessage, 2)
+	var gcmResponse *gcm.Response
+	var gcmErr error
+	if fcmClient, ok := sender.(*FCMClient); ok {
+		options := FCMOptions{Priority: this.Command["android_priority"]}
+		if this.Command["android_message_type"] == "notification" {
+			title, _ := msg.Data["title"].(string)
+			body, _ := msg.Data["message_text"].(string)
+			options.Notification = &FCMNotification{Title: title, Body: body}
+		}
+
+		gcmResponse, gcmErr = fcmClient.SendWithOptions(gcmMessage, options, 2)
+	} else {
+		gcmResponse, gcmErr = sender.Send(gcmMessage, 2)
+	}
 	if gcmErr != nil {
 		server.Stats.LogGCMError()
-		log.Printf("Error (Android): %s\n", gcmErr)
-		return
+		server.Log.Warn("Error sending push notification", "platform", "android", "error", gcmErr)
+		return gcmErr
 	}
 
 	if gcmResponse.Failure > 0 {
 		server.Stats.LogGCMFailure()
-		if !viper.GetBool("redis_enabled") {
-			log.Println("Could not push to android_error_queue since redis is not enabled")
-			return
+		failed := fmt.Errorf("%d of %d registration IDs failed", gcmResponse.Failure, len(regIDs))
+
+		if server.Store.bus == nil {
+			server.Log.Warn("Could not push to android_error_queue since neither redis nor nats is enabled")
+			return failed
 		}
 
 		failurePayload := map[string]interface{}{"registration_ids": regIDs, "results": gcmResponse.Results}
 
 		msg_str, _ := json.Marshal(failurePayload)
-		server.Store.redis.Push(viper.GetString("android_error_queue"), string(msg_str))
+		server.Store.bus.Push(server.runtimeOptions().AndroidErrorQueue, string(msg_str))
+
+		return failed
 	}
+
+	return nil
 }
 
-func (this *CommandMsg) messageUser(UID string, page string, server *Server) {
+func (this *CommandMsg) pushWeb(server *Server) error {
+	endpoint, endpointOk := this.Command["webpush_endpoint"]
+	if !endpointOk {
+		server.Log.Warn("Web push subscription not provided")
+		return errMissingWebPushEndpoint
+	}
+
+	sender := server.GetWebPushClient()
+	if sender == nil {
+		server.Log.Warn("Could not send web push since webpush is not enabled")
+		return errWebPushDisabled
+	}
+
 	msg, err := this.formatMessage()
 	if err != nil {
-		if DEBUG {
-			log.Printf("Error formatting message: %s", err.Error())
+		server.Log.Warn("Could not format message", "error", err)
+		return err
+	}
+
+	sub := &WebPushSubscription{
+		Endpoint: endpoint,
+		P256dh:   this.Command["webpush_p256dh"],
+		Auth:     this.Command["webpush_auth"],
+	}
+
+	options := WebPushOptions{
+		TTL:     webPushDefaultTTL,
+		Urgency: this.Command["webpush_urgency"],
+		Topic:   this.Command["webpush_topic"],
+	}
+	if ttl, err := strconv.Atoi(this.Command["webpush_ttl"]); err == nil {
+		options.TTL = ttl
+	}
+
+	payload, _ := json.Marshal(msg)
+
+	server.Stats.LogWebPush()
+	status, err := sender.Send(sub, payload, options)
+	if err == nil {
+		return nil
+	}
+
+	server.Stats.LogWebPushError()
+	server.Log.Warn("Error sending push notification", "platform", "web", "status", status, "error", err)
+
+	// The browser unsubscribed or the subscription expired.
+	if status == http.StatusNotFound || status == http.StatusGone {
+		if server.Store.bus == nil {
+			server.Log.Warn("Could not push to webpush_error_queue since neither redis nor nats is enabled")
+			return err
 		}
-		return
+
+		failurePayload := map[string]interface{}{"endpoint": endpoint, "status": status}
+
+		msg_str, _ := json.Marshal(failurePayload)
+		server.Store.bus.Push(server.runtimeOptions().Push.WebPushErrorQueue, string(msg_str))
 	}
 
-	user, err := server.Store.Client(UID)
+	return err
+}
+
+// record records a message command once for the cluster, where it enters
+// Incus and before it's sent on to the nodes delivering it: the message is
+// given an ID, kept in history and, for a user, kept until they ack it. It
+// returns false if the message was dropped by the rate limit.
+func (this *CommandMsg) record(server *Server) bool {
+	msg, err := this.formatMessage()
 	if err != nil {
-		if DEBUG {
-			log.Printf("Skipping UID %s because %s", UID, err.Error())
+		return false
+	}
+
+	user, userok := this.Command["user"]
+	page, pageok := this.Command["page"]
+	_, topicok := this.Command["topic"]
+
+	if userok {
+		if !server.allowMessage(user) {
+			return false
+		}
+
+		if err := server.Store.RecordUserMessage(user, page, msg, this.PublishID); err != nil {
+			server.Log.Error("Error recording message history", "uid", user, "error", err)
+		}
+	} else if pageok && !topicok {
+		if err := server.Store.RecordPageMessage(page, msg, this.PublishID); err != nil {
+			server.Log.Error("Error recording message history", "page", page, "error", err)
 		}
-		return
 	}
 
-	server.Stats.LogUserMessage()
+	if err := server.Store.AssignMessageID(msg, this.PublishID); err != nil {
+		server.Log.Error("Error assigning message ID", "error", err)
+	}
+
+	if userok {
+		if err := server.Store.AddPendingAck(user, page, msg); err != nil {
+			server.Log.Error("Error recording pending ack", "uid", user, "error", err)
+		}
+	}
 
+	this.MessageID = msg.ID
+	this.Recorded = true
+
+	return true
+}
+
+// keepsHistory is whether a message command not yet recorded should be
+// kept in history here. Commands every node received from the channel can
+// only be recorded once with a publish ID, and aren't recorded without one.
+func (this *CommandMsg) keepsHistory() bool {
+	return !this.broadcast || this.PublishID != ""
+}
+
+func (this *CommandMsg) messageUser(UID string, page string, server *Server) int {
+	msg, err := this.formatMessage()
+	if err != nil {
+		server.Log.Debug("Error formatting message", "error", err)
+		return 0
+	}
+
+	user, err := server.Store.Client(UID)
+	if err != nil {
+		server.Log.Sampled().Debug("Skipping user", "uid", UID, "error", err)
+	}
+
+	sockets := make([]*Socket, 0, len(user))
 	for _, sock := range user {
 		if page != "" && page != sock.Page {
-			if DEBUG {
-				log.Printf("Skipping given page %s != %s", page, sock.Page)
+			if sock.debugEnabled() {
+				sock.logger().Sampled().Debug("Skipping socket on another page", "want_page", page)
 			}
 
 			continue
 		}
 
-		if !sock.isClosed() {
-			sock.buff <- msg
-		} else {
-			if DEBUG {
-				log.Printf("Skipping because closed")
+		sockets = append(sockets, sock)
+	}
+
+	if this.Recorded {
+		msg.ID = this.MessageID
+	} else {
+		// A command every node received may be given a different ID by each,
+		// so it's only limited and kept pending by the nodes delivering it.
+		delivering := !this.broadcast || len(sockets) > 0
+
+		if delivering && !server.allowMessage(UID) {
+			return 0
+		}
+
+		if this.keepsHistory() {
+			if err := server.Store.RecordUserMessage(UID, page, msg, this.PublishID); err != nil {
+				server.Log.Error("Error recording message history", "uid", UID, "error", err)
+			}
+		}
+
+		if err := server.Store.AssignMessageID(msg, this.PublishID); err != nil {
+			server.Log.Error("Error assigning message ID", "uid", UID, "error", err)
+		}
+
+		// Pending until acked, so it's delivered again when the user reconnects.
+		if delivering {
+			if err := server.Store.AddPendingAck(UID, page, msg); err != nil {
+				server.Log.Error("Error recording pending ack", "uid", UID, "error", err)
 			}
 		}
 	}
+
+	if len(sockets) == 0 {
+		return 0
+	}
+
+	server.Stats.LogUserMessage()
+
+	sent := 0
+	for _, sock := range sockets {
+		if sock.send(msg) {
+			sent++
+		}
+	}
+
+	return sent
+}
+
+// assignMessageID gives msg the ID it was recorded with, or else a new one.
+func (this *CommandMsg) assignMessageID(msg *Message, server *Server) error {
+	if this.Recorded {
+		msg.ID = this.MessageID
+		return nil
+	}
+
+	return server.Store.AssignMessageID(msg, this.PublishID)
 }
 
-func (this *CommandMsg) messageAll(server *Server) {
+func (this *CommandMsg) messageAll(server *Server) int {
 	msg, err := this.formatMessage()
 	if err != nil {
-		return
+		return 0
 	}
 
 	server.Stats.LogBroadcastMessage()
-	clients := server.Store.Clients()
 
-	for _, user := range clients {
-		for _, sock := range user {
-			if !sock.isClosed() {
-				sock.buff <- msg
-			}
-		}
+	if err := this.assignMessageID(msg, server); err != nil {
+		server.Log.Error("Error assigning message ID", "error", err)
 	}
 
-	return
+	sent := 0
+	server.Store.EachSocket(func(sock *Socket) {
+		if sock.send(msg) {
+			sent++
+		}
+	})
+
+	return sent
 }
 
-func (this *CommandMsg) messagePage(page string, server *Server) {
+func (this *CommandMsg) messagePage(page string, server *Server) int {
 	msg, err := this.formatMessage()
 	if err != nil {
-		return
+		return 0
 	}
 
 	server.Stats.LogPageMessage()
 
-	pageMap := server.Store.getPage(page)
-	if pageMap == nil {
-		return
+	if !this.Recorded && this.keepsHistory() {
+		if err := server.Store.RecordPageMessage(page, msg, this.PublishID); err != nil {
+			server.Log.Error("Error recording message history", "page", page, "error", err)
+		}
+	}
+
+	if err := this.assignMessageID(msg, server); err != nil {
+		server.Log.Error("Error assigning message ID", "page", page, "error", err)
+	}
+
+	sent := 0
+	for _, sock := range server.Store.getPage(page) {
+		if sock.send(msg) {
+			sent++
+		}
+	}
+
+	return sent
+}
+
+func (this *CommandMsg) messageTopic(topic string, server *Server) int {
+	msg, err := this.formatMessage()
+	if err != nil {
+		return 0
+	}
+
+	server.Stats.LogTopicMessage()
+
+	if err := this.assignMessageID(msg, server); err != nil {
+		server.Log.Error("Error assigning message ID", "topic", topic, "error", err)
 	}
 
-	for _, sock := range pageMap {
-		if !sock.isClosed() {
-			sock.buff <- msg
+	sent := 0
+	for _, sock := range server.Store.getTopic(topic) {
+		if sock.send(msg) {
+			sent++
 		}
 	}
 
-	return
+	return sent
 }
 
 func (this *CommandMsg) forwardToRedis(server *Server) {
+	server.stampPublishID(this)
+
+	if server.Store.targetedRouting {
+		server.routeMessage(this)
+		return
+	}
+
+	if !this.record(server) {
+		return
+	}
+
 	msg_str, _ := json.Marshal(this)
-	server.Store.redis.Publish(viper.GetString("redis_message_channel"), string(msg_str)) //pass the message into redis to send message across cluster
+	server.Store.bus.Publish(server.Store.messageChannel, string(msg_str)) //pass the message into the bus to send message across cluster
 }
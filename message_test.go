@@ -110,3 +110,33 @@ func TestGCM(t *testing.T) {
 		t.Fatalf("Expected there to be two registration IDs, instead %+v in %+v", message.RegistrationIDs, message)
 	}
 }
+
+func TestMessageRecordedOnce(t *testing.T) {
+	server := &Server{Store: newTestHistoryStore(10), Stats: &DiscardStats{}}
+	message := map[string]interface{}{"event": "foo", "data": map[string]interface{}{}}
+
+	entered := &CommandMsg{Command: map[string]string{"command": "message", "user": "TEST"}, Message: message}
+	if !entered.record(server) || !entered.Recorded || entered.MessageID != 1 {
+		t.Fatalf("Expected the message to be recorded with ID 1, instead %+v", entered)
+	}
+
+	// As received by the nodes it's sent on to.
+	var received CommandMsg
+	data, _ := json.Marshal(entered)
+	json.Unmarshal(data, &received)
+	received.sendMessage(server)
+
+	broadcast := &CommandMsg{Command: map[string]string{"command": "message", "user": "TEST"}, Message: message, broadcast: true}
+	broadcast.sendMessage(server)
+
+	if entries, _ := server.Store.History("TEST", "", 0, 10); len(entries) != 1 || entries[0].ID != 1 {
+		t.Fatalf("Expected the message to be kept once, instead %+v", entries)
+	}
+
+	broadcast = &CommandMsg{Command: map[string]string{"command": "message", "user": "TEST"}, Message: message, PublishID: "app-1", broadcast: true}
+	broadcast.sendMessage(server)
+
+	if entries, _ := server.Store.History("TEST", "", 0, 10); len(entries) != 2 {
+		t.Fatalf("Expected a channel message with a publish ID to be kept, instead %+v", entries)
+	}
+}
@@ -0,0 +1,228 @@
+package incus
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NatsBus is a MessageBus over NATS. Channels are core NATS subjects, so
+// every subscribed node gets each message. Queues are subjects captured by a
+// JetStream stream, read through a durable consumer that all nodes share, so
+// commands published while no node is running are kept until one is.
+type NatsBus struct {
+	conn *nats.Conn
+	js   nats.JetStreamContext
+
+	stream   string
+	consumer string
+	ackWait  time.Duration
+	log      *Logger
+
+	mu       sync.Mutex
+	subs     []*nats.Subscription
+	queueSub *nats.Subscription
+	stopped  bool
+}
+
+// NewNatsBus connects to the NATS servers at url. Servers that are down are
+// retried in the background rather than failing startup.
+func NewNatsBus(url, stream, consumer string, ackWait time.Duration, logger *Logger) (*NatsBus, error) {
+	logger = logger.With("component", "nats")
+
+	conn, err := nats.Connect(url,
+		nats.Name("incus"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				logger.Warn("Disconnected from NATS", "error", err)
+			}
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			logger.Info("Reconnected to NATS", "url", conn.ConnectedUrl())
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &NatsBus{
+		conn:     conn,
+		js:       js,
+		stream:   stream,
+		consumer: consumer,
+		ackWait:  ackWait,
+		log:      logger,
+	}, nil
+}
+
+// Subscribe sends everything published on the channel subject to c. The
+// NATS client resubscribes by itself after reconnecting.
+func (this *NatsBus) Subscribe(c chan []byte, channel string) error {
+	sub, err := this.conn.Subscribe(channel, func(msg *nats.Msg) {
+		c <- msg.Data
+	})
+	if err != nil {
+		return err
+	}
+
+	this.mu.Lock()
+	this.subs = append(this.subs, sub)
+	this.mu.Unlock()
+
+	return nil
+}
+
+// Poll sends the commands published on the queue subject to c, creating the
+// stream that captures them if need be. Every node polling joins the same
+// deliver group, so each command goes to one of them, and is acknowledged
+// once handed to c.
+func (this *NatsBus) Poll(c chan []byte, queue string) error {
+	go func() {
+		var retry backoff
+
+		for {
+			this.mu.Lock()
+			stopped := this.stopped
+			this.mu.Unlock()
+
+			if stopped {
+				return
+			}
+
+			sub, err := this.subscribeQueue(queue, func(msg *nats.Msg) {
+				c <- msg.Data
+
+				if err := msg.Ack(); err != nil {
+					this.log.Error("Error acknowledging command", "queue", queue, "error", err)
+				}
+			})
+			if err == nil {
+				this.mu.Lock()
+				this.queueSub = sub
+				stopped = this.stopped
+				this.mu.Unlock()
+
+				if stopped {
+					this.StopPolling()
+				}
+
+				return
+			}
+
+			this.log.Error("Error subscribing", "queue", queue, "stream", this.stream, "error", err)
+			retry.Wait()
+		}
+	}()
+
+	return nil
+}
+
+func (this *NatsBus) subscribeQueue(queue string, handle nats.MsgHandler) (*nats.Subscription, error) {
+	_, err := this.js.StreamInfo(this.stream)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = this.js.AddStream(&nats.StreamConfig{
+			Name:     this.stream,
+			Subjects: []string{queue},
+			Storage:  nats.FileStorage,
+		})
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Created here rather than by subscribing, so that leaving the deliver
+	// group doesn't delete it.
+	_, err = this.js.ConsumerInfo(this.stream, this.consumer)
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		_, err = this.js.AddConsumer(this.stream, &nats.ConsumerConfig{
+			Durable:        this.consumer,
+			DeliverSubject: "_INCUS.deliver." + this.consumer,
+			DeliverGroup:   this.consumer,
+			FilterSubject:  queue,
+			AckPolicy:      nats.AckExplicitPolicy,
+			AckWait:        this.ackWait,
+		})
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return this.js.QueueSubscribe(queue, this.consumer, handle,
+		nats.Bind(this.stream, this.consumer),
+		nats.ManualAck())
+}
+
+// StopPolling leaves the deliver group, once the commands already delivered
+// to this node are handed over and acknowledged. The durable consumer stays,
+// for the other nodes to carry on with.
+func (this *NatsBus) StopPolling() {
+	this.mu.Lock()
+	this.stopped = true
+	sub := this.queueSub
+	this.queueSub = nil
+	this.mu.Unlock()
+
+	if sub == nil {
+		return
+	}
+
+	if err := sub.Drain(); err != nil {
+		this.log.Error("Error draining subscription", "subject", sub.Subject, "error", err)
+		return
+	}
+
+	for sub.IsValid() {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Health reports subscriptions as receiving while connected. The queue is
+// pushed to rather than polled, so has no LastPoll.
+func (this *NatsBus) Health() BusHealth {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	connected := this.conn.IsConnected()
+	health := BusHealth{
+		Subscriptions: len(this.subs),
+		Polling:       connected && this.queueSub != nil && this.queueSub.IsValid(),
+	}
+
+	for _, sub := range this.subs {
+		if connected && sub.IsValid() {
+			health.Subscribed++
+		}
+	}
+
+	return health
+}
+
+func (this *NatsBus) Publish(channel string, message string) {
+	if err := this.conn.Publish(channel, []byte(message)); err != nil {
+		this.log.Error("Error publishing", "channel", channel, "error", err)
+	}
+}
+
+// Push publishes message on the queue subject, for applications to consume
+// as they see fit, from their own stream or queue group.
+func (this *NatsBus) Push(queue string, message string) {
+	if err := this.conn.Publish(queue, []byte(message)); err != nil {
+		this.log.Error("Error pushing", "queue", queue, "error", err)
+	}
+}
+
+func (this *NatsBus) Close() {
+	this.conn.Close()
+}
@@ -0,0 +1,180 @@
+package incus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func newTestNatsServer(t *testing.T) *server.Server {
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server didn't start")
+	}
+
+	return ns
+}
+
+func newTestNatsBus(t *testing.T, ns *server.Server) *NatsBus {
+	bus, err := NewNatsBus(ns.ClientURL(), "INCUS_TEST", "incus", time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bus
+}
+
+func receive(c chan []byte) (string, bool) {
+	select {
+	case msg := <-c:
+		return string(msg), true
+	case <-time.After(3 * time.Second):
+		return "", false
+	}
+}
+
+func TestNatsBusSubscribe(t *testing.T) {
+	ns := newTestNatsServer(t)
+	defer ns.Shutdown()
+
+	var bus MessageBus = newTestNatsBus(t, ns)
+	other := newTestNatsBus(t, ns)
+	defer bus.(*NatsBus).Close()
+	defer other.Close()
+
+	first := make(chan []byte, 1)
+	second := make(chan []byte, 1)
+	if err := bus.Subscribe(first, "Incus"); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Subscribe(second, "Incus"); err != nil {
+		t.Fatal(err)
+	}
+	other.conn.Flush()
+	bus.(*NatsBus).conn.Flush()
+
+	other.Publish("Incus", "hello")
+
+	for _, c := range []chan []byte{first, second} {
+		if msg, ok := receive(c); !ok || msg != "hello" {
+			t.Errorf("Expected every subscriber to get hello, got %q", msg)
+		}
+	}
+}
+
+func TestNatsBusPoll(t *testing.T) {
+	ns := newTestNatsServer(t)
+	defer ns.Shutdown()
+
+	bus := newTestNatsBus(t, ns)
+	other := newTestNatsBus(t, ns)
+	defer bus.Close()
+	defer other.Close()
+
+	// Queued before any node polls, so kept by the stream.
+	if _, err := bus.js.AddStream(&nats.StreamConfig{Name: "INCUS_TEST", Subjects: []string{"Incus_Queue"}}); err != nil {
+		t.Fatal(err)
+	}
+	bus.Push("Incus_Queue", "early")
+	bus.conn.Flush()
+
+	first := make(chan []byte, 10)
+	second := make(chan []byte, 10)
+	bus.Poll(first, "Incus_Queue")
+	other.Poll(second, "Incus_Queue")
+	merged := mergeChannels(first, second)
+
+	if msg, ok := receive(merged); !ok || msg != "early" {
+		t.Fatalf("Expected the queued command to be kept, got %q", msg)
+	}
+
+	for i := 0; i < 10; i++ {
+		other.Push("Incus_Queue", "later")
+	}
+
+	received := 0
+	for {
+		if _, ok := receive(merged); !ok {
+			break
+		}
+		received++
+
+		if received == 10 {
+			// Anything delivered twice would arrive shortly.
+			select {
+			case msg := <-merged:
+				t.Errorf("Expected each command once, got an extra %q", msg)
+			case <-time.After(200 * time.Millisecond):
+			}
+			break
+		}
+	}
+
+	if received != 10 {
+		t.Errorf("Expected 10 commands, got %d", received)
+	}
+}
+
+func TestNatsBusStopPolling(t *testing.T) {
+	ns := newTestNatsServer(t)
+	defer ns.Shutdown()
+
+	bus := newTestNatsBus(t, ns)
+	other := newTestNatsBus(t, ns)
+	defer bus.Close()
+	defer other.Close()
+
+	if _, err := bus.js.AddStream(&nats.StreamConfig{Name: "INCUS_TEST", Subjects: []string{"Incus_Queue"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	first := make(chan []byte, 10)
+	second := make(chan []byte, 10)
+	bus.Poll(first, "Incus_Queue")
+
+	bus.Push("Incus_Queue", "before")
+	if msg, ok := receive(first); !ok || msg != "before" {
+		t.Fatalf("Expected the command to be polled, got %q", msg)
+	}
+
+	bus.StopPolling()
+	other.Poll(second, "Incus_Queue")
+
+	bus.Push("Incus_Queue", "after")
+	if msg, ok := receive(second); !ok || msg != "after" {
+		t.Errorf("Expected the other node to carry on with the consumer, got %q", msg)
+	}
+
+	select {
+	case msg := <-first:
+		t.Errorf("Expected nothing more once stopped, got %q", msg)
+	default:
+	}
+}
+
+func mergeChannels(channels ...chan []byte) chan []byte {
+	merged := make(chan []byte)
+	for _, c := range channels {
+		go func(c chan []byte) {
+			for msg := range c {
+				merged <- msg
+			}
+		}(c)
+	}
+
+	return merged
+}
@@ -0,0 +1,101 @@
+package incus
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OriginChecker decides which web pages may connect, by the Origin header
+// browsers send. Patterns are exact origins ("https://imgur.com"), origins
+// with a wildcard subdomain ("https://*.imgur.com"), or "*" for any origin.
+type OriginChecker struct {
+	any      bool
+	exact    map[string]bool
+	suffixes []originSuffix
+}
+
+type originSuffix struct {
+	scheme string
+	host   string // with a leading dot, and port if given
+}
+
+// NewOriginChecker with no patterns allows every origin, as Incus always has.
+func NewOriginChecker(patterns []string) *OriginChecker {
+	checker := &OriginChecker{exact: make(map[string]bool)}
+
+	if len(patterns) == 0 {
+		checker.any = true
+	}
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+
+		if pattern == "*" {
+			checker.any = true
+		} else if i := strings.Index(pattern, "://*."); i >= 0 {
+			checker.suffixes = append(checker.suffixes, originSuffix{scheme: pattern[:i], host: pattern[i+4:]})
+		} else if pattern != "" {
+			checker.exact[strings.TrimSuffix(pattern, "/")] = true
+		}
+	}
+
+	return checker
+}
+
+// AllowsAll is true when no allow-list is configured.
+func (this *OriginChecker) AllowsAll() bool {
+	return this.any
+}
+
+// Allowed reports whether a page served from origin may connect. Requests
+// without an Origin header don't come from a browser page, so can't be
+// forged by one, and are allowed.
+func (this *OriginChecker) Allowed(origin string) bool {
+	if this.any || origin == "" {
+		return true
+	}
+
+	parsed, err := url.Parse(strings.ToLower(origin))
+	if err != nil || parsed.Host == "" {
+		return false
+	}
+
+	if this.exact[parsed.Scheme+"://"+parsed.Host] {
+		return true
+	}
+
+	for _, suffix := range this.suffixes {
+		if parsed.Scheme == suffix.scheme && strings.HasSuffix(parsed.Host, suffix.host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkOrigin rejects requests from pages not on the allow-list, counting
+// them against transport. For the HTTP transports, it also sets the CORS
+// headers that let allowed pages read the response.
+func (this *Server) checkOrigin(w http.ResponseWriter, r *http.Request, transport string, cors bool) bool {
+	origin := r.Header.Get("Origin")
+
+	if !this.origins.Allowed(origin) {
+		this.Stats.LogOriginRejected(transport)
+		this.Log.Debug("Rejected connection from origin", "transport", transport, "origin", origin, "remote_addr", r.RemoteAddr)
+
+		http.Error(w, "Origin not allowed", 403)
+		return false
+	}
+
+	if cors {
+		if this.origins.AllowsAll() {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else if origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,73 @@
+package incus
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+type originStats struct {
+	DiscardStats
+	rejected []string
+}
+
+func (this *originStats) LogOriginRejected(transport string) {
+	this.rejected = append(this.rejected, transport)
+}
+
+func TestOriginChecker(t *testing.T) {
+	checker := NewOriginChecker([]string{"https://imgur.com", "https://*.imgur.com", "http://localhost:8080/"})
+
+	for origin, expected := range map[string]bool{
+		"":                        true,
+		"https://imgur.com":       true,
+		"https://IMGUR.com":       true,
+		"https://m.imgur.com":     true,
+		"https://a.b.imgur.com":   true,
+		"http://localhost:8080":   true,
+		"http://imgur.com":        false,
+		"https://evilimgur.com":   false,
+		"https://imgur.com.evil":  false,
+		"http://localhost:8081":   false,
+		"https://m.imgur.com:444": false,
+		"null":                    false,
+	} {
+		if checker.Allowed(origin) != expected {
+			t.Errorf("Expected Allowed(%q) to be %v", origin, expected)
+		}
+	}
+
+	if !NewOriginChecker(nil).Allowed("https://anywhere.example") {
+		t.Errorf("Expected an empty allow-list to allow any origin")
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	stats := &originStats{}
+	server := &Server{Stats: stats, origins: NewOriginChecker([]string{"https://*.imgur.com"})}
+
+	req := httptest.NewRequest("GET", "/lp", nil)
+	req.Header.Set("Origin", "https://m.imgur.com")
+	w := httptest.NewRecorder()
+	if !server.checkOrigin(w, req, "longpoll", true) {
+		t.Fatalf("Expected https://m.imgur.com to be allowed")
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://m.imgur.com" || w.Header().Get("Vary") != "Origin" {
+		t.Fatalf("Expected the origin to be echoed back, instead %+v", w.Header())
+	}
+
+	req.Header.Set("Origin", "https://evil.example")
+	w = httptest.NewRecorder()
+	if server.checkOrigin(w, req, "websocket", false) || w.Code != 403 {
+		t.Fatalf("Expected https://evil.example to be refused, instead %d", w.Code)
+	}
+	if len(stats.rejected) != 1 || stats.rejected[0] != "websocket" {
+		t.Fatalf("Expected one rejected websocket, instead %+v", stats.rejected)
+	}
+
+	server.origins = NewOriginChecker(nil)
+	w = httptest.NewRecorder()
+	server.checkOrigin(w, req, "sse", true)
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("Expected any origin to be allowed without an allow-list, instead %+v", w.Header())
+	}
+}
@@ -0,0 +1,377 @@
+package incus
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// PrometheusStats keeps RuntimeStats as Prometheus metrics, to be scraped
+// from Handler().
+type PrometheusStats struct {
+	registry *prometheus.Registry
+
+	startups    prometheus.Counter
+	clients     prometheus.Gauge
+	goroutines  prometheus.Gauge
+	commands    *prometheus.CounterVec
+	messages    *prometheus.CounterVec
+	reads       prometheus.Counter
+	writes      prometheus.Counter
+	invalidJSON prometheus.Counter
+	rejected    *prometheus.CounterVec
+
+	connects    *prometheus.CounterVec
+	disconnects *prometheus.CounterVec
+	connections *prometheus.GaugeVec
+
+	rejectedOrigins *prometheus.CounterVec
+	rateLimited     *prometheus.CounterVec
+
+	maxSendQueueLength      prometheus.Gauge
+	droppedMessages         *prometheus.CounterVec
+	slowConsumerDisconnects prometheus.Counter
+
+	apnsPushes  prometheus.Counter
+	apnsErrors  prometheus.Counter
+	gcmPushes   prometheus.Counter
+	gcmErrors   prometheus.Counter
+	gcmFailures prometheus.Counter
+
+	webPushes     prometheus.Counter
+	webPushErrors prometheus.Counter
+
+	routedMessages prometheus.Counter
+	routedNodes    prometheus.Counter
+	deadLetters    prometheus.Counter
+
+	pendingRedisActivityCommands prometheus.Gauge
+
+	redisPoolConnections *prometheus.GaugeVec
+	redisPoolWaits       prometheus.Counter
+	redisPoolTimeouts    prometheus.Counter
+	redisDialErrors      prometheus.Counter
+}
+
+func NewPrometheusStats() *PrometheusStats {
+	p := &PrometheusStats{
+		registry: prometheus.NewRegistry(),
+
+		startups: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "incus_startups_total",
+			Help: "Number of times Incus has started.",
+		}),
+		clients: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "incus_clients",
+			Help: "Number of connected sockets.",
+		}),
+		goroutines: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "incus_goroutines",
+			Help: "Number of running goroutines.",
+		}),
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "incus_commands_total",
+			Help: "Commands handled, by source and command type.",
+		}, []string{"source", "type"}),
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "incus_messages_total",
+			Help: "Messages sent, by target (user, page, topic or all).",
+		}, []string{"target"}),
+		reads: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "incus_reads_total",
+			Help: "Commands read from clients.",
+		}),
+		writes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "incus_writes_total",
+			Help: "Messages written to clients.",
+		}),
+		invalidJSON: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "incus_invalid_json_total",
+			Help: "Commands that could not be decoded.",
+		}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "incus_rejected_commands_total",
+			Help: "Commands rejected as invalid, by reason.",
+		}, []string{"reason"}),
+
+		connects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "incus_connects_total",
+			Help: "Client connections, by transport.",
+		}, []string{"transport"}),
+		disconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "incus_disconnects_total",
+			Help: "Client disconnections, by transport.",
+		}, []string{"transport"}),
+		connections: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "incus_connections",
+			Help: "Open client connections, by transport.",
+		}, []string{"transport"}),
+
+		rejectedOrigins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "incus_rejected_origins_total",
+			Help: "Connections refused because of their Origin, by transport.",
+		}, []string{"transport"}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "incus_rate_limited_total",
+			Help: "Connections, commands and messages refused by rate limits, by limit.",
+		}, []string{"limit"}),
+
+		maxSendQueueLength: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "incus_send_queue_max_length",
+			Help: "Most messages waiting to be written to any one socket.",
+		}),
+		droppedMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "incus_dropped_messages_total",
+			Help: "Messages not sent because a socket's send queue was full, by slow consumer policy.",
+		}, []string{"policy"}),
+		slowConsumerDisconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "incus_slow_consumer_disconnects_total",
+			Help: "Sockets closed because their send queue was full.",
+		}),
+
+		apnsPushes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "incus_apns_pushes_total",
+			Help: "iOS push notifications sent.",
+		}),
+		apnsErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "incus_apns_errors_total",
+			Help: "iOS push notifications that failed.",
+		}),
+		gcmPushes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "incus_gcm_pushes_total",
+			Help: "Android push notification requests sent.",
+		}),
+		gcmErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "incus_gcm_errors_total",
+			Help: "Android push notification requests that failed.",
+		}),
+		gcmFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "incus_gcm_failures_total",
+			Help: "Android push notification requests with failed registration ids.",
+		}),
+
+		webPushes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "incus_webpush_pushes_total",
+			Help: "Web push notifications sent.",
+		}),
+		webPushErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "incus_webpush_errors_total",
+			Help: "Web push notifications that failed.",
+		}),
+
+		routedMessages: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "incus_routed_messages_total",
+			Help: "User and page messages routed to the nodes holding their recipients.",
+		}),
+		routedNodes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "incus_routed_node_publishes_total",
+			Help: "Messages published to other nodes' channels while routing.",
+		}),
+
+		deadLetters: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "incus_dead_letters_total",
+			Help: "Queued commands moved to the dead-letter stream.",
+		}),
+
+		pendingRedisActivityCommands: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "incus_pending_redis_activity_commands",
+			Help: "Length of the queue of pending Redis presence commands.",
+		}),
+
+		redisPoolConnections: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "incus_redis_pool_connections",
+			Help: "Redis pool connections, by state (active or idle).",
+		}, []string{"state"}),
+		redisPoolWaits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "incus_redis_pool_waits_total",
+			Help: "Times a Redis connection was waited for because the pool was at its limit.",
+		}),
+		redisPoolTimeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "incus_redis_pool_timeouts_total",
+			Help: "Times waiting for a Redis connection timed out.",
+		}),
+		redisDialErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "incus_redis_dial_errors_total",
+			Help: "Failed attempts to connect to Redis.",
+		}),
+	}
+
+	p.registry.MustRegister(
+		p.startups, p.clients, p.goroutines, p.commands, p.messages, p.reads, p.writes, p.invalidJSON, p.rejected,
+		p.connects, p.disconnects, p.connections, p.rejectedOrigins, p.rateLimited,
+		p.maxSendQueueLength, p.droppedMessages, p.slowConsumerDisconnects,
+		p.apnsPushes, p.apnsErrors, p.gcmPushes, p.gcmErrors, p.gcmFailures,
+		p.webPushes, p.webPushErrors,
+		p.routedMessages, p.routedNodes, p.deadLetters,
+		p.pendingRedisActivityCommands,
+		p.redisPoolConnections, p.redisPoolWaits, p.redisPoolTimeouts, p.redisDialErrors,
+	)
+
+	return p
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (p *PrometheusStats) Handler() http.Handler {
+	return promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{})
+}
+
+func (p *PrometheusStats) LogStartup() {
+	p.startups.Inc()
+}
+
+func (p *PrometheusStats) LogClientCount(clients int64) {
+	p.clients.Set(float64(clients))
+}
+
+func (p *PrometheusStats) LogGoroutines(goroutines int) {
+	p.goroutines.Set(float64(goroutines))
+}
+
+func (p *PrometheusStats) LogCommand(from, cmdType string) {
+	p.commands.WithLabelValues(from, cmdType).Inc()
+}
+
+func (p *PrometheusStats) LogPageMessage() {
+	p.messages.WithLabelValues("page").Inc()
+}
+
+func (p *PrometheusStats) LogUserMessage() {
+	p.messages.WithLabelValues("user").Inc()
+}
+
+func (p *PrometheusStats) LogTopicMessage() {
+	p.messages.WithLabelValues("topic").Inc()
+}
+
+func (p *PrometheusStats) LogBroadcastMessage() {
+	p.messages.WithLabelValues("all").Inc()
+}
+
+func (p *PrometheusStats) LogReadMessage() {
+	p.reads.Inc()
+}
+
+func (p *PrometheusStats) LogWriteMessage() {
+	p.writes.Inc()
+}
+
+func (p *PrometheusStats) LogInvalidJSON() {
+	p.invalidJSON.Inc()
+}
+
+func (p *PrometheusStats) LogCommandRejected(reason string) {
+	p.rejected.WithLabelValues(reason).Inc()
+}
+
+func (p *PrometheusStats) logConnect(transport string) {
+	p.connects.WithLabelValues(transport).Inc()
+	p.connections.WithLabelValues(transport).Inc()
+}
+
+func (p *PrometheusStats) logDisconnect(transport string) {
+	p.disconnects.WithLabelValues(transport).Inc()
+	p.connections.WithLabelValues(transport).Dec()
+}
+
+func (p *PrometheusStats) LogWebsocketConnection() {
+	p.logConnect("websocket")
+}
+
+func (p *PrometheusStats) LogWebsocketDisconnection() {
+	p.logDisconnect("websocket")
+}
+
+func (p *PrometheusStats) LogLongpollConnect() {
+	p.logConnect("longpoll")
+}
+
+func (p *PrometheusStats) LogLongpollDisconnect() {
+	p.logDisconnect("longpoll")
+}
+
+func (p *PrometheusStats) LogSSEConnect() {
+	p.logConnect("sse")
+}
+
+func (p *PrometheusStats) LogSSEDisconnect() {
+	p.logDisconnect("sse")
+}
+
+func (p *PrometheusStats) LogOriginRejected(transport string) {
+	p.rejectedOrigins.WithLabelValues(transport).Inc()
+}
+
+func (p *PrometheusStats) LogRateLimited(limit string) {
+	p.rateLimited.WithLabelValues(limit).Inc()
+}
+
+func (p *PrometheusStats) LogSendQueueLength(length int) {
+	p.maxSendQueueLength.Set(float64(length))
+}
+
+func (p *PrometheusStats) LogDroppedMessage(policy string) {
+	p.droppedMessages.WithLabelValues(policy).Inc()
+}
+
+func (p *PrometheusStats) LogSlowConsumerDisconnect() {
+	p.slowConsumerDisconnects.Inc()
+}
+
+func (p *PrometheusStats) LogAPNSPush() {
+	p.apnsPushes.Inc()
+}
+
+func (p *PrometheusStats) LogAPNSError() {
+	p.apnsErrors.Inc()
+}
+
+func (p *PrometheusStats) LogGCMPush() {
+	p.gcmPushes.Inc()
+}
+
+func (p *PrometheusStats) LogGCMError() {
+	p.gcmErrors.Inc()
+}
+
+func (p *PrometheusStats) LogGCMFailure() {
+	p.gcmFailures.Inc()
+}
+
+func (p *PrometheusStats) LogWebPush() {
+	p.webPushes.Inc()
+}
+
+func (p *PrometheusStats) LogWebPushError() {
+	p.webPushErrors.Inc()
+}
+
+func (p *PrometheusStats) LogRoutedMessage(nodes int) {
+	p.routedMessages.Inc()
+	p.routedNodes.Add(float64(nodes))
+}
+
+func (p *PrometheusStats) LogDeadLetter() {
+	p.deadLetters.Inc()
+}
+
+func (p *PrometheusStats) LogPendingRedisActivityCommandsListLength(length int) {
+	p.pendingRedisActivityCommands.Set(float64(length))
+}
+
+func (p *PrometheusStats) LogRedisPool(active, idle int) {
+	p.redisPoolConnections.WithLabelValues("active").Set(float64(active))
+	p.redisPoolConnections.WithLabelValues("idle").Set(float64(idle))
+}
+
+func (p *PrometheusStats) LogRedisPoolWait() {
+	p.redisPoolWaits.Inc()
+}
+
+func (p *PrometheusStats) LogRedisPoolTimeout() {
+	p.redisPoolTimeouts.Inc()
+}
+
+func (p *PrometheusStats) LogRedisDialError() {
+	p.redisDialErrors.Inc()
+}
@@ -0,0 +1,43 @@
+package incus
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrometheusStats(t *testing.T) {
+	stats := NewPrometheusStats()
+
+	stats.LogStartup()
+	stats.LogClientCount(42)
+	stats.LogCommand("redis", "message")
+	stats.LogCommand("redis", "message")
+	stats.LogUserMessage()
+	stats.LogWebsocketConnection()
+	stats.LogWebsocketConnection()
+	stats.LogWebsocketDisconnection()
+	stats.LogGCMFailure()
+	stats.LogPendingRedisActivityCommandsListLength(7)
+
+	recorder := httptest.NewRecorder()
+	stats.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, _ := ioutil.ReadAll(recorder.Body)
+
+	for _, line := range []string{
+		"incus_startups_total 1",
+		"incus_clients 42",
+		`incus_commands_total{source="redis",type="message"} 2`,
+		`incus_messages_total{target="user"} 1`,
+		`incus_connects_total{transport="websocket"} 2`,
+		`incus_connections{transport="websocket"} 1`,
+		"incus_gcm_failures_total 1",
+		"incus_pending_redis_activity_commands 7",
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("Expected metrics to contain %q, instead:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package incus
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// The rate limits, as named in rate_limit_* options, stats and logs.
+const (
+	LimitConnectionsPerIP   = "connections_per_ip"
+	LimitConnectionsPerUser = "connections_per_user"
+	LimitCommandsPerSocket  = "commands_per_socket"
+	LimitMessagesPerUser    = "messages_per_user"
+)
+
+// Sent to websocket clients disconnected by a rate limit, unless
+// rate_limit_close_code is set.
+const closeCodePolicyViolation = 1008
+
+var errRateLimited = errors.New("Rate limit exceeded")
+
+// RateLimit is a token bucket: Burst tokens, refilled at Rate per second,
+// of which each connection, command or message takes one. A Rate of 0 is
+// no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (this RateLimit) enabled() bool {
+	return this.Rate > 0
+}
+
+// RateLimits are the limits on what each client may do. Connections and
+// messages are limited across the cluster in redis mode, and on each node
+// otherwise; commands are limited on the socket they're sent on.
+type RateLimits struct {
+	ConnectionsPerIP   RateLimit
+	ConnectionsPerUser RateLimit
+	CommandsPerSocket  RateLimit
+	MessagesPerUser    RateLimit
+
+	CloseCode int // sent to websocket clients disconnected by a limit
+
+	// Connections from these networks are limited by the address they
+	// forwarded them for, from X-Forwarded-For.
+	TrustedProxies []*net.IPNet
+}
+
+// NewRateLimits reads the rate_limit_* options from v. Without
+// rate_limit_enabled, nothing is limited.
+func NewRateLimits(v *viper.Viper) (RateLimits, error) {
+	limits := RateLimits{CloseCode: v.GetInt("rate_limit_close_code")}
+	if !v.GetBool("rate_limit_enabled") {
+		return limits, nil
+	}
+
+	for name, limit := range map[string]*RateLimit{
+		LimitConnectionsPerIP:   &limits.ConnectionsPerIP,
+		LimitConnectionsPerUser: &limits.ConnectionsPerUser,
+		LimitCommandsPerSocket:  &limits.CommandsPerSocket,
+		LimitMessagesPerUser:    &limits.MessagesPerUser,
+	} {
+		limit.Rate = v.GetFloat64("rate_limit_" + name)
+		limit.Burst = v.GetInt("rate_limit_" + name + "_burst")
+
+		if limit.Rate < 0 {
+			return limits, fmt.Errorf("rate_limit_%s must not be negative: %v", name, limit.Rate)
+		}
+		if limit.enabled() && limit.Burst < 1 {
+			return limits, fmt.Errorf("rate_limit_%s_burst must be at least 1: %d", name, limit.Burst)
+		}
+	}
+
+	for _, cidr := range v.GetStringSlice("rate_limit_trusted_proxies") {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return limits, fmt.Errorf("rate_limit_trusted_proxies: %v", err)
+		}
+		limits.TrustedProxies = append(limits.TrustedProxies, network)
+	}
+
+	return limits, nil
+}
+
+func (this RateLimits) trusted(ip net.IP) bool {
+	for _, network := range this.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP is the address a request came from. Requests from a trusted proxy
+// came from the last address in X-Forwarded-For it doesn't trust, since
+// clients may send any addresses of their own before it.
+func (this RateLimits) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if len(this.TrustedProxies) == 0 || !this.trusted(net.ParseIP(ip)) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if addr == nil {
+			break
+		}
+
+		ip = addr.String()
+		if !this.trusted(addr) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// tokenBucket is a RateLimit's bucket kept in memory.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time // when the bucket will have refilled, if untouched
+}
+
+// take takes a token if there is one, refilling the bucket for the time
+// since it was last taken from.
+func (this *tokenBucket) take(limit RateLimit, now time.Time) bool {
+	if this.updated.IsZero() {
+		this.tokens = float64(limit.Burst)
+	} else if elapsed := now.Sub(this.updated); elapsed > 0 {
+		this.tokens += elapsed.Seconds() * limit.Rate
+	}
+
+	if this.tokens > float64(limit.Burst) {
+		this.tokens = float64(limit.Burst)
+	}
+	this.updated = now
+
+	allowed := this.tokens >= 1
+	if allowed {
+		this.tokens--
+	}
+
+	this.full = now.Add(time.Duration((float64(limit.Burst) - this.tokens) / limit.Rate * float64(time.Second)))
+
+	return allowed
+}
+
+// How often memoryRateLimiter forgets full buckets.
+const rateLimitSweepInterval = time.Minute
+
+// memoryRateLimiter keeps a bucket for each limit and key on this node. Its
+// zero value is ready to use.
+type memoryRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+func (this *memoryRateLimiter) take(name, key string, limit RateLimit, now time.Time) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.buckets == nil {
+		this.buckets = make(map[string]*tokenBucket)
+		this.swept = now
+	}
+
+	if now.Sub(this.swept) >= rateLimitSweepInterval {
+		this.sweep(now)
+	}
+
+	bucket, ok := this.buckets[name+":"+key]
+	if !ok {
+		bucket = &tokenBucket{}
+		this.buckets[name+":"+key] = bucket
+	}
+
+	return bucket.take(limit, now)
+}
+
+// sweep forgets the buckets that have refilled, which are the same as new.
+func (this *memoryRateLimiter) sweep(now time.Time) {
+	for key, bucket := range this.buckets {
+		if now.After(bucket.full) {
+			delete(this.buckets, key)
+		}
+	}
+	this.swept = now
+}
+
+// TakeRateLimit takes a token from the bucket for key under the limit called
+// name, returning false if there was none. If Redis can't be reached,
+// nothing is limited.
+func (this *Storage) TakeRateLimit(name, key string, limit RateLimit) bool {
+	if !limit.enabled() {
+		return true
+	}
+
+	if this.StorageType == "redis" {
+		allowed, err := this.redis.TakeRateLimit(name, key, limit)
+		if err != nil {
+			this.redis.log.Error("Error checking rate limit", "limit", name, "key", key, "error", err)
+			return true
+		}
+
+		return allowed
+	}
+
+	return this.limiter.take(name, key, limit, time.Now())
+}
+
+func (this *Server) rateLimits() RateLimits {
+	this.settings.RLock()
+	defer this.settings.RUnlock()
+
+	return this.limits
+}
+
+// rateLimitCloseCode is the close code for websockets disconnected by a limit.
+func (this *Server) rateLimitCloseCode() int {
+	if code := this.rateLimits().CloseCode; code != 0 {
+		return code
+	}
+
+	return closeCodePolicyViolation
+}
+
+func (this *Server) rateLimited(limit, key string) {
+	this.Stats.LogRateLimited(limit)
+	this.Log.Sampled().Info("Rate limited", "limit", limit, "key", key)
+}
+
+// allowConnection limits the connections opened from each IP address,
+// refusing the rest with a 429.
+func (this *Server) allowConnection(w http.ResponseWriter, r *http.Request) bool {
+	limits := this.rateLimits()
+	ip := limits.clientIP(r)
+
+	limit := limits.ConnectionsPerIP
+	if this.Store.TakeRateLimit(LimitConnectionsPerIP, ip, limit) {
+		return true
+	}
+
+	this.rateLimited(LimitConnectionsPerIP, ip)
+	refuseRateLimited(w, limit)
+
+	return false
+}
+
+// allowUserConnection limits the connections opened by each user.
+func (this *Server) allowUserConnection(UID string) bool {
+	if this.Store.TakeRateLimit(LimitConnectionsPerUser, UID, this.rateLimits().ConnectionsPerUser) {
+		return true
+	}
+
+	this.rateLimited(LimitConnectionsPerUser, UID)
+
+	return false
+}
+
+// allowMessage limits the messages sent to each user.
+func (this *Server) allowMessage(UID string) bool {
+	if this.Store.TakeRateLimit(LimitMessagesPerUser, UID, this.rateLimits().MessagesPerUser) {
+		return true
+	}
+
+	this.rateLimited(LimitMessagesPerUser, UID)
+
+	return false
+}
+
+// allowCommand limits the commands a client sends on this socket,
+// disconnecting it once it sends too many.
+func (this *Socket) allowCommand() bool {
+	limit := this.Server.rateLimits().CommandsPerSocket
+	if !limit.enabled() || this.commands.take(limit, time.Now()) {
+		return true
+	}
+
+	this.Server.rateLimited(LimitCommandsPerSocket, this.SID)
+	this.logger().Info("Disconnecting socket sending too many commands")
+	go this.disconnect(this.Server.rateLimitCloseCode())
+
+	return false
+}
+
+// refuseRateLimited answers a connection refused by limit with a 429, and
+// when a token will next be available.
+func refuseRateLimited(w http.ResponseWriter, limit RateLimit) {
+	retryAfter := int(1/limit.Rate) + 1
+
+	w.Header().Set("Connection", "close")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, "Too many requests", 429)
+}
@@ -0,0 +1,204 @@
+package incus
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestTokenBucket(t *testing.T) {
+	limit := RateLimit{Rate: 2, Burst: 3}
+	now := time.Now()
+	bucket := &tokenBucket{}
+
+	for i := 0; i < 3; i++ {
+		if !bucket.take(limit, now) {
+			t.Fatalf("Expected take %d of the burst to be allowed", i+1)
+		}
+	}
+
+	if bucket.take(limit, now) {
+		t.Fatal("Expected the empty bucket to refuse")
+	}
+
+	if !bucket.take(limit, now.Add(500*time.Millisecond)) {
+		t.Fatal("Expected a token to be refilled after half a second")
+	}
+
+	if bucket.take(limit, now.Add(500*time.Millisecond)) {
+		t.Fatal("Expected the refilled token to have been taken")
+	}
+}
+
+func TestMemoryRateLimiterSweep(t *testing.T) {
+	limit := RateLimit{Rate: 1, Burst: 2}
+	now := time.Now()
+	limiter := &memoryRateLimiter{}
+
+	limiter.take("test", "a", limit, now)
+	limiter.take("test", "a", limit, now)
+	if limiter.take("test", "a", limit, now) {
+		t.Fatal("Expected the third take to be refused")
+	}
+	if !limiter.take("test", "b", limit, now) {
+		t.Fatal("Expected another key to have its own bucket")
+	}
+
+	limiter.take("test", "a", limit, now.Add(rateLimitSweepInterval))
+	if _, ok := limiter.buckets["test:b"]; ok {
+		t.Error("Expected the refilled bucket to be swept")
+	}
+	if _, ok := limiter.buckets["test:a"]; !ok {
+		t.Error("Expected the bucket just taken from to be kept")
+	}
+}
+
+func TestNewRateLimits(t *testing.T) {
+	defer func() {
+		viper.Set("rate_limit_enabled", false)
+		viper.Set("rate_limit_commands_per_socket", 10)
+		viper.Set("rate_limit_commands_per_socket_burst", 50)
+		viper.Set("rate_limit_trusted_proxies", []string{})
+	}()
+
+	viper.Set("rate_limit_enabled", false)
+	limits, err := NewRateLimits(viper.GetViper())
+	if err != nil || limits.CommandsPerSocket.enabled() || limits.CloseCode != closeCodePolicyViolation {
+		t.Errorf("Expected nothing to be limited when disabled, got %+v and %v", limits, err)
+	}
+
+	viper.Set("rate_limit_enabled", true)
+	limits, err = NewRateLimits(viper.GetViper())
+	if err != nil || limits.CommandsPerSocket != (RateLimit{Rate: 10, Burst: 50}) {
+		t.Errorf("Expected the default command limit, got %+v and %v", limits, err)
+	}
+
+	viper.Set("rate_limit_trusted_proxies", []string{"10.0.0.0/8", "fd00::/8"})
+	limits, err = NewRateLimits(viper.GetViper())
+	if err != nil || len(limits.TrustedProxies) != 2 {
+		t.Errorf("Expected two trusted proxy networks, got %+v and %v", limits.TrustedProxies, err)
+	}
+
+	viper.Set("rate_limit_trusted_proxies", []string{"10.0.0.1"})
+	if _, err := NewRateLimits(viper.GetViper()); err == nil {
+		t.Error("Expected a trusted proxy that isn't a CIDR to be rejected")
+	}
+	viper.Set("rate_limit_trusted_proxies", []string{})
+
+	viper.Set("rate_limit_commands_per_socket_burst", 0)
+	if _, err := NewRateLimits(viper.GetViper()); err == nil {
+		t.Error("Expected a burst of 0 to be rejected")
+	}
+
+	viper.Set("rate_limit_commands_per_socket", -1)
+	if _, err := NewRateLimits(viper.GetViper()); err == nil {
+		t.Error("Expected a negative rate to be rejected")
+	}
+}
+
+func TestAllowConnection(t *testing.T) {
+	server := &Server{Store: newTestHistoryStore(0), Stats: &DiscardStats{}}
+	server.limits.ConnectionsPerIP = RateLimit{Rate: 0.5, Burst: 1}
+
+	r, _ := http.NewRequest("GET", "/socket", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+
+	if !server.allowConnection(httptest.NewRecorder(), r) {
+		t.Fatal("Expected the first connection to be allowed")
+	}
+
+	w := httptest.NewRecorder()
+	if server.allowConnection(w, r) {
+		t.Fatal("Expected the second connection to be refused")
+	}
+	if w.Code != 429 || w.Header().Get("Retry-After") != "3" {
+		t.Errorf("Expected a 429 retrying after 3 seconds, got %d and %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	r.RemoteAddr = "10.0.0.2:1234"
+	if !server.allowConnection(httptest.NewRecorder(), r) {
+		t.Error("Expected another IP address to be allowed")
+	}
+}
+
+func TestMessageLimitedWhereDelivered(t *testing.T) {
+	server := &Server{Store: newTestHistoryStore(0), Stats: &DiscardStats{}}
+	server.limits.MessagesPerUser = RateLimit{Rate: 0.001, Burst: 1}
+	message := map[string]interface{}{"event": "foo", "data": map[string]interface{}{}}
+	broadcast := &CommandMsg{Command: map[string]string{"command": "message", "user": "TEST"}, Message: message, broadcast: true}
+
+	// A node the user isn't connected to leaves the token to the nodes that are.
+	broadcast.sendMessage(server)
+
+	server.Store.Save(newSocket(nil, httptest.NewRecorder(), server, "TEST"))
+	if sent := broadcast.sendMessage(server); sent != 1 {
+		t.Fatalf("Expected the message to be sent once the user connected, instead %d", sent)
+	}
+	if sent := broadcast.sendMessage(server); sent != 0 {
+		t.Errorf("Expected the next message to be limited, instead %d sent", sent)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	limits := RateLimits{TrustedProxies: []*net.IPNet{proxies}}
+
+	for _, test := range []struct {
+		remote, forwarded, want string
+	}{
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "203.0.113.5", "203.0.113.5"},
+		{"10.0.0.1:1234", "198.51.100.1, 203.0.113.5, 10.0.0.2", "203.0.113.5"},
+		{"10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"10.0.0.1:1234", "garbage, 203.0.113.5", "203.0.113.5"},
+		{"203.0.113.5:1234", "198.51.100.1", "203.0.113.5"},
+	} {
+		r, _ := http.NewRequest("GET", "/socket", nil)
+		r.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+
+		if ip := limits.clientIP(r); ip != test.want {
+			t.Errorf("Expected %s forwarding %q to be limited as %s, got %s", test.remote, test.forwarded, test.want, ip)
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "/socket", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.5")
+	if ip := (RateLimits{}).clientIP(r); ip != "10.0.0.1" {
+		t.Errorf("Expected X-Forwarded-For to be ignored without trusted proxies, got %s", ip)
+	}
+}
+
+func TestRedisTakeRateLimit(t *testing.T) {
+	store := newTestRedisStore()
+	limit := RateLimit{Rate: 0.001, Burst: 2}
+
+	client, err := store.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.CloseConn(client)
+
+	key := RateLimitKeyPrefix + ":" + LimitMessagesPerUser + ":ratelimittest"
+	client.Do("DEL", key)
+	defer client.Do("DEL", key)
+
+	for i := 0; i < 2; i++ {
+		allowed, err := store.TakeRateLimit(LimitMessagesPerUser, "ratelimittest", limit)
+		if err != nil || !allowed {
+			t.Fatalf("Expected take %d of the burst to be allowed, got %v and %v", i+1, allowed, err)
+		}
+	}
+
+	allowed, err := store.TakeRateLimit(LimitMessagesPerUser, "ratelimittest", limit)
+	if err != nil || allowed {
+		t.Errorf("Expected the third message to be refused, got %v and %v", allowed, err)
+	}
+}
@@ -0,0 +1,437 @@
+package incus
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	redisClusterSlots = 16384
+
+	// A command redirected more often than this is given up on.
+	redisClusterMaxRedirects = 5
+
+	// The slot map is fetched again at most this often, however many
+	// redirects arrive at once.
+	redisClusterRefreshInterval = 100 * time.Millisecond
+)
+
+var errTooManyRedirects = errors.New("Too many Redis Cluster redirects")
+
+// redisCluster tracks which node of a Redis Cluster serves each hash slot,
+// starting from the seeds and following the cluster as slots move.
+type redisCluster struct {
+	seeds []string
+	log   *Logger
+
+	mu        sync.RWMutex
+	slots     [redisClusterSlots]string // master address per slot
+	nodes     []string                  // master addresses
+	refreshed time.Time
+}
+
+func newRedisCluster(seeds []string, logger *Logger) *redisCluster {
+	cluster := &redisCluster{
+		seeds: seeds,
+		log:   logger,
+	}
+
+	if err := cluster.Refresh(); err != nil {
+		logger.Error("Error fetching Redis Cluster slots", "error", err)
+	}
+
+	return cluster
+}
+
+// Refresh fetches the slot map from the first node that answers.
+func (this *redisCluster) Refresh() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if time.Since(this.refreshed) < redisClusterRefreshInterval {
+		return nil
+	}
+
+	var lastErr error = errors.New("No Redis Cluster nodes configured")
+	for _, addr := range append(append([]string{}, this.nodes...), this.seeds...) {
+		slots, nodes, err := fetchClusterSlots(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		this.slots = slots
+		this.nodes = nodes
+		this.refreshed = time.Now()
+		return nil
+	}
+
+	return lastErr
+}
+
+func fetchClusterSlots(addr string) (slots [redisClusterSlots]string, nodes []string, err error) {
+	conn, err := dialRedis(addr)
+	if err != nil {
+		return slots, nil, err
+	}
+	defer conn.Close()
+
+	ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return slots, nil, err
+	}
+
+	seen := make(map[string]bool)
+	for _, r := range ranges {
+		// [start, end, [host, port, id], replicas...]
+		fields, err := redis.Values(r, nil)
+		if err != nil || len(fields) < 3 {
+			return slots, nil, fmt.Errorf("Unexpected CLUSTER SLOTS reply %v from %s", r, addr)
+		}
+
+		start, _ := redis.Int(fields[0], nil)
+		end, _ := redis.Int(fields[1], nil)
+		master, err := redis.Values(fields[2], nil)
+		if err != nil || len(master) < 2 || start < 0 || end >= redisClusterSlots {
+			return slots, nil, fmt.Errorf("Unexpected CLUSTER SLOTS reply %v from %s", r, addr)
+		}
+
+		host, _ := redis.String(master[0], nil)
+		port, _ := redis.Int(master[1], nil)
+		if host == "" {
+			host = addr[:strings.LastIndex(addr, ":")]
+		}
+
+		node := host + ":" + strconv.Itoa(port)
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = node
+		}
+
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+
+	return slots, nodes, nil
+}
+
+// Addr returns the address of the node serving slot.
+func (this *redisCluster) Addr(slot int) string {
+	this.mu.RLock()
+	addr := this.slots[slot]
+	this.mu.RUnlock()
+
+	if addr == "" {
+		return this.AnyAddr()
+	}
+
+	return addr
+}
+
+// AnyAddr returns the address of a random master, for commands that any
+// node can serve.
+func (this *redisCluster) AnyAddr() string {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	if len(this.nodes) > 0 {
+		return this.nodes[rand.Intn(len(this.nodes))]
+	}
+
+	if len(this.seeds) == 0 {
+		return ""
+	}
+
+	return this.seeds[rand.Intn(len(this.seeds))]
+}
+
+// Moved records that slot is now served by addr, and fetches the rest of
+// the slot map again since more is likely to have changed.
+func (this *redisCluster) Moved(slot int, addr string) {
+	this.mu.Lock()
+	this.slots[slot] = addr
+	this.mu.Unlock()
+
+	if err := this.Refresh(); err != nil {
+		this.log.Error("Error fetching Redis Cluster slots", "error", err)
+	}
+}
+
+// Dial returns a connection to the whole cluster, with a node connection
+// opened up front so unreachable clusters fail here.
+func (this *redisCluster) Dial() (redis.Conn, error) {
+	conn := &clusterConn{
+		cluster: this,
+		conns:   make(map[string]redis.Conn),
+		home:    this.AnyAddr(),
+	}
+
+	if _, err := conn.node(conn.home); err != nil {
+		this.log.Error("Redis connect failed", "addr", conn.home, "error", err)
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// clusterConn sends each command to the node serving its key, following
+// MOVED and ASK redirects. Keyless commands, and pub/sub, go to its home
+// node. Pipelined commands all go to the node serving the first key among
+// them, so a transaction's keys must share a hash slot.
+type clusterConn struct {
+	cluster *redisCluster
+	conns   map[string]redis.Conn
+	home    string
+
+	pending  []clusterCommand
+	receiver redis.Conn
+}
+
+type clusterCommand struct {
+	name string
+	args []interface{}
+}
+
+func (this *clusterConn) node(addr string) (redis.Conn, error) {
+	if conn, ok := this.conns[addr]; ok {
+		return conn, nil
+	}
+
+	conn, err := dialRedis(addr)
+	if err != nil {
+		this.cluster.Refresh()
+		return nil, err
+	}
+
+	this.conns[addr] = conn
+	return conn, nil
+}
+
+func (this *clusterConn) addr(cmd string, args []interface{}) string {
+	if key, ok := commandKey(cmd, args); ok {
+		return this.cluster.Addr(keySlot(key))
+	}
+
+	return this.home
+}
+
+func (this *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if len(this.pending) > 0 || cmd == "" {
+		conn, err := this.flushPending(cmd, args)
+		if err != nil {
+			return nil, err
+		}
+
+		reply, err := conn.Do(cmd, args...)
+		// Redirected pipelines, such as transactions queued on a node that
+		// lost the slot, aren't retried; the next attempt goes to the right node.
+		if _, _, _, ok := parseRedirect(err); ok {
+			this.cluster.Refresh()
+		}
+
+		return reply, err
+	}
+
+	addr := this.addr(cmd, args)
+	asking := false
+	for i := 0; i < redisClusterMaxRedirects; i++ {
+		conn, err := this.node(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if asking {
+			conn.Send("ASKING")
+		}
+
+		reply, err := conn.Do(cmd, args...)
+
+		moved, slot, to, ok := parseRedirect(err)
+		if !ok {
+			return reply, err
+		}
+
+		if moved {
+			this.cluster.Moved(slot, to)
+		}
+
+		addr, asking = to, !moved
+	}
+
+	return nil, errTooManyRedirects
+}
+
+func (this *clusterConn) Send(cmd string, args ...interface{}) error {
+	this.pending = append(this.pending, clusterCommand{cmd, args})
+	return nil
+}
+
+func (this *clusterConn) Flush() error {
+	conn, err := this.flushPending("", nil)
+	if err != nil {
+		return err
+	}
+
+	this.receiver = conn
+	return conn.Flush()
+}
+
+func (this *clusterConn) Receive() (interface{}, error) {
+	if this.receiver == nil {
+		return nil, errors.New("Nothing sent to receive a reply to")
+	}
+
+	return this.receiver.Receive()
+}
+
+// flushPending sends the pending commands to the node serving the first key
+// among them or cmd, returning that node's connection.
+func (this *clusterConn) flushPending(cmd string, args []interface{}) (redis.Conn, error) {
+	addr := ""
+	for _, pending := range append(this.pending, clusterCommand{cmd, args}) {
+		if key, ok := commandKey(pending.name, pending.args); ok {
+			addr = this.cluster.Addr(keySlot(key))
+			break
+		}
+	}
+
+	if addr == "" {
+		addr = this.home
+	}
+
+	conn, err := this.node(addr)
+	if err != nil {
+		this.pending = nil
+		return nil, err
+	}
+
+	for _, pending := range this.pending {
+		conn.Send(pending.name, pending.args...)
+	}
+	this.pending = nil
+
+	return conn, nil
+}
+
+func (this *clusterConn) Err() error {
+	for _, conn := range this.conns {
+		if err := conn.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *clusterConn) Close() error {
+	for addr, conn := range this.conns {
+		conn.Close()
+		delete(this.conns, addr)
+	}
+
+	return nil
+}
+
+// commandKey returns the key a command operates on, which decides the node
+// it is sent to, or false for commands any node can serve.
+func commandKey(cmd string, args []interface{}) (string, bool) {
+	switch strings.ToUpper(cmd) {
+	case "EVAL", "EVALSHA":
+		if len(args) < 3 || argString(args[1]) == "0" {
+			return "", false
+		}
+		return argString(args[2]), true
+
+	case "XREAD", "XREADGROUP":
+		for i := 0; i+1 < len(args); i++ {
+			if strings.ToUpper(argString(args[i])) == "STREAMS" {
+				return argString(args[i+1]), true
+			}
+		}
+		return "", false
+
+	case "XGROUP":
+		if len(args) < 2 {
+			return "", false
+		}
+		return argString(args[1]), true
+
+	case "", "PING", "PUBLISH", "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE",
+		"MULTI", "EXEC", "DISCARD", "ASKING", "CLUSTER", "INFO", "ROLE", "SCRIPT":
+		return "", false
+	}
+
+	if len(args) == 0 {
+		return "", false
+	}
+
+	return argString(args[0]), true
+}
+
+func argString(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+
+	return fmt.Sprint(arg)
+}
+
+// keySlot returns the hash slot of key. Keys with a non-empty {hash tag} are
+// hashed by the tag alone, so keys sharing a tag share a slot.
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	return int(crc16(key)) % redisClusterSlots
+}
+
+// crc16 is CRC-16/XMODEM, as used by Redis Cluster.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+// parseRedirect parses "MOVED <slot> <addr>" and "ASK <slot> <addr>" errors.
+func parseRedirect(err error) (moved bool, slot int, addr string, ok bool) {
+	redisErr, isRedisErr := err.(redis.Error)
+	if !isRedisErr {
+		return false, 0, "", false
+	}
+
+	fields := strings.Fields(string(redisErr))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return false, 0, "", false
+	}
+
+	slot, convErr := strconv.Atoi(fields[1])
+	if convErr != nil || slot < 0 || slot >= redisClusterSlots {
+		return false, 0, "", false
+	}
+
+	return fields[0] == "MOVED", slot, fields[2], true
+}
@@ -0,0 +1,198 @@
+package incus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// fakeRedisServer answers each command with whatever RESP handle returns,
+// standing in for servers the test Redis can't play, like sentinels.
+type fakeRedisServer struct {
+	listener net.Listener
+	handle   func(args []string) string
+}
+
+func newFakeRedisServer(t *testing.T, handle func(args []string) string) *fakeRedisServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &fakeRedisServer{listener: listener, handle: handle}
+	go server.serve()
+
+	return server
+}
+
+func (this *fakeRedisServer) Addr() string {
+	return this.listener.Addr().String()
+}
+
+func (this *fakeRedisServer) Close() {
+	this.listener.Close()
+}
+
+func (this *fakeRedisServer) serve() {
+	for {
+		conn, err := this.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			reader := bufio.NewReader(conn)
+			for {
+				args, err := readFakeCommand(reader)
+				if err != nil {
+					return
+				}
+
+				if _, err := io.WriteString(conn, this.handle(args)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func readFakeCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(line)[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+
+		arg, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+
+	return args, nil
+}
+
+func TestKeySlot(t *testing.T) {
+	if slot := keySlot("123456789"); slot != 12739 {
+		t.Errorf("Expected slot 12739, got %d", slot)
+	}
+
+	if keySlot("{user1000}.following") != keySlot("user1000") {
+		t.Errorf("Expected keys with the same hash tag to share a slot")
+	}
+
+	if keySlot("foo{}{bar}") != int(crc16("foo{}{bar}"))%redisClusterSlots {
+		t.Errorf("Expected an empty hash tag to be ignored")
+	}
+
+	store := &RedisStore{cluster: true, presenceKeyPrefix: PresenceKeyPrefix}
+	if keySlot(store.historyKey("user", "123")) != keySlot(store.ackKey("123")) {
+		t.Errorf("Expected a user's keys to share a slot")
+	}
+	if keySlot(store.historyKey("user", "123")) == keySlot(store.historyKey("user", "456")) {
+		t.Errorf("Expected different users' keys to be spread over the cluster")
+	}
+
+	if store.presenceKey("123") != "ClientPresence:{123}" {
+		t.Errorf("Expected presence keys to be tagged by user, got %s", store.presenceKey("123"))
+	}
+}
+
+func TestCommandKey(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		args []interface{}
+		key  string
+		ok   bool
+	}{
+		{"GET", []interface{}{"foo"}, "foo", true},
+		{"EVALSHA", []interface{}{"abc", 2, []byte("k1"), "k2", "arg"}, "k1", true},
+		{"EVALSHA", []interface{}{"abc", 0, "arg"}, "", false},
+		{"XREADGROUP", []interface{}{"GROUP", "g", "c", "COUNT", 1, "STREAMS", "s", ">"}, "s", true},
+		{"XGROUP", []interface{}{"CREATE", "s", "g", "$"}, "s", true},
+		{"PUBLISH", []interface{}{"channel", "message"}, "", false},
+		{"MULTI", nil, "", false},
+	}
+
+	for _, test := range tests {
+		key, ok := commandKey(test.cmd, test.args)
+		if key != test.key || ok != test.ok {
+			t.Errorf("%s %v: expected %q %v, got %q %v", test.cmd, test.args, test.key, test.ok, key, ok)
+		}
+	}
+}
+
+func TestClusterRedirect(t *testing.T) {
+	target := fmt.Sprintf("%s:%d", REDISHOST, REDISPORT)
+
+	// A node claiming every slot, that has since lost them all to target.
+	var node *fakeRedisServer
+	node = newFakeRedisServer(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "CLUSTER" {
+			host, port, _ := net.SplitHostPort(node.Addr())
+			return fmt.Sprintf("*1\r\n*3\r\n:0\r\n:16383\r\n*2\r\n$%d\r\n%s\r\n:%s\r\n", len(host), host, port)
+		}
+
+		if len(args) > 1 {
+			return fmt.Sprintf("-MOVED %d %s\r\n", keySlot(args[1]), target)
+		}
+
+		return "+PONG\r\n"
+	})
+	defer node.Close()
+
+	cluster := newRedisCluster([]string{node.Addr()}, nil)
+	if cluster.Addr(keySlot("ClusterRedirectKey")) != node.Addr() {
+		t.Fatalf("Expected every slot on %s, got %s", node.Addr(), cluster.Addr(0))
+	}
+
+	conn, err := cluster.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Do("SET", "ClusterRedirectKey", "moved"); err != nil {
+		t.Fatalf("Expected the redirect to be followed, got %s", err.Error())
+	}
+
+	value, err := redis.String(conn.Do("GET", "ClusterRedirectKey"))
+	if err != nil || value != "moved" {
+		t.Errorf("Expected moved, got %q %v", value, err)
+	}
+
+	conn.Do("DEL", "ClusterRedirectKey")
+}
+
+func TestCheckTargetedRouting(t *testing.T) {
+	if err := checkTargetedRouting(RedisModeCluster, true); err == nil {
+		t.Error("Expected targeted routing to be refused in cluster mode")
+	}
+
+	if err := checkTargetedRouting(RedisModeCluster, false); err != nil {
+		t.Errorf("Expected cluster mode without targeted routing to be allowed, got %v", err)
+	}
+
+	if err := checkTargetedRouting(RedisModeSingle, true); err != nil {
+		t.Errorf("Expected targeted routing to be allowed on a single Redis, got %v", err)
+	}
+}
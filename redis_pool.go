@@ -0,0 +1,236 @@
+package incus
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// Idle connections unused for longer than this are pinged before reuse.
+	redisPoolTestIdle = time.Minute
+
+	redisBackoffMin = 100 * time.Millisecond
+	redisBackoffMax = 30 * time.Second
+)
+
+var errPoolExhausted = errors.New("Timed out waiting for a redis connection")
+
+// redisPool lends out at most maxActive connections at once, keeping up to
+// maxIdle of them open between uses. Callers wait up to waitTimeout for a
+// connection when all are in use. A maxActive of 0 means no limit, and an
+// idleTimeout of 0 keeps idle connections open indefinitely.
+type redisPool struct {
+	connFn      func() (redis.Conn, error) // function to create new connection.
+	maxIdle     int
+	maxActive   int
+	waitTimeout time.Duration
+	idleTimeout time.Duration
+	stats       RuntimeStats
+
+	slots chan struct{} // one per connection lent out, if maxActive > 0
+
+	mu     sync.Mutex
+	idle   []idleConn // most recently used last
+	active int        // connections lent out
+}
+
+type idleConn struct {
+	conn redis.Conn
+	used time.Time
+}
+
+func newRedisPool(connFn func() (redis.Conn, error), maxIdle, maxActive int, waitTimeout, idleTimeout time.Duration, stats RuntimeStats) *redisPool {
+	pool := &redisPool{
+		connFn:      connFn,
+		maxIdle:     maxIdle,
+		maxActive:   maxActive,
+		waitTimeout: waitTimeout,
+		idleTimeout: idleTimeout,
+		stats:       stats,
+	}
+
+	if maxActive > 0 {
+		pool.slots = make(chan struct{}, maxActive)
+	}
+
+	return pool
+}
+
+// Get lends out a healthy connection, to be given back with Put.
+func (this *redisPool) Get() (redis.Conn, error) {
+	if err := this.acquire(); err != nil {
+		return nil, err
+	}
+
+	for {
+		idle, ok := this.popIdle()
+		if !ok {
+			break
+		}
+
+		if this.idleTimeout > 0 && time.Since(idle.used) > this.idleTimeout {
+			idle.conn.Close()
+			continue
+		}
+
+		if time.Since(idle.used) > redisPoolTestIdle {
+			if _, err := idle.conn.Do("PING"); err != nil {
+				idle.conn.Close()
+				continue
+			}
+		}
+
+		return idle.conn, nil
+	}
+
+	conn, err := this.connFn()
+	if err != nil {
+		this.stats.LogRedisDialError()
+		this.release()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Put takes back a connection lent out by Get, closing it if it is broken
+// or there are enough idle connections already.
+func (this *redisPool) Put(conn redis.Conn) {
+	if conn.Err() != nil {
+		conn.Close()
+		this.release()
+		return
+	}
+
+	this.mu.Lock()
+	this.idle = append(this.idle, idleConn{conn: conn, used: time.Now()})
+
+	var evicted redis.Conn
+	if len(this.idle) > this.maxIdle {
+		evicted = this.idle[0].conn
+		this.idle = this.idle[1:]
+	}
+	this.mu.Unlock()
+
+	if evicted != nil {
+		evicted.Close()
+	}
+
+	this.release()
+}
+
+// Evict closes connections idle for longer than idleTimeout.
+func (this *redisPool) Evict() {
+	if this.idleTimeout <= 0 {
+		return
+	}
+
+	this.mu.Lock()
+	var evicted []idleConn
+	for len(this.idle) > 0 && time.Since(this.idle[0].used) > this.idleTimeout {
+		evicted = append(evicted, this.idle[0])
+		this.idle = this.idle[1:]
+	}
+	this.mu.Unlock()
+
+	for _, idle := range evicted {
+		idle.conn.Close()
+	}
+}
+
+// Flush closes every idle connection.
+func (this *redisPool) Flush() {
+	this.mu.Lock()
+	idle := this.idle
+	this.idle = nil
+	this.mu.Unlock()
+
+	for _, conn := range idle {
+		conn.conn.Close()
+	}
+}
+
+// Stats returns how many connections are lent out and how many are idle.
+func (this *redisPool) Stats() (active, idle int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.active, len(this.idle)
+}
+
+func (this *redisPool) acquire() error {
+	if this.slots != nil {
+		select {
+		case this.slots <- struct{}{}:
+		default:
+			this.stats.LogRedisPoolWait()
+
+			timer := time.NewTimer(this.waitTimeout)
+			defer timer.Stop()
+
+			select {
+			case this.slots <- struct{}{}:
+			case <-timer.C:
+				this.stats.LogRedisPoolTimeout()
+				return errPoolExhausted
+			}
+		}
+	}
+
+	this.mu.Lock()
+	this.active++
+	this.mu.Unlock()
+
+	return nil
+}
+
+func (this *redisPool) release() {
+	this.mu.Lock()
+	this.active--
+	this.mu.Unlock()
+
+	if this.slots != nil {
+		<-this.slots
+	}
+}
+
+func (this *redisPool) popIdle() (idleConn, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if len(this.idle) == 0 {
+		return idleConn{}, false
+	}
+
+	idle := this.idle[len(this.idle)-1]
+	this.idle = this.idle[:len(this.idle)-1]
+
+	return idle, true
+}
+
+// backoff spaces out reconnection attempts, doubling the wait after each
+// failure up to redisBackoffMax, with jitter so nodes don't retry in step.
+type backoff struct {
+	next time.Duration
+}
+
+func (this *backoff) Wait() {
+	if this.next < redisBackoffMin {
+		this.next = redisBackoffMin
+	}
+
+	time.Sleep(this.next/2 + time.Duration(rand.Int63n(int64(this.next/2)+1)))
+
+	this.next *= 2
+	if this.next > redisBackoffMax {
+		this.next = redisBackoffMax
+	}
+}
+
+func (this *backoff) Reset() {
+	this.next = 0
+}
@@ -0,0 +1,87 @@
+package incus
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+type fakeRedisConn struct {
+	err    error
+	closed bool
+}
+
+func (this *fakeRedisConn) Close() error { this.closed = true; return nil }
+func (this *fakeRedisConn) Err() error   { return this.err }
+func (this *fakeRedisConn) Do(command string, args ...interface{}) (interface{}, error) {
+	return "PONG", this.err
+}
+func (this *fakeRedisConn) Send(command string, args ...interface{}) error { return this.err }
+func (this *fakeRedisConn) Flush() error                                   { return this.err }
+func (this *fakeRedisConn) Receive() (interface{}, error)                  { return nil, this.err }
+
+func TestRedisPool(t *testing.T) {
+	var dialed []*fakeRedisConn
+	dial := func() (redis.Conn, error) {
+		conn := &fakeRedisConn{}
+		dialed = append(dialed, conn)
+		return conn, nil
+	}
+
+	pool := newRedisPool(dial, 1, 2, 20*time.Millisecond, time.Minute, &DiscardStats{})
+
+	first, _ := pool.Get()
+	second, _ := pool.Get()
+
+	if _, err := pool.Get(); err != errPoolExhausted {
+		t.Fatalf("Expected a third connection to time out, instead %v", err)
+	}
+
+	pool.Put(first)
+	if conn, err := pool.Get(); err != nil || conn != first {
+		t.Fatalf("Expected the returned connection to be reused, instead %v (%v)", conn, err)
+	}
+	if active, idle := pool.Stats(); active != 2 || idle != 0 {
+		t.Fatalf("Expected 2 active and no idle connections, instead %d and %d", active, idle)
+	}
+
+	// Only maxIdle connections are kept.
+	pool.Put(first)
+	pool.Put(second)
+	if active, idle := pool.Stats(); active != 0 || idle != 1 || !dialed[0].closed {
+		t.Fatalf("Expected one idle connection, instead %d active and %d idle", active, idle)
+	}
+
+	// Broken connections aren't kept.
+	conn, _ := pool.Get()
+	conn.(*fakeRedisConn).err = errors.New("Broken")
+	pool.Put(conn)
+	if _, idle := pool.Stats(); idle != 0 || !dialed[1].closed {
+		t.Fatalf("Expected the broken connection to be closed")
+	}
+
+	if len(dialed) != 2 {
+		t.Fatalf("Expected 2 connections to have been dialed, instead %d", len(dialed))
+	}
+}
+
+func TestRedisPoolEvict(t *testing.T) {
+	dial := func() (redis.Conn, error) { return &fakeRedisConn{}, nil }
+	pool := newRedisPool(dial, 5, 0, 0, 10*time.Millisecond, &DiscardStats{})
+
+	conn, _ := pool.Get()
+	pool.Put(conn)
+
+	time.Sleep(20 * time.Millisecond)
+	pool.Evict()
+
+	if _, idle := pool.Stats(); idle != 0 || !conn.(*fakeRedisConn).closed {
+		t.Fatalf("Expected the idle connection to be evicted")
+	}
+
+	if _, err := pool.Get(); err != nil {
+		t.Fatalf("Expected no limit on connections, instead %v", err)
+	}
+}
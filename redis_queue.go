@@ -2,7 +2,6 @@ package incus
 
 import "container/list"
 import "sync"
-import "log"
 import "time"
 
 // A queue of redis commands
@@ -11,6 +10,7 @@ type RedisQueue struct {
 	outgoing chan RedisCommand
 	pending  *list.List
 	stats    RuntimeStats
+	log      *Logger
 
 	// Used to control access to the pending list
 	pendingListLock sync.Mutex
@@ -18,13 +18,13 @@ type RedisQueue struct {
 	pendingCond *sync.Cond
 }
 
-func NewRedisQueue(consumers int, stats RuntimeStats, pool *redisPool) *RedisQueue {
+func NewRedisQueue(consumers int, stats RuntimeStats, pool *redisPool, logger *Logger) *RedisQueue {
 	incoming := make(chan RedisCommand)
 	outgoing := make(chan RedisCommand)
 
 	for i := 0; i < consumers; i++ {
 		outgoingRcv := (<-chan RedisCommand)(outgoing)
-		NewRedisQueueConsumer(outgoingRcv, pool)
+		NewRedisQueueConsumer(outgoingRcv, pool, logger)
 	}
 
 	pendingList := &RedisQueue{
@@ -32,6 +32,7 @@ func NewRedisQueue(consumers int, stats RuntimeStats, pool *redisPool) *RedisQue
 		outgoing:        outgoing,
 		pending:         list.New(),
 		stats:           stats,
+		log:             logger,
 		pendingListLock: sync.Mutex{},
 		pendingCond:     sync.NewCond(&sync.Mutex{}),
 	}
@@ -88,9 +89,7 @@ func (r *RedisQueue) DispatchForever() {
 			r.pendingListLock.Lock()
 			pendingLength = r.pending.Len()
 
-			if DEBUG {
-				log.Printf("There are %d pending commands", pendingLength)
-			}
+			r.log.Sampled().Debug("Pending Redis commands", "count", pendingLength)
 
 			r.stats.LogPendingRedisActivityCommandsListLength(pendingLength)
 
@@ -108,9 +107,7 @@ func (r *RedisQueue) DispatchForever() {
 		r.pendingCond.L.Unlock()
 
 		go func(value RedisCommand) {
-			if DEBUG {
-				log.Printf("Pushed one command to outgoing")
-			}
+			r.log.Sampled().Debug("Pushed one command to outgoing")
 
 			r.outgoing <- value
 		}(front.Value.(RedisCommand))
@@ -1,16 +1,16 @@
 package incus
 
-import "log"
-
 type RedisQueueConsumer struct {
 	commands <-chan RedisCommand
 	pool     *redisPool
+	log      *Logger
 }
 
-func NewRedisQueueConsumer(commands <-chan RedisCommand, pool *redisPool) *RedisQueueConsumer {
+func NewRedisQueueConsumer(commands <-chan RedisCommand, pool *redisPool, logger *Logger) *RedisQueueConsumer {
 	consumer := &RedisQueueConsumer{
 		commands: commands,
 		pool:     pool,
+		log:      logger,
 	}
 
 	go consumer.ConsumeForever()
@@ -22,13 +22,11 @@ func (r *RedisQueueConsumer) ConsumeForever() {
 	for {
 		command := <-r.commands
 
-		if DEBUG {
-			log.Println("Dequeued one command in consumer")
-		}
+		r.log.Sampled().Debug("Dequeued one command in consumer")
 
-		conn, success := r.pool.Get()
+		conn, err := r.pool.Get()
 
-		if success {
+		if err == nil {
 			result, err := command.Callback(conn)
 
 			// The Result channel is a buffered channel of length 1 so this does not block.
@@ -37,9 +35,11 @@ func (r *RedisQueueConsumer) ConsumeForever() {
 				Error: err,
 			}
 
-			r.pool.Close(conn)
+			r.pool.Put(conn)
 		} else {
-			log.Println("Failed to get redis connection")
+			r.log.Error("Failed to get redis connection", "error", err)
+
+			command.Result <- RedisCommandResult{Error: err}
 		}
 	}
 }
@@ -0,0 +1,221 @@
+package incus
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// How RedisStore finds Redis: one server at a fixed address, the master of a
+// Sentinel-monitored group, or the nodes of a Redis Cluster.
+const (
+	RedisModeSingle   = "single"
+	RedisModeSentinel = "sentinel"
+	RedisModeCluster  = "cluster"
+)
+
+const (
+	redisDialTimeout = 5 * time.Second
+
+	// The channel Sentinels announce a new master on, as
+	// "<master name> <old ip> <old port> <new ip> <new port>".
+	sentinelSwitchMasterChannel = "+switch-master"
+)
+
+var errFailedOver = errors.New("Redis master has changed")
+
+func checkRedisMode(mode string) error {
+	switch mode {
+	case RedisModeSingle, RedisModeSentinel, RedisModeCluster:
+		return nil
+	}
+
+	return fmt.Errorf("redis_mode must be %s, %s or %s, not %q", RedisModeSingle, RedisModeSentinel, RedisModeCluster, mode)
+}
+
+// splitAddrs parses a comma separated list of host:port addresses.
+func splitAddrs(addrs string) []string {
+	var split []string
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			split = append(split, addr)
+		}
+	}
+
+	return split
+}
+
+func dialRedis(addr string) (redis.Conn, error) {
+	return redis.DialTimeout("tcp", addr, redisDialTimeout, 0, 0)
+}
+
+// redisSentinel connects to whichever server the Sentinels at addrs currently
+// consider the master named master. Connections made before a failover
+// report errFailedOver from Err, so the pool closes them rather than reusing
+// them against what may now be a replica.
+type redisSentinel struct {
+	addrs  []string
+	master string
+	log    *Logger
+
+	epoch int64 // updated atomically, counts failovers seen
+
+	mu   sync.Mutex
+	next int // the sentinel to ask first
+}
+
+func newRedisSentinel(addrs []string, master string, logger *Logger) *redisSentinel {
+	return &redisSentinel{
+		addrs:  addrs,
+		master: master,
+		log:    logger,
+	}
+}
+
+// MasterAddr asks each sentinel in turn for the master's address.
+func (this *redisSentinel) MasterAddr() (string, error) {
+	this.mu.Lock()
+	first := this.next
+	this.mu.Unlock()
+
+	var lastErr error = errors.New("No sentinels configured")
+	for i := range this.addrs {
+		n := (first + i) % len(this.addrs)
+
+		addr, err := this.askSentinel(this.addrs[n])
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		this.mu.Lock()
+		this.next = n
+		this.mu.Unlock()
+
+		return addr, nil
+	}
+
+	return "", lastErr
+}
+
+func (this *redisSentinel) askSentinel(sentinel string) (string, error) {
+	conn, err := dialRedis(sentinel)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	reply, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", this.master))
+	if err == redis.ErrNil {
+		return "", fmt.Errorf("Sentinel %s doesn't know master %s", sentinel, this.master)
+	} else if err != nil {
+		return "", err
+	}
+
+	if len(reply) != 2 {
+		return "", fmt.Errorf("Unexpected SENTINEL reply %v from %s", reply, sentinel)
+	}
+
+	return reply[0] + ":" + reply[1], nil
+}
+
+// Dial connects to the current master.
+func (this *redisSentinel) Dial() (redis.Conn, error) {
+	epoch := atomic.LoadInt64(&this.epoch)
+
+	addr, err := this.MasterAddr()
+	if err != nil {
+		this.log.Error("Redis master lookup failed", "master", this.master, "error", err)
+		return nil, err
+	}
+
+	conn, err := dialRedis(addr)
+	if err != nil {
+		this.log.Error("Redis connect failed", "addr", addr, "error", err)
+		return nil, err
+	}
+
+	// Sentinels announce a new master before it has finished promoting
+	// itself. Servers without ROLE are taken at the sentinels' word.
+	role, err := redis.Values(conn.Do("ROLE"))
+	if err != nil {
+		if _, ok := err.(redis.Error); !ok {
+			conn.Close()
+			return nil, err
+		}
+	} else if len(role) > 0 {
+		if name, _ := redis.String(role[0], nil); name != "master" {
+			conn.Close()
+			return nil, fmt.Errorf("Redis at %s is a %s, not the master", addr, name)
+		}
+	}
+
+	return &sentinelConn{Conn: conn, epoch: epoch, sentinel: this}, nil
+}
+
+// Watch listens for the sentinels announcing a new master, calling
+// switched each time. It runs until the process exits.
+func (this *redisSentinel) Watch(switched func(addr string)) {
+	if len(this.addrs) == 0 {
+		return
+	}
+
+	var retry backoff
+
+	for n := 0; ; n = (n + 1) % len(this.addrs) {
+		conn, err := dialRedis(this.addrs[n])
+		if err != nil {
+			this.log.Error("Error connecting to sentinel", "addr", this.addrs[n], "error", err)
+			retry.Wait()
+			continue
+		}
+
+		psc := redis.PubSubConn{Conn: conn}
+		if err := psc.Subscribe(sentinelSwitchMasterChannel); err == nil {
+			this.watch(psc, switched, &retry)
+		}
+		conn.Close()
+
+		retry.Wait()
+	}
+}
+
+func (this *redisSentinel) watch(psc redis.PubSubConn, switched func(addr string), retry *backoff) {
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			fields := strings.Fields(string(v.Data))
+			if len(fields) != 5 || fields[0] != this.master {
+				continue
+			}
+
+			atomic.AddInt64(&this.epoch, 1)
+			switched(fields[3] + ":" + fields[4])
+		case redis.Subscription:
+			retry.Reset()
+		case error:
+			this.log.Error("Error watching sentinel, reconnecting", "error", v)
+			return
+		}
+	}
+}
+
+type sentinelConn struct {
+	redis.Conn
+
+	epoch    int64
+	sentinel *redisSentinel
+}
+
+func (this *sentinelConn) Err() error {
+	if atomic.LoadInt64(&this.sentinel.epoch) != this.epoch {
+		return errFailedOver
+	}
+
+	return this.Conn.Err()
+}
@@ -0,0 +1,121 @@
+package incus
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func bulkString(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+// newFakeSentinel reports the test Redis as master mymaster, announcing a
+// failover to it as soon as anyone subscribes.
+func newFakeSentinel(t *testing.T) *fakeRedisServer {
+	return newFakeRedisServer(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "SENTINEL":
+			if len(args) == 3 && args[2] == "mymaster" {
+				return "*2\r\n" + bulkString(REDISHOST) + bulkString(strconv.Itoa(REDISPORT))
+			}
+			return "*-1\r\n"
+
+		case "SUBSCRIBE":
+			announcement := fmt.Sprintf("mymaster 10.0.0.1 6379 %s %d", REDISHOST, REDISPORT)
+			return "*3\r\n" + bulkString("subscribe") + bulkString(args[1]) + ":1\r\n" +
+				"*3\r\n" + bulkString("message") + bulkString(args[1]) + bulkString(announcement)
+		}
+
+		return "-ERR unknown command\r\n"
+	})
+}
+
+func TestSentinelDial(t *testing.T) {
+	down := newFakeSentinel(t)
+	down.Close()
+
+	up := newFakeSentinel(t)
+	defer up.Close()
+
+	sentinel := newRedisSentinel([]string{down.Addr(), up.Addr()}, "mymaster", nil)
+
+	addr, err := sentinel.MasterAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr != fmt.Sprintf("%s:%d", REDISHOST, REDISPORT) {
+		t.Errorf("Expected the test Redis as master, got %s", addr)
+	}
+
+	conn, err := sentinel.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if pong, err := redis.String(conn.Do("PING")); err != nil || pong != "PONG" {
+		t.Errorf("Expected PONG from the master, got %q %v", pong, err)
+	}
+
+	if _, err := newRedisSentinel([]string{up.Addr()}, "othermaster", nil).MasterAddr(); err == nil {
+		t.Errorf("Expected an error for an unknown master")
+	}
+
+	switched := make(chan string, 1)
+	go sentinel.Watch(func(addr string) {
+		select {
+		case switched <- addr:
+		default:
+		}
+	})
+
+	select {
+	case <-switched:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the failover to be announced")
+	}
+
+	if conn.Err() != errFailedOver {
+		t.Errorf("Expected connections from before the failover to be stale, got %v", conn.Err())
+	}
+}
+
+func TestResubscribeAfterFailover(t *testing.T) {
+	store := newTestRedisStore()
+
+	received := make(chan []byte, 1)
+	if err := store.Subscribe(received, "FailoverTestChannel"); err != nil {
+		t.Fatal(err)
+	}
+
+	publish := func() bool {
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			store.Publish("FailoverTestChannel", "hello")
+
+			select {
+			case msg := <-received:
+				return string(msg) == "hello"
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+
+		return false
+	}
+
+	if !publish() {
+		t.Fatalf("Expected the subscription to receive messages")
+	}
+
+	store.failedOver("127.0.0.1:6380")
+
+	if !publish() {
+		t.Errorf("Expected the subscription to be restored after the failover")
+	}
+}
@@ -1,9 +1,13 @@
 package incus
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -12,7 +16,102 @@ import (
 
 const ClientsKey = "SocketClients"
 const PageKey = "PageClients"
+const TopicKey = "TopicClients"
 const PresenceKeyPrefix = "ClientPresence"
+const HistoryKeyPrefix = "MessageHistory"
+const HistoryIDKey = "MessageHistoryID"
+const HistoryPublishKeyPrefix = "MessageHistoryPublish"
+const AckKeyPrefix = "PendingAcks"
+const AckDeadlineKey = "PendingAckDeadlines"
+const RateLimitKeyPrefix = "RateLimit"
+
+// How long a command's publish ID is remembered, so every node handling the
+// same pub/sub message records it once and agrees on its ID.
+const historyPublishDuration = 30
+
+// Every key a script touches is passed in KEYS and, in cluster mode, tagged
+// by the user or page it belongs to, so that the keys used together share a
+// hash slot. The ID counter and ack deadlines are used on their own.
+
+// KEYS[1] history list, KEYS[2] publish ID, or the history list again without one
+// ARGV[1] message ID, ARGV[2] entry JSON, ARGV[3] history size, ARGV[4] history TTL, ARGV[5] publish ID TTL
+var recordHistoryScript = redis.NewScript(2, `
+if KEYS[2] ~= KEYS[1] then
+	if not redis.call('SET', KEYS[2], ARGV[1], 'NX', 'EX', ARGV[5]) then
+		return tonumber(redis.call('GET', KEYS[2]))
+	end
+end
+
+redis.call('RPUSH', KEYS[1], ARGV[1] .. ' ' .. ARGV[2])
+redis.call('LTRIM', KEYS[1], -tonumber(ARGV[3]), -1)
+redis.call('EXPIRE', KEYS[1], ARGV[4])
+return tonumber(ARGV[1])
+`)
+
+// KEYS[1] publish ID
+// ARGV[1] message ID, ARGV[2] publish ID TTL
+var messageIDScript = redis.NewScript(1, `
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'EX', ARGV[2]) then
+	return tonumber(ARGV[1])
+end
+return tonumber(redis.call('GET', KEYS[1]))
+`)
+
+// KEYS[1] user's pending acks
+// ARGV[1] message ID, ARGV[2] pending ack JSON, ARGV[3] TTL
+var addAckScript = redis.NewScript(1, `
+local added = redis.call('HSETNX', KEYS[1], ARGV[1], ARGV[2])
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+return added
+`)
+
+// Removes and returns a pending ack.
+// KEYS[1] user's pending acks
+// ARGV[1] message ID
+var takeAckScript = redis.NewScript(1, `
+local ack = redis.call('HGET', KEYS[1], ARGV[1])
+if ack then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return ack
+`)
+
+// Removes and returns up to ARGV[2] members of the ack deadlines whose
+// deadline is before ARGV[1]. Members are "<ID>:<UID>".
+// KEYS[1] ack deadlines
+// ARGV[1] now, ARGV[2] limit
+var expireAcksScript = redis.NewScript(1, `
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+if #due > 0 then
+	redis.call('ZREM', KEYS[1], unpack(due))
+end
+return due
+`)
+
+// Takes a token from a bucket of ARGV[2] tokens refilled at ARGV[1] per
+// second, returning 1 if there was one.
+// KEYS[1] bucket
+// ARGV[1] rate, ARGV[2] burst, ARGV[3] now in milliseconds
+var rateLimitScript = redis.NewScript(1, `
+local rate, burst, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(bucket[1]) or burst
+local updated = tonumber(bucket[2]) or now
+if now > updated then
+	tokens = math.min(burst, tokens + (now - updated) * rate / 1000)
+	updated = now
+end
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'updated', updated)
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return allowed
+`)
 
 var timedOut = errors.New("Timed out waiting for Redis")
 
@@ -31,8 +130,17 @@ type RedisCommand struct {
 type RedisStore struct {
 	clientsKey        string
 	pageKey           string
+	topicKey          string
 	presenceKeyPrefix string
 	presenceDuration  int64
+	historySize       int
+	historyTTL        int64
+
+	// In cluster mode, keys are tagged by the user or page they belong to.
+	cluster bool
+
+	subscriptionsMu sync.Mutex
+	subscriptions   map[redis.Conn]bool
 
 	server                    string
 	port                      int
@@ -40,152 +148,243 @@ type RedisStore struct {
 	pollingFreq               time.Duration
 	incomingRedisActivityCmds chan RedisCommand
 	redisPendingQueue         *RedisQueue
-}
 
-//connection pool implimentation
-type redisPool struct {
-	connections chan redis.Conn
-	maxIdle     int
-	connFn      func() (redis.Conn, error) // function to create new connection.
+	// Closed to stop the goroutines polling queues.
+	pollStop     chan struct{}
+	pollStopOnce sync.Once
+	pollers      sync.WaitGroup
+
+	log *Logger
+
+	// For Health, all updated atomically.
+	subscriptionCount int32
+	subscribedCount   int32
+	activePollers     int32
+	lastPoll          int64 // unix nanoseconds
 }
 
-func newRedisStore(redisHost string, redisPort, numberOfActivityConsumers, connPoolSize int, stats RuntimeStats) *RedisStore {
+func newRedisStore(redisHost string, redisPort, numberOfActivityConsumers, connPoolSize int, stats RuntimeStats, logger *Logger) *RedisStore {
+	logger = logger.With("component", "redis")
 
-	pool := &redisPool{
-		connections: make(chan redis.Conn, connPoolSize),
-		maxIdle:     connPoolSize,
+	connFn := func() (redis.Conn, error) {
+		client, err := redis.Dial("tcp", fmt.Sprintf("%s:%v", redisHost, redisPort))
+		if err != nil {
+			logger.Error("Redis connect failed", "error", err)
+			return nil, err
+		}
 
-		connFn: func() (redis.Conn, error) {
-			client, err := redis.Dial("tcp", fmt.Sprintf("%s:%v", redisHost, redisPort))
-			if err != nil {
-				log.Printf("Redis connect failed: %s\n", err.Error())
-				return nil, err
-			}
+		return client, nil
+	}
+
+	var sentinel *redisSentinel
+	cluster := false
 
-			return client, nil
-		},
+	switch viper.GetString("redis_mode") {
+	case RedisModeSentinel:
+		sentinel = newRedisSentinel(splitAddrs(viper.GetString("redis_sentinel_addrs")), viper.GetString("redis_sentinel_master"), logger)
+		connFn = sentinel.Dial
+	case RedisModeCluster:
+		connFn = newRedisCluster(splitAddrs(viper.GetString("redis_cluster_addrs")), logger).Dial
+		cluster = true
 	}
 
-	redisPendingQueue := NewRedisQueue(numberOfActivityConsumers, stats, pool)
+	pool := newRedisPool(connFn, connPoolSize,
+		viper.GetInt("redis_pool_max_active"),
+		time.Duration(viper.GetInt("redis_pool_wait_timeout"))*time.Millisecond,
+		time.Duration(viper.GetInt("redis_pool_idle_timeout"))*time.Second,
+		stats)
 
-	return &RedisStore{
+	redisPendingQueue := NewRedisQueue(numberOfActivityConsumers, stats, pool, logger)
+
+	store := &RedisStore{
 		redisPendingQueue: redisPendingQueue,
 		clientsKey:        ClientsKey,
 		pageKey:           PageKey,
+		topicKey:          TopicKey,
 		presenceKeyPrefix: PresenceKeyPrefix,
 		presenceDuration:  60,
+		historySize:       viper.GetInt("history_size"),
+		historyTTL:        viper.GetInt64("history_ttl"),
+		cluster:           cluster,
+		subscriptions:     make(map[redis.Conn]bool),
 		server:            redisHost,
 		port:              redisPort,
 		pool:              pool,
 		pollingFreq:       time.Millisecond * 100,
+		pollStop:          make(chan struct{}),
+		log:               logger,
 	}
 
-}
-
-func (this *redisPool) Get() (redis.Conn, bool) {
-
-	var conn redis.Conn
-	select {
-	case conn = <-this.connections:
-	default:
-		conn, err := this.connFn()
-		if err != nil {
-			return nil, false
-		}
-
-		return conn, true
+	if sentinel != nil {
+		go sentinel.Watch(store.failedOver)
 	}
 
-	if err := this.testConn(conn); err != nil {
-		return this.Get() // if connection is bad, get the next one in line until base case is hit, then create new client
+	return store
+}
+
+// tagged is the key under prefix for name, a user or page. In cluster mode
+// name is the key's hash tag, so that keys for the same user or page share a
+// hash slot while users and pages spread over the cluster.
+func (this *RedisStore) tagged(prefix, name string) string {
+	if this.cluster {
+		return prefix + ":{" + name + "}"
 	}
 
-	return conn, true
+	return prefix + ":" + name
 }
 
-func (this *redisPool) Close(conn redis.Conn) {
-	select {
-	case this.connections <- conn:
-		return
-	default:
-		conn.Close()
-	}
+func (this *RedisStore) presenceKey(user string) string {
+	return this.tagged(this.presenceKeyPrefix, user)
 }
 
-func (this *redisPool) testConn(conn redis.Conn) error {
-	if _, err := conn.Do("PING"); err != nil {
-		conn.Close()
-		return err
-	}
+// historyKey is the history list of a user or page, kind being "user" or "page".
+func (this *RedisStore) historyKey(kind, name string) string {
+	return this.tagged(HistoryKeyPrefix+":"+kind, name)
+}
 
-	return nil
+func (this *RedisStore) ackKey(UID string) string {
+	return this.tagged(AckKeyPrefix, UID)
 }
 
-func (this *RedisStore) GetConn() (redis.Conn, error) {
+// failedOver drops every connection to the old master, so that the pool and
+// subscriptions reconnect to the new one.
+func (this *RedisStore) failedOver(addr string) {
+	this.log.Warn("Redis master failed over, reconnecting", "addr", addr)
 
-	client, ok := this.pool.Get()
-	if !ok {
-		return nil, errors.New("Error while getting redis connection")
+	this.pool.Flush()
+
+	this.subscriptionsMu.Lock()
+	for conn := range this.subscriptions {
+		conn.Close()
 	}
+	this.subscriptionsMu.Unlock()
+}
 
-	return client, nil
+func (this *RedisStore) GetConn() (redis.Conn, error) {
+	return this.pool.Get()
 }
 
 func (this *RedisStore) CloseConn(conn redis.Conn) {
-	this.pool.Close(conn)
+	this.pool.Put(conn)
 }
 
-func (this *RedisStore) Subscribe(c chan []byte, channel string) (redis.Conn, error) {
-	conn, err := this.GetConn()
+// PoolStats returns how many connections are in use and how many are idle.
+func (this *RedisStore) PoolStats() (active, idle int) {
+	return this.pool.Stats()
+}
+
+// Subscribe sends everything published on channel to c. A subscription
+// holds its connection for good, so it gets its own rather than one from
+// the pool, and reconnects with backoff when it is dropped.
+func (this *RedisStore) Subscribe(c chan []byte, channel string) error {
+	conn, err := this.pool.connFn()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	psc := redis.PubSubConn{Conn: conn}
-	psc.Subscribe(channel)
+	atomic.AddInt32(&this.subscriptionCount, 1)
+
 	go func() {
-		defer conn.Close()
+		var retry backoff
+
 		for {
-			switch v := psc.Receive().(type) {
-			case redis.Message:
-				c <- v.Data
-			case redis.Subscription:
-			case error:
-				log.Printf("Error receiving: %s. Reconnecting...", v.Error())
-				conn, err = this.GetConn()
-				if err != nil {
-					log.Println(err)
-				}
+			this.subscriptionsMu.Lock()
+			this.subscriptions[conn] = true
+			this.subscriptionsMu.Unlock()
 
-				psc = redis.PubSubConn{Conn: conn}
-				psc.Subscribe(channel)
+			psc := redis.PubSubConn{Conn: conn}
+			if err := psc.Subscribe(channel); err == nil {
+				this.receive(psc, c, &retry)
+			}
+			conn.Close()
+
+			this.subscriptionsMu.Lock()
+			delete(this.subscriptions, conn)
+			this.subscriptionsMu.Unlock()
+
+			for {
+				retry.Wait()
+
+				if conn, err = this.pool.connFn(); err == nil {
+					break
+				}
 			}
 		}
 	}()
 
-	return conn, nil
+	return nil
+}
+
+func (this *RedisStore) receive(psc redis.PubSubConn, c chan []byte, retry *backoff) {
+	subscribed := false
+	defer func() {
+		if subscribed {
+			atomic.AddInt32(&this.subscribedCount, -1)
+		}
+	}()
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			c <- v.Data
+		case redis.Subscription:
+			retry.Reset()
+			if !subscribed {
+				subscribed = true
+				atomic.AddInt32(&this.subscribedCount, 1)
+			}
+		case error:
+			this.log.Error("Error receiving, reconnecting", "error", v)
+			return
+		}
+	}
 }
 
 func (this *RedisStore) Poll(c chan []byte, queue string) error {
+	this.pollers.Add(1)
+	this.pollerStarted()
+
 	go func() {
-		consumer, _ := this.GetConn()
-		defer this.CloseConn(consumer)
-		var err error
+		defer this.pollers.Done()
+		defer this.pollerStopped()
+
+		var retry backoff
 
 		for {
-			consumer, err = this.GetConn()
+			select {
+			case <-this.pollStop:
+				return
+			default:
+			}
+
+			consumer, err := this.GetConn()
 			if err != nil {
-				time.Sleep(time.Millisecond * 100)
+				this.log.Error("Error polling", "queue", queue, "error", err)
+				retry.Wait()
 				continue
 			}
 
 			message, err := redis.Bytes(consumer.Do("LPOP", queue))
 			this.CloseConn(consumer)
 
+			if err == nil || err == redis.ErrNil {
+				this.polled()
+			}
+
 			if err == nil && len(message) > 0 {
+				retry.Reset()
 				c <- message
+			} else if err != nil && err != redis.ErrNil {
+				this.log.Error("Error polling", "queue", queue, "error", err)
+				retry.Wait()
 			} else {
-				time.Sleep(this.pollingFreq)
+				retry.Reset()
+
+				select {
+				case <-this.pollStop:
+					return
+				case <-time.After(this.pollingFreq):
+				}
 			}
 		}
 	}()
@@ -193,9 +392,43 @@ func (this *RedisStore) Poll(c chan []byte, queue string) error {
 	return nil
 }
 
+func (this *RedisStore) pollerStarted() {
+	atomic.AddInt32(&this.activePollers, 1)
+}
+
+func (this *RedisStore) pollerStopped() {
+	atomic.AddInt32(&this.activePollers, -1)
+}
+
+func (this *RedisStore) polled() {
+	atomic.StoreInt64(&this.lastPoll, time.Now().UnixNano())
+}
+
+func (this *RedisStore) Health() BusHealth {
+	health := BusHealth{
+		Subscriptions: int(atomic.LoadInt32(&this.subscriptionCount)),
+		Subscribed:    int(atomic.LoadInt32(&this.subscribedCount)),
+		Polling:       atomic.LoadInt32(&this.activePollers) > 0,
+	}
+
+	if lastPoll := atomic.LoadInt64(&this.lastPoll); lastPoll > 0 {
+		health.LastPoll = time.Unix(0, lastPoll)
+	}
+
+	return health
+}
+
+func (this *RedisStore) StopPolling() {
+	this.pollStopOnce.Do(func() {
+		close(this.pollStop)
+	})
+
+	this.pollers.Wait()
+}
+
 func (this *RedisStore) MarkActive(user, socket_id string, timestamp int64) error {
 	return this.redisPendingQueue.RunAsyncTimeout(5*time.Second, func(conn redis.Conn) (result interface{}, err error) {
-		userSortedSetKey := this.presenceKeyPrefix + ":" + user
+		userSortedSetKey := this.presenceKey(user)
 
 		conn.Send("MULTI")
 		conn.Send("ZADD", userSortedSetKey, timestamp, socket_id)
@@ -206,7 +439,7 @@ func (this *RedisStore) MarkActive(user, socket_id string, timestamp int64) erro
 
 func (this *RedisStore) MarkInactive(user, socket_id string) error {
 	return this.redisPendingQueue.RunAsyncTimeout(5*time.Second, func(conn redis.Conn) (result interface{}, err error) {
-		userSortedSetKey := this.presenceKeyPrefix + ":" + user
+		userSortedSetKey := this.presenceKey(user)
 
 		return conn.Do("ZREM", userSortedSetKey, socket_id)
 	}).Error
@@ -214,7 +447,7 @@ func (this *RedisStore) MarkInactive(user, socket_id string) error {
 
 func (this *RedisStore) QueryIsUserActive(user string, nowTimestamp int64) (bool, error) {
 	result := this.redisPendingQueue.RunAsyncTimeout(5*time.Second, func(conn redis.Conn) (result interface{}, err error) {
-		userSortedSetKey := this.presenceKeyPrefix + ":" + user
+		userSortedSetKey := this.presenceKey(user)
 
 		reply, err := conn.Do("ZRANGEBYSCORE", userSortedSetKey, nowTimestamp-this.presenceDuration, nowTimestamp)
 
@@ -230,9 +463,7 @@ func (this *RedisStore) QueryIsUserActive(user string, nowTimestamp int64) (bool
 	}
 }
 
-func (this *RedisStore) GetIsLongpollKillswitchActive() (bool, error) {
-	killswitchKey := viper.Get("longpoll_killswitch")
-
+func (this *RedisStore) GetIsLongpollKillswitchActive(killswitchKey string) (bool, error) {
 	result := this.redisPendingQueue.RunAsyncTimeout(5*time.Second, func(conn redis.Conn) (result interface{}, err error) {
 		return conn.Do("TTL", killswitchKey)
 	})
@@ -248,17 +479,13 @@ func (this *RedisStore) GetIsLongpollKillswitchActive() (bool, error) {
 	return false, timedOut
 }
 
-func (this *RedisStore) ActivateLongpollKillswitch(seconds int64) error {
-	killswitchKey := viper.Get("longpoll_killswitch")
-
+func (this *RedisStore) ActivateLongpollKillswitch(killswitchKey string, seconds int64) error {
 	return this.redisPendingQueue.RunAsyncTimeout(5*time.Second, func(conn redis.Conn) (result interface{}, err error) {
 		return conn.Do("SETEX", killswitchKey, seconds, "1")
 	}).Error
 }
 
-func (this *RedisStore) DeactivateLongpollKillswitch() error {
-	killswitchKey := viper.Get("longpoll_killswitch")
-
+func (this *RedisStore) DeactivateLongpollKillswitch(killswitchKey string) error {
 	return this.redisPendingQueue.RunAsyncTimeout(5*time.Second, func(conn redis.Conn) (result interface{}, err error) {
 		return conn.Do("DEL", killswitchKey)
 	}).Error
@@ -378,3 +605,290 @@ func (this *RedisStore) UnsetPage(sock *Socket) error {
 
 	return nil
 }
+
+func (this *RedisStore) SubscribeTopic(topic string) error {
+	client, err := this.GetConn()
+	if err != nil {
+		return err
+	}
+	defer this.CloseConn(client)
+
+	_, err = client.Do("HINCRBY", this.topicKey, topic, 1)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (this *RedisStore) UnsubscribeTopic(topic string) error {
+	client, err := this.GetConn()
+	if err != nil {
+		return err
+	}
+	defer this.CloseConn(client)
+
+	var i int64
+	i, err = redis.Int64(client.Do("HINCRBY", this.topicKey, topic, -1))
+	if err != nil {
+		return err
+	}
+
+	if i <= 0 {
+		client.Do("HDEL", this.topicKey, topic)
+	}
+
+	return nil
+}
+
+// RecordHistory appends entry to the history of a user or page. Nodes
+// handling a command with the same publish ID record it once, and share its ID.
+func (this *RedisStore) RecordHistory(kind, name string, entry *historyEntry, publishID string) error {
+	entry_str, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	client, err := this.GetConn()
+	if err != nil {
+		return err
+	}
+	defer this.CloseConn(client)
+
+	id, err := redis.Int64(client.Do("INCR", HistoryIDKey))
+	if err != nil {
+		return err
+	}
+
+	key := this.historyKey(kind, name)
+	publishKey := key
+	if publishID != "" {
+		publishKey = this.tagged(HistoryPublishKeyPrefix+":"+kind+":"+publishID, name)
+	}
+
+	id, err = redis.Int64(recordHistoryScript.Do(client, key, publishKey,
+		id, entry_str, this.historySize, this.historyTTL, historyPublishDuration))
+	if err != nil {
+		return err
+	}
+
+	entry.ID = id
+	entry.Message.ID = id
+
+	return nil
+}
+
+func (this *RedisStore) LastMessageID() (int64, error) {
+	client, err := this.GetConn()
+	if err != nil {
+		return 0, err
+	}
+	defer this.CloseConn(client)
+
+	id, err := redis.Int64(client.Do("GET", HistoryIDKey))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+
+	return id, err
+}
+
+// History returns the history of a user or page, kind being "user" or "page".
+func (this *RedisStore) History(kind, name string) ([]*historyEntry, error) {
+	client, err := this.GetConn()
+	if err != nil {
+		return nil, err
+	}
+	defer this.CloseConn(client)
+
+	items, err := redis.Strings(client.Do("LRANGE", this.historyKey(kind, name), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*historyEntry, 0, len(items))
+	for _, item := range items {
+		parts := strings.SplitN(item, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		entry := new(historyEntry)
+		if err := json.Unmarshal([]byte(parts[1]), entry); err != nil || entry.Message == nil {
+			continue
+		}
+
+		entry.ID, err = strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		entry.Message.ID = entry.ID
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// MessageID gives msg the ID every node handling the command with the same
+// publish ID agrees on, from the same sequence as history.
+func (this *RedisStore) MessageID(msg *Message, publishID string) error {
+	client, err := this.GetConn()
+	if err != nil {
+		return err
+	}
+	defer this.CloseConn(client)
+
+	id, err := redis.Int64(client.Do("INCR", HistoryIDKey))
+	if err != nil {
+		return err
+	}
+
+	if publishID != "" {
+		id, err = redis.Int64(messageIDScript.Do(client, HistoryPublishKeyPrefix+":"+publishID, id, historyPublishDuration))
+		if err != nil {
+			return err
+		}
+	}
+
+	msg.ID = id
+
+	return nil
+}
+
+// TakeRateLimit takes a token from the bucket for key under the limit called
+// name, shared by every node.
+func (this *RedisStore) TakeRateLimit(name, key string, limit RateLimit) (bool, error) {
+	client, err := this.GetConn()
+	if err != nil {
+		return false, err
+	}
+	defer this.CloseConn(client)
+
+	bucketKey := this.tagged(RateLimitKeyPrefix+":"+name, key)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	allowed, err := redis.Int(rateLimitScript.Do(client, bucketKey, limit.Rate, limit.Burst, now))
+	if err != nil {
+		return false, err
+	}
+
+	return allowed == 1, nil
+}
+
+// AddPendingAck records a message sent to a user that has not yet been
+// acknowledged. Every node handling the command may call it; the first wins.
+func (this *RedisStore) AddPendingAck(ack *pendingAck) error {
+	ack_str, err := json.Marshal(ack)
+	if err != nil {
+		return err
+	}
+
+	client, err := this.GetConn()
+	if err != nil {
+		return err
+	}
+	defer this.CloseConn(client)
+
+	id := strconv.FormatInt(ack.Message.ID, 10)
+	ttl := ack.Expires - time.Now().Unix() + 60
+
+	added, err := redis.Int(addAckScript.Do(client, this.ackKey(ack.UID), id, ack_str, ttl))
+	if err != nil || added == 0 {
+		return err
+	}
+
+	_, err = client.Do("ZADD", AckDeadlineKey, ack.Expires, id+":"+ack.UID)
+
+	return err
+}
+
+// Ack removes and returns a pending ack, to only one caller across the cluster.
+func (this *RedisStore) Ack(UID string, id int64) (*pendingAck, error) {
+	client, err := this.GetConn()
+	if err != nil {
+		return nil, err
+	}
+	defer this.CloseConn(client)
+
+	ID := strconv.FormatInt(id, 10)
+	item, err := redis.String(takeAckScript.Do(client, this.ackKey(UID), ID))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	client.Do("ZREM", AckDeadlineKey, ID+":"+UID)
+
+	acks := parsePendingAcks([]string{item})
+	if len(acks) == 0 {
+		return nil, nil
+	}
+
+	return acks[0], nil
+}
+
+func (this *RedisStore) PendingAcks(UID string) ([]*pendingAck, error) {
+	client, err := this.GetConn()
+	if err != nil {
+		return nil, err
+	}
+	defer this.CloseConn(client)
+
+	items, err := redis.Strings(client.Do("HVALS", this.ackKey(UID)))
+	if err != nil {
+		return nil, err
+	}
+
+	return parsePendingAcks(items), nil
+}
+
+// ExpireAcks removes and returns up to limit pending acks whose deadline has
+// passed. Each deadline is taken by one node, which then takes the ack from
+// its user's pending acks unless the user acked it meanwhile.
+func (this *RedisStore) ExpireAcks(now time.Time, limit int) ([]*pendingAck, error) {
+	client, err := this.GetConn()
+	if err != nil {
+		return nil, err
+	}
+	defer this.CloseConn(client)
+
+	due, err := redis.Strings(expireAcksScript.Do(client, AckDeadlineKey, now.Unix(), limit))
+	if err != nil {
+		return nil, err
+	}
+
+	var items []string
+	for _, member := range due {
+		parts := strings.SplitN(member, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		item, err := redis.String(takeAckScript.Do(client, this.ackKey(parts[1]), parts[0]))
+		if err != nil {
+			if err != redis.ErrNil {
+				this.log.Error("Error expiring pending ack", "uid", parts[1], "id", parts[0], "error", err)
+			}
+			continue
+		}
+
+		items = append(items, item)
+	}
+
+	return parsePendingAcks(items), nil
+}
+
+func parsePendingAcks(items []string) []*pendingAck {
+	acks := make([]*pendingAck, 0, len(items))
+	for _, item := range items {
+		ack := new(pendingAck)
+		if err := json.Unmarshal([]byte(item), ack); err != nil || ack.Message == nil {
+			continue
+		}
+
+		acks = append(acks, ack)
+	}
+
+	return acks
+}
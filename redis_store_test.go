@@ -1,10 +1,14 @@
 package incus
 
 import (
+	"encoding/json"
 	"log"
 	"os"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/garyburd/redigo/redis"
 )
 
 var (
@@ -14,13 +18,13 @@ var (
 
 func newTestRedisStore() *RedisStore {
 	stats := &DiscardStats{}
-	store := newRedisStore(REDISHOST, REDISPORT, 5, 3, stats)
+	store := newRedisStore(REDISHOST, REDISPORT, 5, 3, stats, nil)
 	store.presenceDuration = 10
 	return store
 }
 
 func TestMain(m *testing.M) {
-	DEBUG = true
+	defaultLogger.SetLevel(LevelDebug)
 	store := newTestRedisStore()
 	_, err := store.GetConn()
 
@@ -258,9 +262,9 @@ func TestUserPresenceIsImmediatelyRemovedUponMarkingInactive(t *testing.T) {
 func TestKillswitch(t *testing.T) {
 	store := newTestRedisStore()
 
-	store.DeactivateLongpollKillswitch()
+	store.DeactivateLongpollKillswitch("longpoll_killswitch")
 
-	active, err := store.GetIsLongpollKillswitchActive()
+	active, err := store.GetIsLongpollKillswitchActive("longpoll_killswitch")
 
 	if err != nil {
 		t.Fatalf("Unexpected error: %s", err.Error())
@@ -269,9 +273,9 @@ func TestKillswitch(t *testing.T) {
 		t.Fatalf("Expected precondition that killswitch is inactive")
 	}
 
-	store.ActivateLongpollKillswitch(3)
+	store.ActivateLongpollKillswitch("longpoll_killswitch", 3)
 
-	active, err = store.GetIsLongpollKillswitchActive()
+	active, err = store.GetIsLongpollKillswitchActive("longpoll_killswitch")
 
 	if err != nil {
 		t.Fatalf("Unexpected error: %s", err.Error())
@@ -282,7 +286,7 @@ func TestKillswitch(t *testing.T) {
 
 	time.Sleep(4 * time.Second)
 
-	active, err = store.GetIsLongpollKillswitchActive()
+	active, err = store.GetIsLongpollKillswitchActive("longpoll_killswitch")
 
 	if err != nil {
 		t.Fatalf("Unexpected error: %s", err.Error())
@@ -291,3 +295,214 @@ func TestKillswitch(t *testing.T) {
 		t.Fatalf("Expected killswitch to be inactive")
 	}
 }
+
+func TestRecordHistory(t *testing.T) {
+	store := newTestRedisStore()
+	store.historySize = 2
+	store.historyTTL = 10
+
+	client, _ := store.GetConn()
+	client.Do("DEL", "MessageHistory:user:historytest", HistoryPublishKeyPrefix+":user:historytest-1:historytest", HistoryPublishKeyPrefix+":user:historytest-2:historytest")
+	store.CloseConn(client)
+
+	first := &historyEntry{Message: &Message{Event: "first"}}
+	if err := store.RecordHistory("user", "historytest", first, "historytest-1"); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	// Another node handling the same command must not record it twice.
+	duplicate := &historyEntry{Message: &Message{Event: "first"}}
+	store.RecordHistory("user", "historytest", duplicate, "historytest-1")
+	if duplicate.ID != first.ID || duplicate.Message.ID != first.ID {
+		t.Fatalf("Expected duplicate to share ID %d, instead %d", first.ID, duplicate.ID)
+	}
+
+	// The same command published again is a message of its own.
+	second := &historyEntry{Page: "/gallery", Message: &Message{Event: "second"}}
+	store.RecordHistory("user", "historytest", second, "historytest-2")
+	if second.ID <= first.ID {
+		t.Fatalf("Expected IDs to increase, instead %d after %d", second.ID, first.ID)
+	}
+
+	last, err := store.LastMessageID()
+	if err != nil || last != second.ID {
+		t.Fatalf("Expected last message ID to be %d, instead %d (%v)", second.ID, last, err)
+	}
+
+	entries, err := store.History("user", "historytest")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 history entries, instead %+v", entries)
+	}
+	if entries[1].ID != second.ID || entries[1].Page != "/gallery" || entries[1].Message.Event != "second" {
+		t.Fatalf("Expected second entry to round trip, instead %+v", entries[1])
+	}
+
+	// Identical commands without a publish ID are never deduplicated.
+	third := &historyEntry{Message: &Message{Event: "same"}}
+	fourth := &historyEntry{Message: &Message{Event: "same"}}
+	store.RecordHistory("user", "historytest", third, "")
+	store.RecordHistory("user", "historytest", fourth, "")
+	if third.ID == 0 || fourth.ID <= third.ID {
+		t.Fatalf("Expected identical commands to get their own IDs, instead %d and %d", third.ID, fourth.ID)
+	}
+}
+
+func TestRAcks(t *testing.T) {
+	store := newTestRedisStore()
+
+	client, _ := store.GetConn()
+	client.Do("DEL", AckKeyPrefix+":acktest", HistoryPublishKeyPrefix+":acktest-1")
+	store.CloseConn(client)
+
+	msg := &Message{Event: "first"}
+	if err := store.MessageID(msg, "acktest-1"); err != nil || msg.ID == 0 {
+		t.Fatalf("Expected a message ID, instead %d (%v)", msg.ID, err)
+	}
+
+	// Another node handling the same command agrees on its ID.
+	duplicate := &Message{Event: "first"}
+	store.MessageID(duplicate, "acktest-1")
+	if duplicate.ID != msg.ID {
+		t.Fatalf("Expected duplicate to share ID %d, instead %d", msg.ID, duplicate.ID)
+	}
+
+	unpublished := &Message{Event: "first"}
+	store.MessageID(unpublished, "")
+	if unpublished.ID == 0 || unpublished.ID == msg.ID {
+		t.Fatalf("Expected a command without a publish ID to get a new ID, instead %d", unpublished.ID)
+	}
+
+	expires := time.Now().Add(time.Minute).Unix()
+	store.AddPendingAck(&pendingAck{UID: "acktest", Message: msg, Expires: expires})
+	store.AddPendingAck(&pendingAck{UID: "acktest", Message: duplicate, Expires: expires})
+
+	pending, err := store.PendingAcks("acktest")
+	if err != nil || len(pending) != 1 || pending[0].Message.ID != msg.ID {
+		t.Fatalf("Expected one pending message, instead %+v (%v)", pending, err)
+	}
+
+	ack, err := store.Ack("acktest", msg.ID)
+	if err != nil || ack == nil || ack.Message.Event != "first" {
+		t.Fatalf("Expected acking the message to return it, instead %+v (%v)", ack, err)
+	}
+	if ack, _ := store.Ack("acktest", msg.ID); ack != nil {
+		t.Fatalf("Expected acking twice to return nothing, instead %+v", ack)
+	}
+
+	second := &Message{ID: msg.ID + 1, Event: "second"}
+	store.AddPendingAck(&pendingAck{UID: "acktest", Message: second, Expires: expires})
+
+	expired, err := store.ExpireAcks(time.Now().Add(2*time.Minute), 1000)
+	if err != nil || len(expired) == 0 {
+		t.Fatalf("Expected the unacked message to expire, instead %+v (%v)", expired, err)
+	}
+	if pending, _ := store.PendingAcks("acktest"); len(pending) != 0 {
+		t.Fatalf("Expected nothing pending after expiry, instead %+v", pending)
+	}
+}
+
+func TestRouteMessage(t *testing.T) {
+	store := newTestRedisStore()
+	key := userNodesKey("routetest")
+
+	client, _ := store.GetConn()
+	client.Do("DEL", key)
+	store.CloseConn(client)
+
+	store.AddNode(key, "node-b")
+	store.AddNode(key, "node-b")
+	store.AddNode(key, "node-gone")
+	store.RemoveNode(key, "node-b")
+
+	nodes, err := store.Nodes(key)
+	if err != nil || len(nodes) != 2 {
+		t.Fatalf("Expected two nodes, instead %+v (%v)", nodes, err)
+	}
+
+	received := make(chan []byte, 1)
+	store.Subscribe(received, nodeChannel("node-b"))
+
+	// Wait for the subscription, or node-b looks gone.
+	for i := 0; i < 100; i++ {
+		client, _ := store.GetConn()
+		reply, _ := redis.Values(client.Do("PUBSUB", "NUMSUB", nodeChannel("node-b")))
+		store.CloseConn(client)
+
+		if subscribers, _ := redis.Int(reply[1], nil); subscribers > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server := &Server{
+		ID:    "node-a",
+		Store: &Storage{memory: newMemoryStore(0), redis: store, StorageType: "redis", targetedRouting: true},
+		Stats: &DiscardStats{},
+	}
+
+	server.routeMessage(&CommandMsg{
+		Command: map[string]string{"command": "message", "user": "routetest"},
+		Message: map[string]interface{}{"event": "routed", "data": map[string]interface{}{}},
+	})
+
+	select {
+	case data := <-received:
+		var cmd CommandMsg
+		if json.Unmarshal(data, &cmd); cmd.Command["user"] != "routetest" || cmd.Message["event"] != "routed" {
+			t.Fatalf("Unexpected routed command %s", data)
+		}
+		if !strings.HasPrefix(cmd.PublishID, "node-a:") {
+			t.Fatalf("Expected the routed command to carry a publish ID from node-a, instead %q", cmd.PublishID)
+		}
+		if !cmd.Recorded {
+			t.Fatalf("Expected the routed command to have been recorded by node-a")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the message to be routed to node-b")
+	}
+
+	if nodes, _ := store.Nodes(key); len(nodes) != 1 || nodes[0] != "node-b" {
+		t.Fatalf("Expected the node that's gone to be forgotten, instead %+v", nodes)
+	}
+
+	store.RemoveNode(key, "node-b")
+	if nodes, _ := store.Nodes(key); len(nodes) != 0 {
+		t.Fatalf("Expected no nodes after the last socket left, instead %+v", nodes)
+	}
+}
+
+func TestStopPolling(t *testing.T) {
+	store := newTestRedisStore()
+	queue := "incusTestingStopPolling"
+
+	conn, _ := store.GetConn()
+	defer store.CloseConn(conn)
+	conn.Do("DEL", queue)
+
+	c := make(chan []byte, 10)
+	store.Poll(c, queue)
+
+	conn.Do("RPUSH", queue, "one")
+	select {
+	case msg := <-c:
+		if string(msg) != "one" {
+			t.Errorf("Expected one, got %s", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the queue to be polled")
+	}
+
+	store.StopPolling()
+
+	conn.Do("RPUSH", queue, "two")
+	time.Sleep(3 * store.pollingFreq)
+
+	if length, _ := redis.Int(conn.Do("LLEN", queue)); length != 1 {
+		t.Errorf("Expected the queue to be left alone once stopped, %d left", length)
+	}
+
+	conn.Do("DEL", queue)
+}
@@ -0,0 +1,392 @@
+package incus
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// The field of each stream entry holding the command JSON.
+const StreamCommandField = "command"
+
+const (
+	streamReadCount = 100
+	streamReadBlock = 5 * time.Second
+)
+
+// A command handler's error for commands that can never succeed, which are
+// dead-lettered straight away instead of being retried.
+var errInvalidCommand = errors.New("Invalid command")
+
+type StreamEntry struct {
+	ID         string
+	Command    []byte
+	Deliveries int64
+}
+
+// StreamConsumer reads commands from a Redis stream as one member of a
+// consumer group, acknowledging each once handled. Commands a node was
+// handling when it died stay pending, and are claimed by another consumer
+// after ClaimIdle; those delivered more than MaxDeliveries times, or that
+// are invalid, are moved to the DeadLetter stream.
+type StreamConsumer struct {
+	Stream        string
+	Group         string
+	Consumer      string
+	DeadLetter    string
+	ClaimIdle     time.Duration
+	MaxDeliveries int64
+
+	store  *RedisStore
+	stats  RuntimeStats
+	handle func([]byte) error
+
+	stopped int32 // set atomically by Stop
+}
+
+func NewStreamConsumer(store *RedisStore, stats RuntimeStats, stream, group, consumer, deadLetter string, claimIdle time.Duration, maxDeliveries int64, handle func([]byte) error) *StreamConsumer {
+	return &StreamConsumer{
+		Stream:        stream,
+		Group:         group,
+		Consumer:      consumer,
+		DeadLetter:    deadLetter,
+		ClaimIdle:     claimIdle,
+		MaxDeliveries: maxDeliveries,
+
+		store:  store,
+		stats:  stats,
+		handle: handle,
+	}
+}
+
+// Run consumes the stream until Stop is called or the process exits.
+func (this *StreamConsumer) Run() {
+	var retry backoff
+
+	for {
+		if err := this.store.CreateStreamGroup(this.Stream, this.Group); err != nil {
+			this.store.log.Error("Error creating consumer group", "stream", this.Stream, "group", this.Group, "error", err)
+			retry.Wait()
+			continue
+		}
+
+		retry.Reset()
+		break
+	}
+
+	this.store.pollerStarted()
+	defer this.store.pollerStopped()
+
+	// Anything this consumer read before it last stopped, and never acked.
+	this.Recover()
+
+	lastClaim := time.Now()
+	for {
+		entries, err := this.store.ReadStream(this.Stream, this.Group, this.Consumer, ">", streamReadCount, streamReadBlock)
+		if err != nil {
+			this.store.log.Error("Error reading stream", "stream", this.Stream, "error", err)
+			retry.Wait()
+		} else {
+			retry.Reset()
+			this.store.polled()
+		}
+
+		// What was read stays pending, for another consumer to claim.
+		if this.isStopped() {
+			return
+		}
+
+		for _, entry := range entries {
+			go this.Process(entry)
+		}
+
+		if time.Since(lastClaim) >= this.ClaimIdle {
+			this.Claim()
+			lastClaim = time.Now()
+		}
+	}
+}
+
+// Stop stops reading new entries. Entries read but not yet handled stay
+// pending, and are claimed by another consumer after ClaimIdle.
+func (this *StreamConsumer) Stop() {
+	atomic.StoreInt32(&this.stopped, 1)
+}
+
+func (this *StreamConsumer) isStopped() bool {
+	return atomic.LoadInt32(&this.stopped) == 1
+}
+
+// Recover handles the entries delivered to this consumer but never acked.
+func (this *StreamConsumer) Recover() {
+	start := "0"
+	for {
+		entries, err := this.store.ReadStream(this.Stream, this.Group, this.Consumer, start, streamReadCount, 0)
+		if err != nil {
+			this.store.log.Error("Error recovering pending entries", "stream", this.Stream, "error", err)
+			return
+		}
+
+		if len(entries) == 0 {
+			return
+		}
+
+		for _, entry := range entries {
+			this.countDeliveries(entry)
+			this.Process(entry)
+			start = entry.ID
+		}
+	}
+}
+
+// Claim takes over and handles entries left pending by any consumer for
+// longer than ClaimIdle.
+func (this *StreamConsumer) Claim() {
+	start := "0-0"
+	for {
+		next, entries, err := this.store.ClaimStream(this.Stream, this.Group, this.Consumer, this.ClaimIdle, start, streamReadCount)
+		if err != nil {
+			this.store.log.Error("Error claiming pending entries", "stream", this.Stream, "error", err)
+			return
+		}
+
+		for _, entry := range entries {
+			this.countDeliveries(entry)
+			go this.Process(entry)
+		}
+
+		if next == "0-0" || len(entries) == 0 {
+			return
+		}
+		start = next
+	}
+}
+
+func (this *StreamConsumer) countDeliveries(entry *StreamEntry) {
+	deliveries, err := this.store.StreamDeliveries(this.Stream, this.Group, entry.ID)
+	if err != nil {
+		this.store.log.Error("Error counting deliveries", "stream", this.Stream, "entry", entry.ID, "error", err)
+		return
+	}
+
+	entry.Deliveries = deliveries
+}
+
+// Process handles one entry, acknowledging it if it succeeded and leaving it
+// pending to be claimed again if it failed.
+func (this *StreamConsumer) Process(entry *StreamEntry) {
+	if entry.Command == nil {
+		this.deadLetter(entry, "missing "+StreamCommandField+" field")
+		return
+	}
+
+	if this.MaxDeliveries > 0 && entry.Deliveries > this.MaxDeliveries {
+		this.deadLetter(entry, fmt.Sprintf("failed after %d deliveries", entry.Deliveries-1))
+		return
+	}
+
+	if err := this.handle(entry.Command); err == errInvalidCommand {
+		this.deadLetter(entry, err.Error())
+		return
+	} else if err != nil {
+		this.store.log.Warn("Error handling entry, will retry", "stream", this.Stream, "entry", entry.ID, "error", err)
+		return
+	}
+
+	if err := this.store.AckStream(this.Stream, this.Group, entry.ID); err != nil {
+		this.store.log.Error("Error acknowledging entry", "stream", this.Stream, "entry", entry.ID, "error", err)
+	}
+}
+
+func (this *StreamConsumer) deadLetter(entry *StreamEntry, reason string) {
+	this.store.log.Warn("Moving entry to dead letter stream", "stream", this.Stream, "entry", entry.ID, "dead_letter", this.DeadLetter, "reason", reason)
+	this.stats.LogDeadLetter()
+
+	if err := this.store.DeadLetterStream(this.Stream, this.Group, this.DeadLetter, entry, reason); err != nil {
+		this.store.log.Error("Error dead-lettering entry", "stream", this.Stream, "entry", entry.ID, "error", err)
+	}
+}
+
+// CreateStreamGroup creates group on stream, and stream if need be. New
+// groups start with entries added from now on.
+func (this *RedisStore) CreateStreamGroup(stream, group string) error {
+	client, err := this.GetConn()
+	if err != nil {
+		return err
+	}
+	defer this.CloseConn(client)
+
+	_, err = client.Do("XGROUP", "CREATE", stream, group, "$", "MKSTREAM")
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+
+	return err
+}
+
+// ReadStream reads entries for consumer: new ones with start ">", or its
+// pending ones after start otherwise. A block of 0 doesn't wait.
+func (this *RedisStore) ReadStream(stream, group, consumer, start string, count int, block time.Duration) ([]*StreamEntry, error) {
+	client, err := this.GetConn()
+	if err != nil {
+		return nil, err
+	}
+	defer this.CloseConn(client)
+
+	args := redis.Args{"GROUP", group, consumer, "COUNT", count}
+	if block > 0 {
+		args = args.Add("BLOCK", int64(block/time.Millisecond))
+	}
+	args = args.Add("STREAMS", stream, start)
+
+	reply, err := redis.Values(client.Do("XREADGROUP", args...))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var entries []*StreamEntry
+	for _, item := range reply {
+		streamReply, err := redis.Values(item, nil)
+		if err != nil || len(streamReply) != 2 {
+			return nil, fmt.Errorf("Unexpected XREADGROUP reply %v", item)
+		}
+
+		parsed, err := parseStreamEntries(streamReply[1])
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, parsed...)
+	}
+
+	for _, entry := range entries {
+		entry.Deliveries = 1
+	}
+
+	return entries, nil
+}
+
+// ClaimStream hands consumer the entries pending for longer than minIdle,
+// from start, returning where to continue from.
+func (this *RedisStore) ClaimStream(stream, group, consumer string, minIdle time.Duration, start string, count int) (string, []*StreamEntry, error) {
+	client, err := this.GetConn()
+	if err != nil {
+		return "", nil, err
+	}
+	defer this.CloseConn(client)
+
+	reply, err := redis.Values(client.Do("XAUTOCLAIM", stream, group, consumer, int64(minIdle/time.Millisecond), start, "COUNT", count))
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(reply) < 2 {
+		return "", nil, fmt.Errorf("Unexpected XAUTOCLAIM reply %v", reply)
+	}
+
+	next, err := redis.String(reply[0], nil)
+	if err != nil {
+		return "", nil, err
+	}
+
+	entries, err := parseStreamEntries(reply[1])
+
+	return next, entries, err
+}
+
+// StreamDeliveries returns how many times a pending entry has been delivered.
+func (this *RedisStore) StreamDeliveries(stream, group, ID string) (int64, error) {
+	client, err := this.GetConn()
+	if err != nil {
+		return 0, err
+	}
+	defer this.CloseConn(client)
+
+	reply, err := redis.Values(client.Do("XPENDING", stream, group, ID, ID, 1))
+	if err != nil {
+		return 0, err
+	}
+
+	if len(reply) == 0 {
+		return 0, nil
+	}
+
+	pending, err := redis.Values(reply[0], nil)
+	if err != nil || len(pending) != 4 {
+		return 0, fmt.Errorf("Unexpected XPENDING reply %v", reply)
+	}
+
+	return redis.Int64(pending[3], nil)
+}
+
+func (this *RedisStore) AckStream(stream, group, ID string) error {
+	client, err := this.GetConn()
+	if err != nil {
+		return err
+	}
+	defer this.CloseConn(client)
+
+	_, err = client.Do("XACK", stream, group, ID)
+
+	return err
+}
+
+// DeadLetterStream moves an entry to the deadLetter stream, along with why.
+func (this *RedisStore) DeadLetterStream(stream, group, deadLetter string, entry *StreamEntry, reason string) error {
+	client, err := this.GetConn()
+	if err != nil {
+		return err
+	}
+	defer this.CloseConn(client)
+
+	client.Send("MULTI")
+	client.Send("XADD", deadLetter, "*",
+		StreamCommandField, entry.Command,
+		"error", reason,
+		"stream", stream,
+		"id", entry.ID,
+		"deliveries", entry.Deliveries)
+	client.Send("XACK", stream, group, entry.ID)
+	_, err = client.Do("EXEC")
+
+	return err
+}
+
+// parseStreamEntries parses [[id, [field, value, ...]], ...]. Entries deleted
+// from the stream while pending come back without fields.
+func parseStreamEntries(reply interface{}) ([]*StreamEntry, error) {
+	items, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*StreamEntry, 0, len(items))
+	for _, item := range items {
+		parts, err := redis.Values(item, nil)
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("Unexpected stream entry %v", item)
+		}
+
+		entry := &StreamEntry{}
+		if entry.ID, err = redis.String(parts[0], nil); err != nil {
+			return nil, err
+		}
+
+		fields, _ := redis.Values(parts[1], nil)
+		for i := 0; i+1 < len(fields); i += 2 {
+			if name, _ := redis.String(fields[i], nil); name == StreamCommandField {
+				entry.Command, _ = redis.Bytes(fields[i+1], nil)
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,144 @@
+package incus
+
+import (
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestStreamConsumer(t *testing.T) {
+	store := newTestRedisStore()
+
+	client, _ := store.GetConn()
+	client.Do("DEL", "streamtest", "streamtest-dead")
+	store.CloseConn(client)
+
+	var mu sync.Mutex
+	handled := map[string]int{}
+
+	consumer := NewStreamConsumer(store, &DiscardStats{}, "streamtest", "incus", "node-1", "streamtest-dead", 0, 2, func(data []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		handled[string(data)]++
+
+		switch string(data) {
+		case "invalid":
+			return errInvalidCommand
+		case "failing":
+			return errors.New("Failed")
+		}
+		return nil
+	})
+
+	if err := store.CreateStreamGroup("streamtest", "incus"); err != nil {
+		t.Fatalf("Unexpected error creating group: %s", err.Error())
+	}
+	if err := store.CreateStreamGroup("streamtest", "incus"); err != nil {
+		t.Fatalf("Expected creating the group again to be fine, instead %s", err.Error())
+	}
+
+	client, _ = store.GetConn()
+	for _, command := range []string{"ok", "invalid", "failing"} {
+		client.Do("XADD", "streamtest", "*", StreamCommandField, command)
+	}
+	store.CloseConn(client)
+
+	entries, err := store.ReadStream("streamtest", "incus", "node-1", ">", 10, 0)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("Expected three entries, instead %+v (%v)", entries, err)
+	}
+	for _, entry := range entries {
+		consumer.Process(entry)
+	}
+
+	// Only the failing command is left pending, and is retried until it has
+	// been delivered too many times.
+	consumer.Recover()
+	consumer.Recover()
+
+	if handled["ok"] != 1 || handled["invalid"] != 1 || handled["failing"] != 2 {
+		t.Fatalf("Unexpected handling %+v", handled)
+	}
+
+	client, _ = store.GetConn()
+	defer store.CloseConn(client)
+
+	pending, _ := redis.Values(client.Do("XPENDING", "streamtest", "incus"))
+	if count, _ := redis.Int(pending[0], nil); count != 0 {
+		t.Fatalf("Expected nothing left pending, instead %d", count)
+	}
+
+	dead, _ := redis.Values(client.Do("XRANGE", "streamtest-dead", "-", "+"))
+	if len(dead) != 2 {
+		t.Fatalf("Expected the invalid and failing commands to be dead-lettered, instead %d", len(dead))
+	}
+
+	parsed, _ := parseStreamEntries(dead)
+	if string(parsed[0].Command) != "invalid" || string(parsed[1].Command) != "failing" {
+		t.Fatalf("Unexpected dead letters %s, %s", parsed[0].Command, parsed[1].Command)
+	}
+}
+
+func TestStreamConsumerClaim(t *testing.T) {
+	store := newTestRedisStore()
+
+	client, _ := store.GetConn()
+	client.Do("DEL", "claimtest")
+	store.CreateStreamGroup("claimtest", "incus")
+	client.Do("XADD", "claimtest", "*", StreamCommandField, "orphaned")
+	store.CloseConn(client)
+
+	// A node reads the command, then dies before handling it.
+	store.ReadStream("claimtest", "incus", "node-dead", ">", 10, 0)
+
+	done := make(chan string, 1)
+	consumer := NewStreamConsumer(store, &DiscardStats{}, "claimtest", "incus", "node-2", "claimtest-dead", 0, 5, func(data []byte) error {
+		done <- string(data)
+		return nil
+	})
+	consumer.Claim()
+
+	if command := <-done; command != "orphaned" {
+		t.Fatalf("Expected the orphaned command to be claimed, instead %s", command)
+	}
+}
+
+func TestParseStreamEntries(t *testing.T) {
+	reply := []interface{}{
+		[]interface{}{[]byte("1-0"), []interface{}{[]byte("other"), []byte("x"), []byte(StreamCommandField), []byte("payload")}},
+		[]interface{}{[]byte("2-0"), nil},
+	}
+
+	entries, err := parseStreamEntries(reply)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Expected two entries, instead %+v (%v)", entries, err)
+	}
+	if entries[0].ID != "1-0" || string(entries[0].Command) != "payload" {
+		t.Fatalf("Unexpected first entry %+v", entries[0])
+	}
+	if entries[1].ID != "2-0" || entries[1].Command != nil {
+		t.Fatalf("Expected the deleted entry to have no command, instead %+v", entries[1])
+	}
+}
+
+func TestHandleStreamCommand(t *testing.T) {
+	server := &Server{Store: newTestHistoryStore(0), Stats: &DiscardStats{}, Log: NewLogger(ioutil.Discard, "logfmt", LevelInfo, 0, 0)}
+
+	if err := server.handleStreamCommand([]byte(`{"command": {"command": "message", "user": "TEST"}, "message": {"event": "hi", "data": {}}}`)); err != nil {
+		t.Errorf("Expected a message to be acknowledged, instead %v", err)
+	}
+
+	if err := server.handleStreamCommand([]byte(`{"command": {"command": "explode"}}`)); err != errInvalidCommand {
+		t.Errorf("Expected a rejected command to be dead-lettered, instead %v", err)
+	}
+
+	// Push is disabled, so the push fails.
+	err := server.handleStreamCommand([]byte(`{"command": {"command": "pushios", "build": "store", "device_token": "abc"}, "message": {"event": "hi", "data": {}}}`))
+	if err == nil || err == errInvalidCommand {
+		t.Errorf("Expected a failed command to be retried, instead %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package incus
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+const registryShards = 64
+
+// socketRegistry indexes sockets by a key (a UID, page or topic), then by
+// SID. Keys are spread over shards, each with its own lock, so that sockets
+// connecting and disconnecting under different keys rarely wait on each
+// other. Nothing it returns refers to its internal maps, so results are safe
+// to use without holding any lock.
+type socketRegistry struct {
+	shards [registryShards]registryShard
+
+	keys    int64 // updated atomically
+	sockets int64 // updated atomically
+}
+
+type registryShard struct {
+	sync.RWMutex
+	entries map[string]map[string]*Socket
+}
+
+func newSocketRegistry() *socketRegistry {
+	registry := &socketRegistry{}
+	for i := range registry.shards {
+		registry.shards[i].entries = make(map[string]map[string]*Socket)
+	}
+
+	return registry
+}
+
+func (this *socketRegistry) shard(key string) *registryShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+
+	return &this.shards[hash.Sum32()%registryShards]
+}
+
+// Add files sock under key, returning false if it already was.
+func (this *socketRegistry) Add(key string, sock *Socket) bool {
+	shard := this.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	entry, exists := shard.entries[key]
+	if !exists {
+		entry = make(map[string]*Socket)
+		shard.entries[key] = entry
+		atomic.AddInt64(&this.keys, 1)
+	}
+
+	_, exists = entry[sock.SID]
+	entry[sock.SID] = sock
+	if exists {
+		return false
+	}
+
+	atomic.AddInt64(&this.sockets, 1)
+	return true
+}
+
+// Remove forgets the socket SID under key, returning false if it wasn't there.
+func (this *socketRegistry) Remove(key, SID string) bool {
+	shard := this.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	entry, exists := shard.entries[key]
+	if !exists {
+		return false
+	}
+
+	if _, exists = entry[SID]; !exists {
+		return false
+	}
+
+	delete(entry, SID)
+	atomic.AddInt64(&this.sockets, -1)
+
+	if len(entry) == 0 {
+		delete(shard.entries, key)
+		atomic.AddInt64(&this.keys, -1)
+	}
+
+	return true
+}
+
+// Get returns a copy of the sockets filed under key, or nil if there are none.
+func (this *socketRegistry) Get(key string) map[string]*Socket {
+	shard := this.shard(key)
+	shard.RLock()
+	defer shard.RUnlock()
+
+	entry, exists := shard.entries[key]
+	if !exists {
+		return nil
+	}
+
+	sockets := make(map[string]*Socket, len(entry))
+	for SID, sock := range entry {
+		sockets[SID] = sock
+	}
+
+	return sockets
+}
+
+// Count returns how many sockets are filed under key.
+func (this *socketRegistry) Count(key string) int {
+	shard := this.shard(key)
+	shard.RLock()
+	defer shard.RUnlock()
+
+	return len(shard.entries[key])
+}
+
+// Len returns how many keys have sockets.
+func (this *socketRegistry) Len() int64 {
+	return atomic.LoadInt64(&this.keys)
+}
+
+// Size returns how many sockets are filed, under every key.
+func (this *socketRegistry) Size() int64 {
+	return atomic.LoadInt64(&this.sockets)
+}
+
+// Each calls fn for every socket, a shard at a time. fn runs without any of
+// the registry's locks held, so it may block or change the registry; sockets
+// added or removed meanwhile may or may not be seen.
+func (this *socketRegistry) Each(fn func(key string, sock *Socket)) {
+	type filed struct {
+		key  string
+		sock *Socket
+	}
+
+	var batch []filed
+	for i := range this.shards {
+		shard := &this.shards[i]
+
+		batch = batch[:0]
+		shard.RLock()
+		for key, entry := range shard.entries {
+			for _, sock := range entry {
+				batch = append(batch, filed{key, sock})
+			}
+		}
+		shard.RUnlock()
+
+		for _, f := range batch {
+			fn(f.key, f.sock)
+		}
+	}
+}
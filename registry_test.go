@@ -0,0 +1,80 @@
+package incus
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSocketRegistry(t *testing.T) {
+	registry := newSocketRegistry()
+
+	first := &Socket{SID: "1"}
+	second := &Socket{SID: "2"}
+
+	if !registry.Add("/gallery", first) || !registry.Add("/gallery", second) || registry.Add("/gallery", first) {
+		t.Fatalf("Expected each socket to be added once")
+	}
+	registry.Add("/hot", first)
+
+	if registry.Count("/gallery") != 2 || registry.Count("/nowhere") != 0 {
+		t.Fatalf("Expected 2 sockets on /gallery, instead %d", registry.Count("/gallery"))
+	}
+	if registry.Len() != 2 || registry.Size() != 3 {
+		t.Fatalf("Expected 2 keys and 3 entries, instead %d and %d", registry.Len(), registry.Size())
+	}
+
+	gallery := registry.Get("/gallery")
+	delete(gallery, "1")
+	if registry.Count("/gallery") != 2 {
+		t.Fatalf("Expected changing a copy to leave the registry alone")
+	}
+
+	if !registry.Remove("/gallery", "1") || registry.Remove("/gallery", "1") || !registry.Remove("/gallery", "2") {
+		t.Fatalf("Expected each socket to be removed once")
+	}
+	if registry.Get("/gallery") != nil || registry.Len() != 1 || registry.Size() != 1 {
+		t.Fatalf("Expected only /hot to be left, instead %d keys", registry.Len())
+	}
+}
+
+func TestSocketRegistryConcurrency(t *testing.T) {
+	registry := newSocketRegistry()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 500; j++ {
+				sock := &Socket{SID: fmt.Sprintf("%d-%d", i, j)}
+				UID := fmt.Sprintf("user-%d", j%50)
+
+				registry.Add(UID, sock)
+				if j%2 == 0 {
+					registry.Remove(UID, sock.SID)
+				}
+			}
+		}(i)
+	}
+
+	// Iterating while sockets come and go must not race, and may change the
+	// registry itself.
+	for i := 0; i < 10; i++ {
+		registry.Each(func(UID string, sock *Socket) {
+			if sock.SID[0] == '0' {
+				registry.Remove(UID, sock.SID)
+				registry.Add(UID, sock)
+			}
+		})
+	}
+
+	wg.Wait()
+
+	seen := 0
+	registry.Each(func(UID string, sock *Socket) { seen++ })
+	if seen != 8*250 || registry.Size() != 8*250 || registry.Len() != 25 {
+		t.Fatalf("Expected 2000 sockets over 25 users, instead %d (%d) over %d", seen, registry.Size(), registry.Len())
+	}
+}
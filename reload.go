@@ -0,0 +1,330 @@
+package incus
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Options applied by Reload without a restart, by name or, ending in "_",
+// by prefix. The rest take effect when Incus restarts.
+var reloadableOptions = []string{
+	"client_broadcasts",
+	"log_level",
+	"connection_timeout",
+	"longpoll_killswitch",
+	"command_error_queue",
+	"ack_callback",
+	"ack_callback_queue",
+	"ack_callback_url",
+	"drain_",
+	"health_",
+	"ios_push_sound",
+	"apns_",
+	"gcm_",
+	"fcm_",
+	"android_error_queue",
+	"webpush_",
+	"rate_limit_",
+}
+
+// Push notification options, for which new clients are made on reload.
+var pushOptions = []string{"apns_", "gcm_", "fcm_", "webpush_"}
+
+// RuntimeOptions are the options read while running that Reload may change.
+// They're read from the Server, since viper can't be changed while requests
+// read it.
+type RuntimeOptions struct {
+	ClientBroadcasts   bool
+	LongpollKillswitch string // Redis key
+	CommandErrorQueue  string
+	DrainTimeout       time.Duration
+
+	AckCallback      string // "redis", "webhook", or "" for none
+	AckCallbackQueue string
+	AckCallbackURL   string
+
+	IOSPushSound      string
+	AndroidErrorQueue string
+
+	Health HealthThresholds
+	Push   PushOptions
+}
+
+// PushOptions are the push notification options read while running. Reload
+// applies them along with the clients made from them, or not at all.
+type PushOptions struct {
+	APNSEnabled       bool
+	APNSProvider      string
+	APNSCerts         map[string]string // by build
+	GCMEnabled        bool
+	WebPushEnabled    bool
+	WebPushErrorQueue string
+}
+
+// NewRuntimeOptions reads the RuntimeOptions from v.
+func NewRuntimeOptions(v *viper.Viper) RuntimeOptions {
+	certs := make(map[string]string)
+	for _, build := range apnsBuilds {
+		certs[build] = v.GetString("apns_" + build + "_cert")
+	}
+
+	return RuntimeOptions{
+		ClientBroadcasts:   v.GetBool("client_broadcasts"),
+		LongpollKillswitch: v.GetString("longpoll_killswitch"),
+		CommandErrorQueue:  v.GetString("command_error_queue"),
+		DrainTimeout:       time.Duration(v.GetInt("drain_timeout")) * time.Second,
+
+		AckCallback:      v.GetString("ack_callback"),
+		AckCallbackQueue: v.GetString("ack_callback_queue"),
+		AckCallbackURL:   v.GetString("ack_callback_url"),
+
+		IOSPushSound:      v.GetString("ios_push_sound"),
+		AndroidErrorQueue: v.GetString("android_error_queue"),
+
+		Health: NewHealthThresholds(v),
+		Push: PushOptions{
+			APNSEnabled:       v.GetBool("apns_enabled"),
+			APNSProvider:      v.GetString("apns_provider"),
+			APNSCerts:         certs,
+			GCMEnabled:        v.GetBool("gcm_enabled"),
+			WebPushEnabled:    v.GetBool("webpush_enabled"),
+			WebPushErrorQueue: v.GetString("webpush_error_queue"),
+		},
+	}
+}
+
+// ReloadResult reports what came of reloading the configuration.
+type ReloadResult struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+	Error           string   `json:"error,omitempty"`
+}
+
+func matchesOption(key string, options []string) bool {
+	for _, option := range options {
+		if key == option || (strings.HasSuffix(option, "_") && strings.HasPrefix(key, option)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (this *ReloadResult) addError(err error) {
+	if this.Error != "" {
+		this.Error += "; "
+	}
+	this.Error += err.Error()
+}
+
+// revert puts back the applied options matching options to their previous
+// values in running.
+func (this *ReloadResult) revert(options []string, previous, running map[string]interface{}) {
+	applied := this.Applied[:0]
+	for _, key := range this.Applied {
+		if matchesOption(key, options) {
+			running[key] = previous[key]
+		} else {
+			applied = append(applied, key)
+		}
+	}
+
+	this.Applied = applied
+}
+
+// readConfig reads the config file in use afresh, with defaults.
+func readConfig() (v *viper.Viper, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	v = viper.New()
+	v.SetConfigFile(viper.ConfigFileUsed())
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	configDefaults(v)
+
+	return v, nil
+}
+
+// runningOption is the value of the option key in use: as last applied by
+// Reload, or as read on startup.
+func (this *Server) runningOption(key string) interface{} {
+	if value, ok := this.reloaded[key]; ok {
+		return value
+	}
+
+	return viper.Get(key)
+}
+
+// changedOptions lists the options whose value in v differs from the one
+// in use.
+func (this *Server) changedOptions(v *viper.Viper) []string {
+	keys := make(map[string]bool)
+	for _, key := range v.AllKeys() {
+		keys[key] = true
+	}
+	for _, key := range viper.AllKeys() {
+		keys[key] = true
+	}
+
+	var changed []string
+	for key := range keys {
+		if !reflect.DeepEqual(v.Get(key), this.runningOption(key)) {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+
+	return changed
+}
+
+// Reload re-reads the config file, applying the changes that can be made
+// while running: client broadcasts, the log level, timeouts, rate limits,
+// health check thresholds and push notification settings. Changes to
+// anything else are reported as needing a restart, and keep their running
+// value until then. Changes that don't work, such as push notification
+// settings that fail to load, are reported and the old values kept.
+func (this *Server) Reload() *ReloadResult {
+	this.reloadLock.Lock()
+	defer this.reloadLock.Unlock()
+
+	result := &ReloadResult{Applied: []string{}, RestartRequired: []string{}}
+
+	v, err := readConfig()
+	if err != nil {
+		result.Error = err.Error()
+		this.Log.Error("Error reloading config", "error", err)
+		return result
+	}
+
+	if this.reloaded == nil {
+		this.reloaded = make(map[string]interface{})
+	}
+
+	previous := make(map[string]interface{})
+	pushChanged := false
+
+	for _, key := range this.changedOptions(v) {
+		if !matchesOption(key, reloadableOptions) {
+			result.RestartRequired = append(result.RestartRequired, key)
+			continue
+		}
+
+		previous[key] = this.runningOption(key)
+		this.reloaded[key] = v.Get(key)
+		result.Applied = append(result.Applied, key)
+
+		if matchesOption(key, pushOptions) {
+			pushChanged = true
+		}
+	}
+
+	options := NewRuntimeOptions(v)
+
+	if pushChanged {
+		if err := this.reloadPush(v); err != nil {
+			result.addError(errors.New("Push notification settings not applied: " + err.Error()))
+			result.revert(pushOptions, previous, this.reloaded)
+
+			options.Push = this.runtimeOptions().Push
+		}
+	}
+
+	if _, ok := previous["log_level"]; ok {
+		if level, err := ParseLevel(v.GetString("log_level")); err != nil {
+			result.addError(err)
+			result.revert([]string{"log_level"}, previous, this.reloaded)
+		} else {
+			this.Log.SetLevel(level)
+		}
+	}
+
+	limits, err := NewRateLimits(v)
+	if err != nil {
+		result.addError(err)
+		result.revert([]string{"rate_limit_"}, previous, this.reloaded)
+
+		limits = this.rateLimits()
+	}
+
+	this.settings.Lock()
+	this.options = options
+	this.limits = limits
+	if timeout := time.Duration(v.GetInt("connection_timeout")); timeout > 0 {
+		this.timeout = timeout
+	}
+	this.drainReconnectMin = time.Duration(v.GetInt("drain_reconnect_min")) * time.Millisecond
+	this.drainReconnectMax = time.Duration(v.GetInt("drain_reconnect_max")) * time.Millisecond
+	this.settings.Unlock()
+
+	this.Log.Info("Reloaded config", "applied", strings.Join(result.Applied, ","), "restart_required", strings.Join(result.RestartRequired, ","))
+	if result.Error != "" {
+		this.Log.Error("Error reloading config", "error", result.Error)
+	}
+
+	return result
+}
+
+// reloadPush makes new push notification clients from the settings in v.
+func (this *Server) reloadPush(v *viper.Viper) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	apnsProvider, gcmProvider, webPush := newPushProviders(v)
+
+	this.settings.Lock()
+	defer this.settings.Unlock()
+
+	this.apnsProvider = apnsProvider
+	this.gcmProvider = gcmProvider
+	this.webPush = webPush
+
+	return nil
+}
+
+func (this *Server) runtimeOptions() RuntimeOptions {
+	this.settings.RLock()
+	defer this.settings.RUnlock()
+
+	return this.options
+}
+
+// DrainTimeout is how long Drain should be given before exiting.
+func (this *Server) DrainTimeout() time.Duration {
+	return this.runtimeOptions().DrainTimeout
+}
+
+func (this *Server) healthThresholds() HealthThresholds {
+	return this.runtimeOptions().Health
+}
+
+// adminReload serves POST /reload.
+func (this *Server) adminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, 405, "Method not allowed")
+		return
+	}
+
+	result := this.Reload()
+	if result.Error != "" {
+		writeJSON(w, 500, result)
+		return
+	}
+
+	writeJSON(w, 200, result)
+}
@@ -0,0 +1,183 @@
+package incus
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// useTestConfig points viper at a copy of config.yml, returning its path and
+// contents, and a func putting back the config file in use.
+func useTestConfig(t *testing.T) (string, []byte, func()) {
+	original, err := ioutil.ReadFile("config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "incus-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(file, original, 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	configFile := viper.ConfigFileUsed()
+	viper.SetConfigFile(file)
+	if err := viper.ReadInConfig(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return file, original, func() {
+		viper.SetConfigFile(configFile)
+		viper.ReadInConfig()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestReload(t *testing.T) {
+	file, original, restore := useTestConfig(t)
+	defer restore()
+
+	logger := NewLogger(ioutil.Discard, "logfmt", LevelDebug, 0, 0)
+	server := &Server{Store: newTestHistoryStore(0), Stats: &DiscardStats{}, Log: logger, timeout: 60000}
+
+	changed := strings.Replace(string(original), "client_broadcasts: true", "client_broadcasts: false", 1)
+	changed = strings.Replace(changed, `log_level: "debug"`, `log_level: "error"`, 1)
+	changed = strings.Replace(changed, `listening_port: "4000"`, `listening_port: "4001"`, 1)
+	if err := ioutil.WriteFile(file, []byte(changed), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result := server.Reload()
+	if result.Error != "" {
+		t.Fatalf("Expected the config to reload, got %s", result.Error)
+	}
+
+	if !contains(result.Applied, "client_broadcasts") || server.runtimeOptions().ClientBroadcasts {
+		t.Errorf("Expected client_broadcasts to be turned off, got %+v", result)
+	}
+
+	if !viper.GetBool("client_broadcasts") {
+		t.Error("Expected reloading to leave viper unchanged")
+	}
+
+	if !contains(result.Applied, "log_level") || logger.Level() != LevelError {
+		t.Errorf("Expected the log level to be raised to error, got %+v and %s", result, logger.Level())
+	}
+
+	if !contains(result.RestartRequired, "listening_port") || viper.GetString("listening_port") != "4000" {
+		t.Errorf("Expected listening_port to need a restart and stay 4000, got %+v and %s", result, viper.GetString("listening_port"))
+	}
+
+	result = server.Reload()
+	if result.Error != "" || len(result.Applied) != 0 || !contains(result.RestartRequired, "listening_port") {
+		t.Errorf("Expected reloading the same config to apply nothing more, got %+v", result)
+	}
+
+	changed = strings.Replace(changed, "webpush_enabled: false", "webpush_enabled: true", 1)
+	if err := ioutil.WriteFile(file, []byte(changed), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result = server.Reload()
+	if result.Error == "" || contains(result.Applied, "webpush_enabled") || server.runtimeOptions().Push.WebPushEnabled {
+		t.Errorf("Expected a bad VAPID key to leave web push off, got %+v", result)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("client_broadcasts: [\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result = server.Reload()
+	if result.Error == "" || len(result.Applied) != 0 || server.runtimeOptions().ClientBroadcasts {
+		t.Errorf("Expected an unreadable config to change nothing, got %+v", result)
+	}
+}
+
+// Run with -race: reloading must not race with the requests reading the
+// options it changes.
+func TestReloadWhileHandlingCommands(t *testing.T) {
+	file, original, restore := useTestConfig(t)
+	defer restore()
+
+	configs := []string{
+		string(original),
+		strings.NewReplacer(
+			"client_broadcasts: true", "client_broadcasts: false",
+			`log_level: "debug"`, `log_level: "error"`,
+			"rate_limit_close_code: 1008", "rate_limit_close_code: 4000",
+			"health_max_connections: 0", "health_max_connections: 10",
+		).Replace(string(original)),
+	}
+
+	logger := NewLogger(ioutil.Discard, "logfmt", LevelDebug, 0, 0)
+	server := &Server{Store: newTestHistoryStore(0), Stats: &DiscardStats{}, Log: logger, timeout: 60000}
+	server.options = NewRuntimeOptions(viper.GetViper())
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		sock := newSocket(nil, httptest.NewRecorder(), server, fmt.Sprintf("reload-test-%d", i))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				cmd := &CommandMsg{
+					Command: map[string]string{"command": "message", "user": "reload-test"},
+					Message: map[string]interface{}{"event": "foo", "data": map[string]interface{}{"message_text": "bar"}},
+				}
+				cmd.FromSocket(sock)
+				cmd.push(server, "ios", true)
+
+				server.checkPush(server.healthThresholds())
+				server.reportAck(&pendingAck{UID: "reload-test", Message: &Message{ID: 1, Event: "foo"}}, AckDelivered)
+				server.connectionTimeout()
+				server.DrainTimeout()
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := ioutil.WriteFile(file, []byte(configs[i%2]), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if result := server.Reload(); result.Error != "" {
+			t.Fatalf("Expected the config to reload, got %s", result.Error)
+		}
+	}
+
+	close(done)
+	wg.Wait()
+}
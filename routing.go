@@ -0,0 +1,186 @@
+package incus
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/spf13/viper"
+)
+
+// Which nodes hold a user's or page's sockets, as hashes of Server.ID to the
+// number of sockets on that node.
+const UserNodesKeyPrefix = "UserNodes"
+const PageNodesKeyPrefix = "PageNodes"
+
+// KEYS[1] nodes hash
+// ARGV[1] node ID
+var removeNodeScript = redis.NewScript(1, `
+local sockets = redis.call('HINCRBY', KEYS[1], ARGV[1], -1)
+if sockets <= 0 then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return sockets
+`)
+
+// checkTargetedRouting refuses targeted routing in Redis Cluster, where
+// PUBLISH only counts the receivers on one shard, so that nodes listening
+// through another would look gone.
+func checkTargetedRouting(mode string, targeted bool) error {
+	if targeted && mode == RedisModeCluster {
+		return errors.New("redis_targeted_routing can't be used with redis_mode cluster")
+	}
+
+	return nil
+}
+
+// nodeChannel is the pub/sub channel only the node with ID listens on.
+func nodeChannel(ID string) string {
+	return viper.GetString("redis_message_channel") + ":node:" + ID
+}
+
+func userNodesKey(UID string) string {
+	return UserNodesKeyPrefix + ":" + UID
+}
+
+func pageNodesKey(page string) string {
+	return PageNodesKeyPrefix + ":" + page
+}
+
+// AddNode records one more socket on node under key.
+func (this *RedisStore) AddNode(key, node string) error {
+	client, err := this.GetConn()
+	if err != nil {
+		return err
+	}
+	defer this.CloseConn(client)
+
+	_, err = client.Do("HINCRBY", key, node, 1)
+
+	return err
+}
+
+// RemoveNode records one less socket on node under key, forgetting the node
+// when it has none left.
+func (this *RedisStore) RemoveNode(key, node string) error {
+	client, err := this.GetConn()
+	if err != nil {
+		return err
+	}
+	defer this.CloseConn(client)
+
+	_, err = removeNodeScript.Do(client, key, node)
+
+	return err
+}
+
+// Nodes returns the IDs of the nodes with sockets under key.
+func (this *RedisStore) Nodes(key string) ([]string, error) {
+	client, err := this.GetConn()
+	if err != nil {
+		return nil, err
+	}
+	defer this.CloseConn(client)
+
+	return redis.Strings(client.Do("HKEYS", key))
+}
+
+// PublishToNode publishes message on node's channel, returning whether the
+// node received it. A node that isn't listening has gone away without
+// removing its sockets, so it is forgotten under key.
+func (this *RedisStore) PublishToNode(key, node, message string) (bool, error) {
+	client, err := this.GetConn()
+	if err != nil {
+		return false, err
+	}
+	defer this.CloseConn(client)
+
+	receivers, err := redis.Int(client.Do("PUBLISH", nodeChannel(node), message))
+	if err != nil {
+		return false, err
+	}
+
+	if receivers == 0 {
+		client.Do("HDEL", key, node)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// stampPublishID gives cmd a publish ID unique across the cluster, unless
+// the application that sent it already did.
+func (this *Server) stampPublishID(cmd *CommandMsg) {
+	if cmd.PublishID == "" {
+		cmd.PublishID = this.ID + ":" + strconv.FormatInt(atomic.AddInt64(&this.publishes, 1), 10)
+	}
+}
+
+// routingKey is the nodes hash a message command is routed by, or "" for
+// messages every node has to see.
+func (this *CommandMsg) routingKey() string {
+	if user, ok := this.Command["user"]; ok {
+		return userNodesKey(user)
+	}
+
+	if _, ok := this.Command["topic"]; ok {
+		return ""
+	}
+
+	if page, ok := this.Command["page"]; ok {
+		return pageNodesKey(page)
+	}
+
+	return ""
+}
+
+// routeMessage delivers a message command received by this node alone to
+// the nodes holding its recipients. User and page messages go to those
+// nodes' own channels; topic and broadcast messages to every node.
+func (this *Server) routeMessage(cmd *CommandMsg) {
+	this.stampPublishID(cmd)
+	if !cmd.record(this) {
+		return
+	}
+
+	msg_str, _ := json.Marshal(cmd)
+
+	key := cmd.routingKey()
+	if key == "" {
+		this.Store.redis.Publish(viper.GetString("redis_message_channel"), string(msg_str))
+		return
+	}
+
+	nodes, err := this.Store.redis.Nodes(key)
+	if err != nil {
+		this.Log.Error("Error routing message, sending to every node", "key", key, "error", err)
+		this.Store.redis.Publish(viper.GetString("redis_message_channel"), string(msg_str))
+		return
+	}
+
+	local := false
+	delivered := 0
+	for _, node := range nodes {
+		if node == this.ID {
+			local = true
+			continue
+		}
+
+		ok, err := this.Store.redis.PublishToNode(key, node, string(msg_str))
+		if err != nil {
+			this.Log.Error("Error routing message to node", "key", key, "node", node, "error", err)
+		} else if ok {
+			delivered++
+		}
+	}
+
+	this.Stats.LogRoutedMessage(delivered)
+
+	this.Log.Sampled().Debug("Routed message", "key", key, "nodes", delivered)
+
+	if local {
+		cmd.FromRedis(this)
+	}
+}
@@ -2,17 +2,18 @@ package incus
 
 import (
 	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
-	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
 	"sync/atomic"
-	"syscall"
 	"time"
-	"runtime"
 
 	"github.com/alexjlockwood/gcm"
 	apns "github.com/anachronistic/apns"
@@ -26,15 +27,20 @@ const (
 	abnormalCloseControlWriteDeadline = 1 * time.Second
 	websocketReadBufferSize           = 1024
 	websocketWriteBufferSize          = 1024
+	sseKeepaliveInterval              = 15 * time.Second
+	sseRetryMilliseconds              = 3000
 
 	// RFC 6455 Section 7
 	closeCodeNormal          = 1000
 	closeCodeGoingAway       = 1001
 	closeCodeUnexpectedError = 1011
+	closeCodeTryAgainLater   = 1013
 )
 
 var (
 	disableLongpoll atomic.Value
+
+	apnsBuilds = []string{"store", "enterprise", "beta", "development"}
 )
 
 type GCMClient interface {
@@ -45,16 +51,47 @@ type Server struct {
 	ID    string
 	Store *Storage
 	Stats RuntimeStats
+	Auth  Authenticator
+	Log   *Logger
+
+	origins *OriginChecker
+
+	publishes int64 // commands published to the bus, counted atomically for publish IDs
+
+	// Reload changes the fields guarded by settings while running.
+	reloadLock sync.Mutex
+	reloaded   map[string]interface{} // options applied by Reload, guarded by reloadLock
+	settings   sync.RWMutex
+	timeout    time.Duration  // guarded by settings
+	limits     RateLimits     // guarded by settings
+	options    RuntimeOptions // guarded by settings
+
+	sendQueueSize         int
+	slowConsumerPolicy    string
+	slowConsumerCloseCode int
 
-	timeout      time.Duration
-	apnsProvider func(string) apns.APNSClient
-	gcmProvider  func() GCMClient
+	apnsProvider func(string) apns.APNSClient // guarded by settings
+	gcmProvider  func() GCMClient             // guarded by settings
+	webPush      WebPushClient                // guarded by settings
+
+	// Graceful shutdown; see Drain.
+	draining          int32         // set atomically once Drain begins
+	closing           chan struct{} // closed once sockets should be closed
+	inflight          int64         // commands being handled, updated atomically
+	drainReconnectMin time.Duration // guarded by settings
+	drainReconnectMax time.Duration // guarded by settings
+
+	queueLock    sync.Mutex
+	stopQueue    func()
+	queueBacklog func() int
+
+	pushes pushHealth // what came of recent push notifications, for /readyz
 }
 
-func NewServer(store *Storage, stats RuntimeStats) *Server {
+func NewServer(store *Storage, stats RuntimeStats, logger *Logger) *Server {
 	hash := md5.New()
 	io.WriteString(hash, time.Now().String())
-	id := string(hash.Sum(nil))
+	id := hex.EncodeToString(hash.Sum(nil))
 
 	timeout := time.Duration(viper.GetInt("connection_timeout"))
 
@@ -62,21 +99,104 @@ func NewServer(store *Storage, stats RuntimeStats) *Server {
 		panic(fmt.Errorf("connection_timeout <= 0: %+v", timeout))
 	}
 
-	apnsProvider := func(build string) apns.APNSClient {
-		return apns.NewClient(viper.GetString("apns_"+build+"_url"), viper.GetString("apns_"+build+"_cert"), viper.GetString("apns_"+build+"_private_key"))
+	apnsProvider, gcmProvider, webPush := newPushProviders(viper.GetViper())
+
+	auth, err := NewAuthenticator()
+	if err != nil {
+		panic(err)
 	}
 
-	gcmProvider := func() GCMClient {
-		return &gcm.Sender{ApiKey: viper.GetString("gcm_api_key")}
+	if err := checkSlowConsumerPolicy(viper.GetString("slow_consumer_policy")); err != nil {
+		panic(err)
+	}
+
+	limits, err := NewRateLimits(viper.GetViper())
+	if err != nil {
+		panic(err)
 	}
 
 	return &Server{
-		ID:           id,
-		Store:        store,
-		timeout:      timeout,
-		Stats:        stats,
+		ID:      id,
+		Store:   store,
+		timeout: timeout,
+		limits:  limits,
+		options: NewRuntimeOptions(viper.GetViper()),
+		Stats:   stats,
+		Auth:    auth,
+		Log:     logger,
+		origins: NewOriginChecker(viper.GetStringSlice("allowed_origins")),
+
+		sendQueueSize:         viper.GetInt("send_queue_size"),
+		slowConsumerPolicy:    viper.GetString("slow_consumer_policy"),
+		slowConsumerCloseCode: viper.GetInt("slow_consumer_close_code"),
+
 		apnsProvider: apnsProvider,
 		gcmProvider:  gcmProvider,
+		webPush:      webPush,
+
+		closing:           make(chan struct{}),
+		drainReconnectMin: time.Duration(viper.GetInt("drain_reconnect_min")) * time.Millisecond,
+		drainReconnectMax: time.Duration(viper.GetInt("drain_reconnect_max")) * time.Millisecond,
+	}
+}
+
+// newPushProviders makes the push notification clients for the settings in
+// v, panicking if they can't be made.
+func newPushProviders(v *viper.Viper) (func(string) apns.APNSClient, func() GCMClient, WebPushClient) {
+	apnsProvider := func(build string) apns.APNSClient {
+		return apns.NewClient(v.GetString("apns_"+build+"_url"), v.GetString("apns_"+build+"_cert"), v.GetString("apns_"+build+"_private_key"))
+	}
+
+	if v.GetBool("apns_enabled") && v.GetString("apns_provider") == "token" {
+		apnsProvider = newAPNSHTTP2Provider(v)
+	}
+
+	gcmProvider := func() GCMClient {
+		return &gcm.Sender{ApiKey: v.GetString("gcm_api_key")}
+	}
+
+	if v.GetBool("gcm_enabled") && v.GetString("gcm_provider") == "fcm" {
+		fcmClient, err := NewFCMClient(v.GetString("fcm_service_account_file"), v.GetString("fcm_endpoint"), nil)
+		if err != nil {
+			panic(err)
+		}
+
+		gcmProvider = func() GCMClient { return fcmClient }
+	}
+
+	var webPush WebPushClient
+	if v.GetBool("webpush_enabled") {
+		sender, err := NewWebPushSender(v.GetString("webpush_vapid_private_key"), v.GetString("webpush_subject"), nil)
+		if err != nil {
+			panic(err)
+		}
+
+		webPush = sender
+	}
+
+	return apnsProvider, gcmProvider, webPush
+}
+
+// newAPNSHTTP2Provider builds one long-lived HTTP/2 client per build, so that
+// connections to APNs are reused between notifications.
+func newAPNSHTTP2Provider(v *viper.Viper) func(string) apns.APNSClient {
+	signer, err := NewAPNSTokenSigner(v.GetString("apns_auth_key_file"), v.GetString("apns_key_id"), v.GetString("apns_team_id"))
+	if err != nil {
+		panic(err)
+	}
+
+	clients := make(map[string]apns.APNSClient)
+	for _, build := range apnsBuilds {
+		clients[build] = NewAPNSHTTP2Client(v.GetString("apns_"+build+"_host"), v.GetString("apns_"+build+"_topic"), signer, nil)
+	}
+
+	return func(build string) apns.APNSClient {
+		client, ok := clients[build]
+		if !ok {
+			return clients["store"]
+		}
+
+		return client
 	}
 }
 
@@ -84,25 +204,29 @@ func (this *Server) ListenFromSockets() {
 	Connect := func(w http.ResponseWriter, r *http.Request) {
 		writtenCloseMessage := false
 
-		exitSignals := make(chan os.Signal)
-		signal.Notify(exitSignals, os.Interrupt, syscall.SIGTERM)
-		defer signal.Stop(exitSignals)
-
 		if r.Method != "GET" {
 			http.Error(w, "Method not allowed", 405)
 			return
 		}
-		//if r.Header.Get("Origin") != "http://"+r.Host {
-		//        http.Error(w, "Origin not allowed", 403)
-		//        return
-		// }
+
+		if !this.checkOrigin(w, r, "websocket", false) {
+			return
+		}
+
+		if this.refuseWhileDraining(w) {
+			return
+		}
+
+		if !this.allowConnection(w, r) {
+			return
+		}
 
 		ws, err := websocket.Upgrade(w, r, nil, websocketReadBufferSize, websocketWriteBufferSize)
 		if _, ok := err.(websocket.HandshakeError); ok {
 			http.Error(w, "Not a websocket handshake", 400)
 			return
 		} else if err != nil {
-			log.Println(err)
+			this.Log.Warn("Websocket upgrade failed", "remote_addr", r.RemoteAddr, "error", err)
 			return
 		}
 
@@ -114,32 +238,38 @@ func (this *Server) ListenFromSockets() {
 
 			ws.Close()
 			this.Stats.LogWebsocketDisconnection()
-			if DEBUG {
-				log.Println("Socket Closed")
-			}
+			this.Log.Debug("Socket closed", "transport", "websocket", "remote_addr", r.RemoteAddr)
 		}()
 
 		sock := newSocket(ws, nil, this, "")
+		sock.RemoteAddr = r.RemoteAddr
 
 		this.Stats.LogWebsocketConnection()
-		if DEBUG {
-			log.Printf("Socket connected via %s\n", ws.RemoteAddr())
-		}
-		if err := sock.Authenticate(""); err != nil {
-			if DEBUG {
-				log.Printf("Error: %s\n", err.Error())
-			}
+		sock.logger().Debug("Socket connected")
+		if err := sock.Authenticate("", ""); err == errRateLimited {
+			writtenCloseMessage = closeWebsocket(this.rateLimitCloseCode(), ws)
+			return
+		} else if err != nil {
+			sock.logger().Debug("Authentication failed", "error", err)
 			return
 		}
 
+		sock.loadHistory()
+		sock.loadPendingAcks()
+
 		go sock.listenForMessages()
 		go sock.listenForWrites()
 
 		select {
 		case <-sock.done:
-			writtenCloseMessage = closeWebsocket(closeCodeNormal, ws)
+			closeCode := closeCodeNormal
+			if sock.closeCode != 0 {
+				closeCode = sock.closeCode
+			}
+
+			writtenCloseMessage = closeWebsocket(closeCode, ws)
 			return
-		case <-exitSignals:
+		case <-this.closing:
 			writtenCloseMessage = closeWebsocket(closeCodeGoingAway, ws)
 			return
 		}
@@ -156,19 +286,27 @@ func closeWebsocket(closeCode int, ws *websocket.Conn) bool {
 
 func (this *Server) ListenFromLongpoll() {
 	LpConnect := func(w http.ResponseWriter, r *http.Request) {
-		exitSignals := make(chan os.Signal)
-		signal.Notify(exitSignals, os.Interrupt, syscall.SIGTERM)
-		defer signal.Stop(exitSignals)
+		if !this.checkOrigin(w, r, "longpoll", true) {
+			return
+		}
+
+		if this.refuseWhileDraining(w) {
+			return
+		}
+
+		if !this.allowConnection(w, r) {
+			return
+		}
+
+		// Logged up front so every disconnect below is paired with a connect.
+		this.Stats.LogLongpollConnect()
 
 		defer func() {
 			this.Stats.LogLongpollDisconnect()
 			r.Body.Close()
-			if DEBUG {
-				log.Println("Socket Closed")
-			}
+			this.Log.Debug("Socket closed", "transport", "longpoll", "remote_addr", r.RemoteAddr)
 		}()
 
-		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Cache-Control", "private, no-store, no-cache, must-revalidate, post-check=0, pre-check=0")
 		w.Header().Set("Connection", "keep-alive")
@@ -182,17 +320,15 @@ func (this *Server) ListenFromLongpoll() {
 		}
 
 		sock := newSocket(nil, w, this, "")
+		sock.RemoteAddr = r.RemoteAddr
 
-		if DEBUG {
-			log.Printf("Long poll connected via \n")
-		}
+		sock.logger().Debug("Socket connected")
 
-		this.Stats.LogLongpollConnect()
-
-		if err := sock.Authenticate(r.FormValue("user")); err != nil {
-			if DEBUG {
-				log.Printf("Error: %s\n", err.Error())
-			}
+		if err := sock.Authenticate(r.FormValue("user"), r.FormValue("token")); err == errRateLimited {
+			refuseRateLimited(w, this.rateLimits().ConnectionsPerUser)
+			return
+		} else if err != nil {
+			sock.logger().Debug("Authentication failed", "error", err)
 			return
 		}
 
@@ -206,24 +342,43 @@ func (this *Server) ListenFromLongpoll() {
 			this.Store.SetPage(sock)
 		}
 
+		sock.subscribeAll(r.FormValue("topics"))
+
+		var cmd *CommandMsg
 		command := r.FormValue("command")
 		if command != "" {
 			this.Stats.LogReadMessage()
 
-			var cmd = new(CommandMsg)
-			json.Unmarshal([]byte(command), cmd)
+			cmd = new(CommandMsg)
+			if err := json.Unmarshal([]byte(command), cmd); err != nil {
+				this.Stats.LogInvalidJSON()
+				sock.rejectCommand(invalidJSON(err))
+				cmd = nil
+			} else if strings.ToLower(cmd.Command["command"]) == "ack" {
+				// Handled before replying, as it sends nothing back.
+				cmd.FromSocket(sock)
+				cmd = nil
+			}
+		}
+
+		// Pending acks aren't replayed: each poll returns a single message, so
+		// an unacked one would be returned again and again, hiding anything
+		// newer. Longpoll clients catch up with last_id instead.
+		sock.lastID = parseLastID(r.FormValue("last_id"))
+		sock.loadHistory()
 
+		if cmd != nil {
 			go cmd.FromSocket(sock)
 		}
 
 		go sock.listenForWrites()
 
 		select {
-		case <-exitSignals:
+		case <-this.closing:
 			sock.Close()
 			w.WriteHeader(503)
 			return
-		case <-time.After(this.timeout * time.Second):
+		case <-time.After(this.connectionTimeout()):
 			sock.Close()
 			w.WriteHeader(204)
 			return
@@ -237,55 +392,257 @@ func (this *Server) ListenFromLongpoll() {
 	http.HandleFunc("/lp", LpConnect)
 }
 
+func (this *Server) ListenFromSSE() {
+	SSEConnect := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", 405)
+			return
+		}
+
+		if _, ok := w.(http.Flusher); !ok {
+			http.Error(w, "Streaming unsupported", 500)
+			return
+		}
+
+		if !this.checkOrigin(w, r, "sse", true) {
+			return
+		}
+
+		if this.refuseWhileDraining(w) {
+			return
+		}
+
+		if !this.allowConnection(w, r) {
+			return
+		}
+
+		sock := newSocket(nil, nil, this, "")
+		sock.sse = w
+		sock.RemoteAddr = r.RemoteAddr
+
+		if err := sock.Authenticate(r.FormValue("user"), r.FormValue("token")); err == errRateLimited {
+			refuseRateLimited(w, this.rateLimits().ConnectionsPerUser)
+			return
+		} else if err != nil {
+			sock.logger().Debug("Authentication failed", "error", err)
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+
+		this.Stats.LogSSEConnect()
+		sock.logger().Debug("Socket connected")
+
+		defer func() {
+			sock.Close()
+			this.Stats.LogSSEDisconnect()
+			sock.logger().Debug("Socket closed")
+		}()
+
+		page := r.FormValue("page")
+		if page != "" {
+			sock.Page = page
+			this.Store.SetPage(sock)
+		}
+
+		sock.subscribeAll(r.FormValue("topics"))
+
+		// EventSource sends the ID of the last event it saw when reconnecting.
+		lastID := r.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = r.FormValue("last_id")
+		}
+		sock.lastID = parseLastID(lastID)
+		sock.loadHistory()
+		sock.loadPendingAcks()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(200)
+
+		if err := sock.writeSSE(fmt.Sprintf("retry: %d\n\n", sseRetryMilliseconds)); err != nil {
+			return
+		}
+
+		go func() {
+			select {
+			case <-this.closing:
+			case <-r.Context().Done():
+			case <-sock.done:
+			}
+			sock.Close()
+		}()
+
+		// Writes stay on the handler goroutine, so nothing touches w after
+		// the handler returns.
+		sock.listenForWrites()
+	}
+
+	http.HandleFunc("/sse", SSEConnect)
+}
+
+// ListenFromRedis handles the commands arriving on the message bus, be it
+// Redis or NATS.
 func (this *Server) ListenFromRedis() {
-	if !viper.GetBool("redis_enabled") {
+	if this.Store.bus == nil {
 		return
 	}
 
 	subReciever := make(chan []byte, 10000)
+	nodeReciever := make(chan []byte, 10000)
 	queueReciever := make(chan []byte, 10000)
 
-	_, err := this.Store.redis.Subscribe(subReciever, viper.GetString("redis_message_channel"))
+	err := this.Store.bus.Subscribe(subReciever, this.Store.messageChannel)
 	if err != nil {
-		log.Fatal("Couldn't subscribe to redis channel")
+		this.Log.Fatal("Couldn't subscribe to message channel", "channel", this.Store.messageChannel, "error", err)
 	}
 
-	err = this.Store.redis.Poll(queueReciever, viper.GetString("redis_message_queue"))
-	if err != nil {
-		log.Fatal("Couldn't start polling of redis queue")
+	if this.Store.targetedRouting {
+		err = this.Store.redis.Subscribe(nodeReciever, nodeChannel(this.ID))
+		if err != nil {
+			this.Log.Fatal("Couldn't subscribe to this node's redis channel", "channel", nodeChannel(this.ID), "error", err)
+		}
+	}
+
+	backlog := func() int {
+		return len(subReciever) + len(nodeReciever) + len(queueReciever)
 	}
 
-	if DEBUG {
-		log.Println("LISTENING FOR REDIS MESSAGE")
+	if this.Store.bus == this.Store.redis && viper.GetString("redis_queue_type") == "stream" {
+		consumer := this.newStreamConsumer()
+		this.setQueue(consumer.Stop, backlog)
+		go consumer.Run()
+	} else {
+		this.setQueue(this.Store.bus.StopPolling, backlog)
+		err = this.Store.bus.Poll(queueReciever, this.Store.messageQueue)
+		if err != nil {
+			this.Log.Fatal("Couldn't start polling of message queue", "queue", this.Store.messageQueue, "error", err)
+		}
 	}
 
-	var subMessage []byte
-	var pollMessage []byte
+	this.Log.Info("Listening for commands", "channel", this.Store.messageChannel, "queue", this.Store.messageQueue)
+
+	var message []byte
 	for {
 		var cmd = new(CommandMsg)
+		queued := false
 
 		select {
-		case subMessage = <-subReciever:
-			err = json.Unmarshal(subMessage, cmd)
-		case pollMessage = <-queueReciever:
-			err = json.Unmarshal(pollMessage, cmd)
+		case message = <-subReciever:
+			err = json.Unmarshal(message, cmd)
+			cmd.broadcast = !cmd.Recorded
+		case message = <-nodeReciever:
+			err = json.Unmarshal(message, cmd)
+		case message = <-queueReciever:
+			err = json.Unmarshal(message, cmd)
+			queued = true
 		}
 
 		if err != nil {
-			log.Printf("Error decoding JSON: %s", err.Error())
-			this.Stats.LogInvalidJSON()
+			// Every node receives what's published to a channel, so only
+			// the node taking it off the queue reports it.
+			this.Log.Warn("Error decoding JSON", "error", err)
+			if queued {
+				this.rejectJSON(err, message)
+			}
+		} else if queued {
+			this.commandStarted()
+			go func() {
+				defer this.commandDone()
+				this.fromQueue(cmd)
+			}()
 		} else {
-			go cmd.FromRedis(this)
+			this.commandStarted()
+			go func() {
+				defer this.commandDone()
+				cmd.FromRedis(this)
+			}()
 		}
 	}
 }
 
+// fromQueue handles a command taken off the message queue, reporting what
+// came of it. Every node sees what's published to the shared channel, but
+// only one takes each queued command, so queued messages are routed on to the
+// other nodes.
+func (this *Server) fromQueue(cmd *CommandMsg) *CommandResult {
+	if this.Store.targetedRouting && strings.ToLower(cmd.Command["command"]) == "message" {
+		if _, err := cmd.parseAppCommand(); err != nil {
+			this.rejectCommand(err, cmd)
+			return newRejectedResult(err)
+		}
+
+		this.routeMessage(cmd)
+		return &CommandResult{Command: "message", Status: CommandOK, Forwarded: true}
+	}
+
+	return cmd.Handle(this, "redis")
+}
+
+func (this *Server) newStreamConsumer() *StreamConsumer {
+	consumer := viper.GetString("redis_stream_consumer")
+	if consumer == "" {
+		consumer, _ = os.Hostname()
+	}
+
+	return NewStreamConsumer(
+		this.Store.redis,
+		this.Stats,
+		viper.GetString("redis_message_queue"),
+		viper.GetString("redis_stream_group"),
+		consumer,
+		viper.GetString("redis_stream_dead_letter"),
+		time.Duration(viper.GetInt("redis_stream_claim_idle"))*time.Second,
+		viper.GetInt64("redis_stream_max_deliveries"),
+		this.handleStreamCommand,
+	)
+}
+
+// handleStreamCommand handles a command from the stream, reporting whether
+// it can be acknowledged. Rejected commands will never succeed, so are
+// dead-lettered straight away, while failed ones are retried.
+func (this *Server) handleStreamCommand(data []byte) (err error) {
+	this.commandStarted()
+	defer this.commandDone()
+
+	cmd := new(CommandMsg)
+	if err := json.Unmarshal(data, cmd); err != nil {
+		this.Log.Warn("Error decoding JSON", "error", err)
+		this.rejectJSON(err, data)
+		return errInvalidCommand
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	switch result := this.fromQueue(cmd); result.Status {
+	case CommandRejected:
+		return errInvalidCommand
+	case CommandFailed:
+		return errors.New(result.Error)
+	}
+
+	return nil
+}
+
 func (this *Server) ListenForHTTPPings() {
 	pingHandler := func(w http.ResponseWriter, r *http.Request) {
+		if this.isDraining() {
+			w.WriteHeader(503)
+			fmt.Fprint(w, "DRAINING")
+			return
+		}
+
 		fmt.Fprint(w, "OK")
 	}
 
 	http.HandleFunc("/ping", pingHandler)
+	http.Handle("/healthz", this.LivenessHandler(false))
+	http.Handle("/readyz", this.ReadinessHandler(this.healthThresholds, false))
 }
 
 func (this *Server) SendHeartbeatsPeriodically(period time.Duration) {
@@ -293,43 +650,102 @@ func (this *Server) SendHeartbeatsPeriodically(period time.Duration) {
 	for {
 		time.Sleep(period)
 
-		clients := this.Store.Clients()
-
-		for _, user := range clients {
-			for _, sock := range user {
-
-				if sock.isWebsocket() {
-					if !sock.isClosed() {
-						sock.ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(pongWait))
-					}
+		this.Store.EachSocket(func(sock *Socket) {
+			if sock.isWebsocket() {
+				if !sock.isClosed() {
+					sock.ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(pongWait))
 				}
-
 			}
-		}
+		})
 	}
 }
 
 func (this *Server) RecordStats(period time.Duration) {
 	for {
-		this.Stats.LogClientCount(this.Store.memory.clientCount)
+		clients, _ := this.Store.memory.Count()
+		this.Stats.LogClientCount(clients)
 		this.Stats.LogGoroutines(runtime.NumGoroutine())
+
+		longest := 0
+		this.Store.EachSocket(func(sock *Socket) {
+			if length := sock.QueueLength(); length > longest {
+				longest = length
+			}
+		})
+		this.Stats.LogSendQueueLength(longest)
+
+		if this.Store.StorageType == "redis" {
+			this.Store.redis.pool.Evict()
+			this.Stats.LogRedisPool(this.Store.redis.PoolStats())
+		}
+
 		time.Sleep(period)
 	}
 }
 
 func (this *Server) LogConnectedClientsPeriodically(period time.Duration) {
 	for {
-		log.Printf("There are %d connected clients\n", this.Store.memory.clientCount)
+		clients, _ := this.Store.memory.Count()
+		this.Log.Info("Connected clients", "count", clients)
+		time.Sleep(period)
+	}
+}
+
+func (this *Server) ExpireHistoryPeriodically(period, ttl time.Duration) {
+	for {
 		time.Sleep(period)
+		this.Store.ExpireHistory(time.Now().Add(-ttl))
+	}
+}
+
+// ExpireAcksPeriodically reports messages that weren't acknowledged within
+// ack_timeout as expired.
+func (this *Server) ExpireAcksPeriodically(period time.Duration) {
+	for {
+		time.Sleep(period)
+
+		acks, err := this.Store.ExpireAcks(time.Now())
+		if err != nil {
+			this.Log.Error("Error expiring pending acks", "error", err)
+			continue
+		}
+
+		for _, ack := range acks {
+			this.reportAck(ack, AckExpired)
+		}
 	}
 }
 
 func (this *Server) GetAPNSClient(build string) apns.APNSClient {
-	return this.apnsProvider(build)
+	this.settings.RLock()
+	apnsProvider := this.apnsProvider
+	this.settings.RUnlock()
+
+	return apnsProvider(build)
 }
 
 func (this *Server) GetGCMClient() GCMClient {
-	return this.gcmProvider()
+	this.settings.RLock()
+	gcmProvider := this.gcmProvider
+	this.settings.RUnlock()
+
+	return gcmProvider()
+}
+
+// GetWebPushClient returns nil unless webpush is enabled.
+func (this *Server) GetWebPushClient() WebPushClient {
+	this.settings.RLock()
+	defer this.settings.RUnlock()
+
+	return this.webPush
+}
+
+// connectionTimeout is how long a longpoll waits for messages.
+func (this *Server) connectionTimeout() time.Duration {
+	this.settings.RLock()
+	defer this.settings.RUnlock()
+
+	return this.timeout * time.Second
 }
 
 func (this *Server) MonitorLongpollKillswitch() {
@@ -338,7 +754,7 @@ func (this *Server) MonitorLongpollKillswitch() {
 	}
 
 	for {
-		longpollSwitchedOff, err := this.Store.redis.GetIsLongpollKillswitchActive()
+		longpollSwitchedOff, err := this.Store.redis.GetIsLongpollKillswitchActive(this.runtimeOptions().LongpollKillswitch)
 
 		if err == nil {
 			disableLongpoll.Store(longpollSwitchedOff)
@@ -4,15 +4,20 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// lastID of a socket whose client didn't ask for missed messages.
+const noLastID = -1
+
 var socketIds chan string
 
 func init() {
@@ -28,16 +33,24 @@ func init() {
 }
 
 func newSocket(ws *websocket.Conn, lp http.ResponseWriter, server *Server, UID string) *Socket {
+	queueSize := defaultSendQueueSize
+	if server != nil && server.sendQueueSize > 0 {
+		queueSize = server.sendQueueSize
+	}
+
 	return &Socket{
 		SID:    <-socketIds,
 		UID:    UID,
 		ws:     ws,
 		lp:     lp,
 		Server: server,
-		buff:   make(chan *Message, 1000),
+		buff:   make(chan *Message, queueSize),
 		done:   make(chan bool),
-		closed: false,
+		lastID: noLastID,
+		topics: make(map[string]bool),
 		lock:   sync.Mutex{},
+
+		Connected: time.Now(),
 	}
 }
 
@@ -46,13 +59,29 @@ type Socket struct {
 	UID  string // User ID, passed in via client
 	Page string // Current page, if set.
 
+	RemoteAddr string    // Address of the client, as seen by the server.
+	Connected  time.Time // When the socket was opened.
+
+	topics map[string]bool // Topics subscribed to, guarded by lock.
+
 	ws     *websocket.Conn
 	lp     http.ResponseWriter
+	sse    http.ResponseWriter
 	Server *Server
 
+	// ID of the last message the client saw before reconnecting, and the
+	// messages it missed since, which are written before anything in buff.
+	lastID int64
+	replay []*Message
+
 	buff   chan *Message
 	done   chan bool
-	closed bool
+	closed int32 // set atomically by Close, under lock, so send needn't take the lock
+
+	dropped   int64 // messages not queued because buff was full, updated atomically
+	closeCode int   // sent to websocket clients when done closes, if set
+
+	commands tokenBucket // commands sent, for CommandsPerSocket; used by listenForMessages
 
 	// The purpose of this mutex is to prevent writing to the closed channel buff.
 	lock sync.Mutex
@@ -66,23 +95,82 @@ func (this *Socket) isLongPoll() bool {
 	return (this.lp != nil)
 }
 
+func (this *Socket) isSSE() bool {
+	return (this.sse != nil)
+}
+
+// Transport names how the client is connected: websocket, longpoll or sse.
+func (this *Socket) Transport() string {
+	if this.isWebsocket() {
+		return "websocket"
+	}
+
+	if this.isSSE() {
+		return "sse"
+	}
+
+	return "longpoll"
+}
+
+// logger returns the server's Logger with this socket's fields.
+func (this *Socket) logger() *Logger {
+	var logger *Logger
+	if this.Server != nil {
+		logger = this.Server.Log
+	}
+
+	return logger.With("sid", this.SID, "uid", this.UID, "page", this.Page, "transport", this.Transport(), "remote_addr", this.RemoteAddr)
+}
+
+// debugEnabled is whether debug logs are written. Debug logs made for every
+// message or command check it first, since logger() allocates.
+func (this *Socket) debugEnabled() bool {
+	var logger *Logger
+	if this.Server != nil {
+		logger = this.Server.Log
+	}
+
+	return logger.Enabled(LevelDebug)
+}
+
+// Topics returns the topics the socket is subscribed to.
+func (this *Socket) Topics() []string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	topics := make([]string, 0, len(this.topics))
+	for topic := range this.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	return topics
+}
+
 func (this *Socket) isClosed() bool {
-	return this.closed
+	return atomic.LoadInt32(&this.closed) == 1
 }
 
 func (this *Socket) Close() error {
 	this.lock.Lock()
 	defer this.lock.Unlock()
 
-	if !this.closed {
-		this.closed = true
+	if !this.isClosed() {
+		atomic.StoreInt32(&this.closed, 1)
 
 		if this.Page != "" {
 			this.Server.Store.UnsetPage(this)
 			this.Page = ""
 		}
 
-		this.Server.Store.redis.MarkInactive(this.UID, this.SID)
+		for topic := range this.topics {
+			this.Server.Store.UnsubscribeTopic(this, topic)
+			delete(this.topics, topic)
+		}
+
+		if this.Server.Store.StorageType == "redis" {
+			this.Server.Store.redis.MarkInactive(this.UID, this.SID)
+		}
 
 		this.Server.Store.Remove(this)
 		close(this.done)
@@ -91,15 +179,48 @@ func (this *Socket) Close() error {
 	return nil
 }
 
-func (this *Socket) Authenticate(UID string) error {
+func (this *Socket) Subscribe(topic string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.isClosed() || this.topics[topic] {
+		return nil
+	}
+
+	this.topics[topic] = true
+
+	return this.Server.Store.SubscribeTopic(this, topic)
+}
+
+func (this *Socket) Unsubscribe(topic string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.isClosed() || !this.topics[topic] {
+		return nil
+	}
+
+	delete(this.topics, topic)
+
+	return this.Server.Store.UnsubscribeTopic(this, topic)
+}
+
+// subscribeAll subscribes to each topic in a comma separated list.
+func (this *Socket) subscribeAll(topics string) {
+	for _, topic := range strings.Split(topics, ",") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			this.Subscribe(topic)
+		}
+	}
+}
+
+func (this *Socket) Authenticate(UID, token string) error {
 
 	if this.isWebsocket() {
 		var message = new(CommandMsg)
 		err := this.ws.ReadJSON(message)
 
-		if DEBUG {
-			log.Println(message.Command)
-		}
+		this.logger().Debug("Received authenticate command", "command", message.Command)
 		if err != nil {
 			return err
 		}
@@ -109,26 +230,89 @@ func (this *Socket) Authenticate(UID string) error {
 			return errors.New("Error: Authenticate Expected.\n")
 		}
 
-		var ok bool
-		UID, ok = message.Command["user"]
-		if !ok {
-			return errors.New("Error on Authenticate: Bad Input.\n")
-		}
+		UID = message.Command["user"]
+		token = message.Command["token"]
+		this.lastID = parseLastID(message.Command["last_id"])
+		this.Page = message.Command["page"]
 	}
 
-	if UID == "" {
-		return errors.New("Error on Authenticate: Bad Input.\n")
+	UID, err := this.Server.Auth.Authenticate(UID, token)
+	if err != nil {
+		return err
 	}
 
-	if DEBUG {
-		log.Printf("saving UID as %s", UID)
+	if !this.Server.allowUserConnection(UID) {
+		return errRateLimited
 	}
+
 	this.UID = UID
+	this.logger().Debug("Authenticated")
 	this.Server.Store.Save(this)
 
+	if this.Page != "" {
+		this.Server.Store.SetPage(this)
+	}
+
 	return nil
 }
 
+// loadHistory queues the messages recorded since lastID for this socket's
+// user and page. It must run after the socket is saved: anything newer than
+// the ID read here is delivered live instead.
+func (this *Socket) loadHistory() {
+	if this.lastID == noLastID {
+		return
+	}
+
+	upto, err := this.Server.Store.LastMessageID()
+	if err != nil {
+		this.logger().Error("Error loading message history", "error", err)
+		return
+	}
+
+	entries, err := this.Server.Store.History(this.UID, this.Page, this.lastID, upto)
+	if err != nil {
+		this.logger().Error("Error loading message history", "error", err)
+		return
+	}
+
+	for _, entry := range entries {
+		this.replay = append(this.replay, entry.Message)
+	}
+}
+
+// loadPendingAcks queues the messages this socket's user hasn't acknowledged
+// yet, after any history replayed by loadHistory.
+func (this *Socket) loadPendingAcks() {
+	acks, err := this.Server.Store.PendingAcks(this.UID)
+	if err != nil {
+		this.logger().Error("Error loading pending acks", "error", err)
+		return
+	}
+
+	replayed := make(map[int64]bool, len(this.replay))
+	for _, msg := range this.replay {
+		replayed[msg.ID] = true
+	}
+
+	for _, ack := range acks {
+		if replayed[ack.Message.ID] || (ack.Page != "" && ack.Page != this.Page) {
+			continue
+		}
+
+		this.replay = append(this.replay, ack.Message)
+	}
+}
+
+func parseLastID(lastID string) int64 {
+	id, err := strconv.ParseInt(lastID, 10, 64)
+	if err != nil || id < 0 {
+		return noLastID
+	}
+
+	return id
+}
+
 func (this *Socket) listenForMessages() {
 	for {
 
@@ -137,12 +321,9 @@ func (this *Socket) listenForMessages() {
 			return
 
 		default:
-			var command = new(CommandMsg)
-			err := this.ws.ReadJSON(command)
+			_, data, err := this.ws.ReadMessage()
 			if err != nil {
-				if DEBUG {
-					log.Printf("Error: %s\n", err.Error())
-				}
+				this.logger().Debug("Error reading from socket", "error", err)
 
 				go this.Close()
 				return
@@ -150,39 +331,50 @@ func (this *Socket) listenForMessages() {
 
 			this.Server.Stats.LogReadMessage()
 
-			if DEBUG {
-				log.Println(command)
+			var command = new(CommandMsg)
+			if err := json.Unmarshal(data, command); err != nil {
+				this.Server.Stats.LogInvalidJSON()
+				this.rejectCommand(invalidJSON(err))
+				continue
+			}
+
+			if this.debugEnabled() {
+				this.logger().Sampled().Debug("Received command", "command", command.Command)
+			}
+			if !this.allowCommand() {
+				return
 			}
+
 			go command.FromSocket(this)
 		}
 	}
 }
 
 func (this *Socket) listenForWrites() {
+	// SSE streams are held open indefinitely, so keep proxies from timing them out.
+	var keepalive <-chan time.Time
+	if this.isSSE() {
+		ticker := time.NewTicker(sseKeepaliveInterval)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	for _, message := range this.replay {
+		if !this.writeMessage(message) {
+			return
+		}
+	}
+	this.replay = nil
+
 	for {
 		select {
 		case message := <-this.buff:
-			if DEBUG {
-				log.Println("Sending:", message)
-			}
-
-			var err error
-			if this.isWebsocket() {
-				this.ws.SetWriteDeadline(time.Now().Add(writeWait))
-				err = this.ws.WriteJSON(message)
-			} else {
-				json_str, _ := json.Marshal(message)
-
-				_, err = fmt.Fprint(this.lp, string(json_str))
+			if !this.writeMessage(message) {
+				return
 			}
 
-			this.Server.Stats.LogWriteMessage()
-
-			if this.isLongPoll() || err != nil {
-				if DEBUG && err != nil {
-					log.Printf("Error: %s\n", err.Error())
-				}
-
+		case <-keepalive:
+			if err := this.writeSSE(": keepalive\n\n"); err != nil {
 				go this.Close()
 				return
 			}
@@ -192,3 +384,63 @@ func (this *Socket) listenForWrites() {
 		}
 	}
 }
+
+// writeMessage sends message to the client, returning false once nothing
+// more should be written to this socket.
+func (this *Socket) writeMessage(message *Message) bool {
+	if this.debugEnabled() {
+		this.logger().Sampled().Debug("Sending message", "event", message.Event, "id", message.ID)
+	}
+
+	var err error
+	if this.isWebsocket() {
+		this.ws.SetWriteDeadline(time.Now().Add(writeWait))
+		err = this.ws.WriteJSON(message)
+	} else if this.isSSE() {
+		err = this.writeSSEMessage(message)
+	} else {
+		json_str, _ := json.Marshal(message)
+
+		_, err = fmt.Fprint(this.lp, string(json_str))
+	}
+
+	this.Server.Stats.LogWriteMessage()
+
+	if this.isLongPoll() || err != nil {
+		if err != nil {
+			this.logger().Debug("Error writing to socket", "error", err)
+		}
+
+		go this.Close()
+		return false
+	}
+
+	return true
+}
+
+func (this *Socket) writeSSEMessage(message *Message) error {
+	json_str, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	// Only messages recorded in history have IDs; EventSource keeps the
+	// previous ID for events without one.
+	if message.ID != 0 {
+		return this.writeSSE(fmt.Sprintf("id: %d\ndata: %s\n\n", message.ID, json_str))
+	}
+
+	return this.writeSSE(fmt.Sprintf("data: %s\n\n", json_str))
+}
+
+func (this *Socket) writeSSE(frame string) error {
+	if _, err := fmt.Fprint(this.sse, frame); err != nil {
+		return err
+	}
+
+	if flusher, ok := this.sse.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	return nil
+}
@@ -14,10 +14,12 @@ type RuntimeStats interface {
 	LogCommand(from, cmdType string)
 	LogPageMessage()
 	LogUserMessage()
+	LogTopicMessage()
 	LogBroadcastMessage()
 	LogReadMessage()
 	LogWriteMessage()
 	LogInvalidJSON()
+	LogCommandRejected(reason string)
 
 	LogWebsocketConnection()
 	LogWebsocketDisconnection()
@@ -25,6 +27,16 @@ type RuntimeStats interface {
 	LogLongpollConnect()
 	LogLongpollDisconnect()
 
+	LogSSEConnect()
+	LogSSEDisconnect()
+
+	LogOriginRejected(transport string)
+	LogRateLimited(limit string)
+
+	LogSendQueueLength(int)
+	LogDroppedMessage(policy string)
+	LogSlowConsumerDisconnect()
+
 	LogAPNSPush()
 	LogAPNSError()
 
@@ -32,7 +44,18 @@ type RuntimeStats interface {
 	LogGCMError()
 	LogGCMFailure()
 
+	LogWebPush()
+	LogWebPushError()
+
+	LogRoutedMessage(nodes int)
+	LogDeadLetter()
+
 	LogPendingRedisActivityCommandsListLength(int)
+
+	LogRedisPool(active, idle int)
+	LogRedisPoolWait()
+	LogRedisPoolTimeout()
+	LogRedisDialError()
 }
 
 type DiscardStats struct{}
@@ -43,6 +66,7 @@ func (d *DiscardStats) LogGoroutines(int)                          {}
 func (d *DiscardStats) LogCommand(from, cmdType string)               {}
 func (d *DiscardStats) LogPageMessage()                               {}
 func (d *DiscardStats) LogUserMessage()                               {}
+func (d *DiscardStats) LogTopicMessage()                              {}
 func (d *DiscardStats) LogBroadcastMessage()                          {}
 func (d *DiscardStats) LogWebsocketConnection()                       {}
 func (d *DiscardStats) LogWebsocketDisconnection()                    {}
@@ -50,13 +74,29 @@ func (d *DiscardStats) LogReadMessage()                               {}
 func (d *DiscardStats) LogWriteMessage()                              {}
 func (d *DiscardStats) LogLongpollConnect()                           {}
 func (d *DiscardStats) LogLongpollDisconnect()                        {}
+func (d *DiscardStats) LogSSEConnect()                                {}
+func (d *DiscardStats) LogSSEDisconnect()                             {}
+func (d *DiscardStats) LogOriginRejected(transport string)            {}
+func (d *DiscardStats) LogRateLimited(limit string)                   {}
+func (d *DiscardStats) LogSendQueueLength(int)                        {}
+func (d *DiscardStats) LogDroppedMessage(policy string)               {}
+func (d *DiscardStats) LogSlowConsumerDisconnect()                    {}
 func (d *DiscardStats) LogAPNSPush()                                  {}
 func (d *DiscardStats) LogGCMPush()                                   {}
 func (d *DiscardStats) LogAPNSError()                                 {}
 func (d *DiscardStats) LogGCMError()                                  {}
 func (d *DiscardStats) LogGCMFailure()                                {}
+func (d *DiscardStats) LogWebPush()                                   {}
+func (d *DiscardStats) LogWebPushError()                              {}
 func (d *DiscardStats) LogInvalidJSON()                               {}
+func (d *DiscardStats) LogCommandRejected(reason string)              {}
+func (d *DiscardStats) LogRoutedMessage(nodes int)                    {}
+func (d *DiscardStats) LogDeadLetter()                                {}
 func (d *DiscardStats) LogPendingRedisActivityCommandsListLength(int) {}
+func (d *DiscardStats) LogRedisPool(active, idle int)                 {}
+func (d *DiscardStats) LogRedisPoolWait()                             {}
+func (d *DiscardStats) LogRedisPoolTimeout()                          {}
+func (d *DiscardStats) LogRedisDialError()                            {}
 
 type DatadogStats struct {
 	dog *godspeed.Godspeed
@@ -117,6 +157,11 @@ func (d *DatadogStats) LogUserMessage() {
 	d.dog.Incr("incus.message.user", nil)
 }
 
+func (d *DatadogStats) LogTopicMessage() {
+	d.dog.Incr("incus.message", nil)
+	d.dog.Incr("incus.message.topic", nil)
+}
+
 func (d *DatadogStats) LogBroadcastMessage() {
 	d.dog.Incr("incus.message", nil)
 	d.dog.Incr("incus.message.all", nil)
@@ -146,6 +191,37 @@ func (d *DatadogStats) LogLongpollDisconnect() {
 	d.dog.Incr("incus.longpoll.disconnect", nil)
 }
 
+func (d *DatadogStats) LogSSEConnect() {
+	d.dog.Incr("incus.sse.connect", nil)
+}
+
+func (d *DatadogStats) LogSSEDisconnect() {
+	d.dog.Incr("incus.sse.disconnect", nil)
+}
+
+func (d *DatadogStats) LogOriginRejected(transport string) {
+	d.dog.Incr("incus.origin.rejected", nil)
+	d.dog.Incr("incus.origin.rejected."+transport, nil)
+}
+
+func (d *DatadogStats) LogRateLimited(limit string) {
+	d.dog.Incr("incus.rate_limited", nil)
+	d.dog.Incr("incus.rate_limited."+limit, nil)
+}
+
+func (d *DatadogStats) LogSendQueueLength(length int) {
+	d.dog.Gauge("incus.send_queue.max_length", float64(length), nil)
+}
+
+func (d *DatadogStats) LogDroppedMessage(policy string) {
+	d.dog.Incr("incus.send_queue.dropped", nil)
+	d.dog.Incr("incus.send_queue.dropped."+policy, nil)
+}
+
+func (d *DatadogStats) LogSlowConsumerDisconnect() {
+	d.dog.Incr("incus.send_queue.disconnect", nil)
+}
+
 func (d *DatadogStats) LogAPNSPush() {
 	d.dog.Incr("incus.apns.push", nil)
 }
@@ -166,10 +242,49 @@ func (d *DatadogStats) LogGCMFailure() {
 	d.dog.Incr("incus.gcm.fail", nil)
 }
 
+func (d *DatadogStats) LogWebPush() {
+	d.dog.Incr("incus.webpush.push", nil)
+}
+
+func (d *DatadogStats) LogWebPushError() {
+	d.dog.Incr("incus.webpush.error", nil)
+}
+
 func (d *DatadogStats) LogInvalidJSON() {
 	d.dog.Incr("incus.jsonerror", nil)
 }
 
+func (d *DatadogStats) LogCommandRejected(reason string) {
+	d.dog.Incr("incus.command.rejected", nil)
+	d.dog.Incr("incus.command.rejected."+reason, nil)
+}
+
+func (d *DatadogStats) LogRoutedMessage(nodes int) {
+	d.dog.Incr("incus.route", nil)
+	d.dog.Count("incus.route.nodes", float64(nodes), nil)
+}
+
+func (d *DatadogStats) LogDeadLetter() {
+	d.dog.Incr("incus.stream.deadletter", nil)
+}
+
 func (d *DatadogStats) LogPendingRedisActivityCommandsListLength(length int) {
 	d.dog.Gauge("incus.pendingactivityredislen", float64(length), nil)
 }
+
+func (d *DatadogStats) LogRedisPool(active, idle int) {
+	d.dog.Gauge("incus.redis.pool.active", float64(active), nil)
+	d.dog.Gauge("incus.redis.pool.idle", float64(idle), nil)
+}
+
+func (d *DatadogStats) LogRedisPoolWait() {
+	d.dog.Incr("incus.redis.pool.wait", nil)
+}
+
+func (d *DatadogStats) LogRedisPoolTimeout() {
+	d.dog.Incr("incus.redis.pool.timeout", nil)
+}
+
+func (d *DatadogStats) LogRedisDialError() {
+	d.dog.Incr("incus.redis.dial_error", nil)
+}
@@ -1,88 +1,213 @@
 package incus
 
 import (
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
+// A message recorded in a user's or page's history so it can be replayed to
+// clients that reconnect with the ID of the last message they saw.
+type historyEntry struct {
+	ID      int64    `json:"-"`
+	Page    string   `json:"page,omitempty"`
+	Message *Message `json:"message"`
+}
+
+type historyEntries []*historyEntry
+
+func (h historyEntries) Len() int           { return len(h) }
+func (h historyEntries) Less(i, j int) bool { return h[i].ID < h[j].ID }
+func (h historyEntries) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+// A message sent to a user that the user hasn't acknowledged yet. It is
+// redelivered when the user reconnects, until it is acked or Expires.
+type pendingAck struct {
+	UID     string   `json:"uid"`
+	Page    string   `json:"page,omitempty"`
+	Message *Message `json:"message"`
+	Expires int64    `json:"expires"`
+}
+
+type pendingAcks []*pendingAck
+
+func (p pendingAcks) Len() int           { return len(p) }
+func (p pendingAcks) Less(i, j int) bool { return p[i].Message.ID < p[j].Message.ID }
+func (p pendingAcks) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
 type Storage struct {
 	memory      *MemoryStore
 	redis       *RedisStore
 	StorageType string
 
-	userMu sync.RWMutex
-	pageMu sync.RWMutex
+	// What carries commands between nodes, or nil on a lone node, with the
+	// channel every node listens on and the queue applications push onto.
+	bus            MessageBus
+	messageChannel string
+	messageQueue   string
+
+	historyEnabled bool
+	historyMu      sync.Mutex
+	lastMessageID  int64
+
+	// Whether to track which node holds each user's and page's sockets, so
+	// messages can be routed only to those nodes.
+	targetedRouting bool
+
+	// Rate limit buckets, without Redis.
+	limiter memoryRateLimiter
+
+	acksEnabled bool
+	ackTimeout  time.Duration
+	ackMu       sync.Mutex
 }
 
-func NewStore(stats RuntimeStats) *Storage {
+func NewStore(stats RuntimeStats, logger *Logger) *Storage {
 	storeType := "memory"
 	var redisStore *RedisStore
 
 	if viper.GetBool("redis_enabled") {
+		if err := checkRedisMode(viper.GetString("redis_mode")); err != nil {
+			panic(err)
+		}
+
+		if err := checkTargetedRouting(viper.GetString("redis_mode"), viper.GetBool("redis_targeted_routing")); err != nil {
+			panic(err)
+		}
+
 		redisHost := viper.GetString("redis_port_6379_tcp_addr")
 		redisPort := viper.GetInt("redis_port_6379_tcp_port")
 		connPoolSize := viper.GetInt("redis_connection_pool_size")
 		numConsumers := viper.GetInt("redis_activity_consumers")
 
-		redisStore = newRedisStore(redisHost, redisPort, numConsumers, connPoolSize, stats)
+		redisStore = newRedisStore(redisHost, redisPort, numConsumers, connPoolSize, stats, logger)
 		storeType = "redis"
 	}
 
+	var bus MessageBus
+	var messageChannel, messageQueue string
+
+	if viper.GetBool("nats_enabled") {
+		natsBus, err := NewNatsBus(
+			viper.GetString("nats_url"),
+			viper.GetString("nats_stream"),
+			viper.GetString("nats_consumer"),
+			time.Duration(viper.GetInt("nats_ack_wait"))*time.Second,
+			logger)
+		if err != nil {
+			panic(err)
+		}
+
+		bus = natsBus
+		messageChannel = viper.GetString("nats_message_subject")
+		messageQueue = viper.GetString("nats_message_queue")
+	} else if redisStore != nil {
+		bus = redisStore
+		messageChannel = viper.GetString("redis_message_channel")
+		messageQueue = viper.GetString("redis_message_queue")
+	}
+
 	var Store = Storage{
-		&MemoryStore{make(map[string]map[string]*Socket), make(map[string]map[string]*Socket), 0},
-		redisStore,
-		storeType,
+		memory:      newMemoryStore(viper.GetInt("history_size")),
+		redis:       redisStore,
+		StorageType: storeType,
+
+		bus:            bus,
+		messageChannel: messageChannel,
+		messageQueue:   messageQueue,
+
+		// Routing relies on Redis pub/sub counting a channel's receivers.
+		targetedRouting: storeType == "redis" && bus == redisStore && viper.GetBool("redis_targeted_routing"),
 
-		sync.RWMutex{},
-		sync.RWMutex{},
+		historyEnabled: viper.GetBool("history_enabled"),
+		historyMu:      sync.Mutex{},
+
+		acksEnabled: viper.GetBool("acks_enabled"),
+		ackTimeout:  time.Duration(viper.GetInt("ack_timeout")) * time.Second,
+		ackMu:       sync.Mutex{},
 	}
 
 	return &Store
 }
 
 func (this *Storage) Save(sock *Socket) error {
-	this.userMu.Lock()
 	this.memory.Save(sock)
-	this.userMu.Unlock()
 
 	if this.StorageType == "redis" {
 		if err := this.redis.Save(sock); err != nil {
 			return err
 		}
+
+		if this.targetedRouting {
+			if err := this.redis.AddNode(userNodesKey(sock.UID), sock.Server.ID); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
 func (this *Storage) Remove(sock *Socket) error {
-	this.userMu.Lock()
 	this.memory.Remove(sock)
-	this.userMu.Unlock()
 
 	if this.StorageType == "redis" {
 		if err := this.redis.Remove(sock); err != nil {
 			return err
 		}
+
+		if this.targetedRouting {
+			if err := this.redis.RemoveNode(userNodesKey(sock.UID), sock.Server.ID); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
+// Client returns a copy of UID's sockets on this node.
 func (this *Storage) Client(UID string) (map[string]*Socket, error) {
-	defer this.userMu.RUnlock()
-	this.userMu.RLock()
-
 	return this.memory.Client(UID)
 }
 
-func (this *Storage) Clients() map[string]map[string]*Socket {
-	defer this.userMu.RUnlock()
-	this.userMu.RLock()
+// Socket returns the socket SID if it's connected to this node, or nil.
+func (this *Storage) Socket(SID string) *Socket {
+	return this.memory.Socket(SID)
+}
 
+// Clients returns a copy of the sockets connected to this node, by UID.
+func (this *Storage) Clients() map[string]map[string]*Socket {
 	return this.memory.Clients()
 }
 
+// Sockets returns every socket connected to this node, safe to use while
+// sockets connect and disconnect.
+func (this *Storage) Sockets() []*Socket {
+	return this.memory.Sockets()
+}
+
+// EachSocket calls fn for every socket connected to this node, without
+// holding any of the store's locks.
+func (this *Storage) EachSocket(fn func(*Socket)) {
+	this.memory.clients.Each(func(UID string, sock *Socket) {
+		fn(sock)
+	})
+}
+
+// IsUserActive reports whether a user has an active socket: anywhere, by
+// their presence in Redis, or on this node otherwise.
+func (this *Storage) IsUserActive(UID string) (bool, error) {
+	if this.StorageType == "redis" {
+		return this.redis.QueryIsUserActive(UID, time.Now().Unix())
+	}
+
+	return this.memory.clients.Count(UID) > 0, nil
+}
+
 func (this *Storage) ClientList() ([]string, error) {
 	if this.StorageType == "redis" {
 		return this.redis.Clients()
@@ -100,35 +225,278 @@ func (this *Storage) Count() (int64, error) {
 }
 
 func (this *Storage) SetPage(sock *Socket) error {
-	this.pageMu.Lock()
 	this.memory.SetPage(sock)
-	this.pageMu.Unlock()
 
 	if this.StorageType == "redis" {
 		if err := this.redis.SetPage(sock); err != nil {
 			return err
 		}
+
+		if this.targetedRouting {
+			if err := this.redis.AddNode(pageNodesKey(sock.Page), sock.Server.ID); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
 func (this *Storage) UnsetPage(sock *Socket) error {
-	this.pageMu.Lock()
 	this.memory.UnsetPage(sock)
-	this.pageMu.Unlock()
 
 	if this.StorageType == "redis" {
 		if err := this.redis.UnsetPage(sock); err != nil {
 			return err
 		}
+
+		if this.targetedRouting {
+			if err := this.redis.RemoveNode(pageNodesKey(sock.Page), sock.Server.ID); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
+// getPage returns a copy of the sockets on page.
 func (this *Storage) getPage(page string) map[string]*Socket {
-	defer this.pageMu.RUnlock()
-	this.pageMu.RLock()
 	return this.memory.getPage(page)
 }
+
+// PageCount returns how many sockets on this node are on page.
+func (this *Storage) PageCount(page string) int {
+	return this.memory.PageCount(page)
+}
+
+func (this *Storage) SubscribeTopic(sock *Socket, topic string) error {
+	this.memory.SubscribeTopic(sock, topic)
+
+	if this.StorageType == "redis" {
+		if err := this.redis.SubscribeTopic(topic); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *Storage) UnsubscribeTopic(sock *Socket, topic string) error {
+	this.memory.UnsubscribeTopic(sock, topic)
+
+	if this.StorageType == "redis" {
+		if err := this.redis.UnsubscribeTopic(topic); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getTopic returns a copy of the sockets subscribed to topic, since sockets
+// may subscribe and unsubscribe while a message is being sent.
+func (this *Storage) getTopic(topic string) map[string]*Socket {
+	return this.memory.getTopic(topic)
+}
+
+// RecordUserMessage assigns msg the next message ID and appends it to UID's
+// history. publishID identifies the publish the message came from, so that
+// every node receiving the same command over pub/sub agrees on a single ID.
+func (this *Storage) RecordUserMessage(UID, page string, msg *Message, publishID string) error {
+	return this.recordMessage("user", this.memory.userHistory, UID, page, msg, publishID)
+}
+
+// RecordPageMessage is RecordUserMessage for messages sent to everyone on a page.
+func (this *Storage) RecordPageMessage(page string, msg *Message, publishID string) error {
+	return this.recordMessage("page", this.memory.pageHistory, page, "", msg, publishID)
+}
+
+func (this *Storage) recordMessage(kind string, memoryHistory map[string]*messageHistory, name, page string, msg *Message, publishID string) error {
+	if !this.historyEnabled {
+		return nil
+	}
+
+	entry := &historyEntry{Page: page, Message: msg}
+
+	if this.StorageType == "redis" {
+		return this.redis.RecordHistory(kind, name, entry, publishID)
+	}
+
+	entry.ID = atomic.AddInt64(&this.lastMessageID, 1)
+	msg.ID = entry.ID
+
+	this.historyMu.Lock()
+	this.memory.RecordHistory(memoryHistory, name, entry)
+	this.historyMu.Unlock()
+
+	return nil
+}
+
+// LastMessageID returns the most recently assigned message ID.
+func (this *Storage) LastMessageID() (int64, error) {
+	if this.StorageType == "redis" {
+		return this.redis.LastMessageID()
+	}
+
+	return atomic.LoadInt64(&this.lastMessageID), nil
+}
+
+// History returns the messages recorded for UID and page with IDs in
+// (after, upto], oldest first. User messages scoped to a page other than
+// page are left out.
+func (this *Storage) History(UID, page string, after, upto int64) ([]*historyEntry, error) {
+	var userEntries, pageEntries []*historyEntry
+	var err error
+
+	if this.StorageType == "redis" {
+		userEntries, err = this.redis.History("user", UID)
+		if err != nil {
+			return nil, err
+		}
+
+		if page != "" {
+			pageEntries, err = this.redis.History("page", page)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		this.historyMu.Lock()
+		userEntries = this.memory.History(this.memory.userHistory, UID)
+		if page != "" {
+			pageEntries = this.memory.History(this.memory.pageHistory, page)
+		}
+		this.historyMu.Unlock()
+	}
+
+	var entries historyEntries
+	for _, entry := range append(userEntries, pageEntries...) {
+		if entry.ID <= after || entry.ID > upto {
+			continue
+		}
+
+		if entry.Page != "" && entry.Page != page {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.Sort(entries)
+
+	return entries, nil
+}
+
+// ExpireHistory forgets in-memory histories that haven't been written to
+// since before. Redis histories expire on their own.
+func (this *Storage) ExpireHistory(before time.Time) {
+	this.historyMu.Lock()
+	defer this.historyMu.Unlock()
+
+	this.memory.ExpireHistory(this.memory.userHistory, before)
+	this.memory.ExpireHistory(this.memory.pageHistory, before)
+}
+
+// AssignMessageID gives msg an ID, if it doesn't have one from its history
+// already, when acks are enabled. As with history, publishID makes every
+// node handling the same publish assign the same ID.
+func (this *Storage) AssignMessageID(msg *Message, publishID string) error {
+	if !this.acksEnabled || msg.ID != 0 {
+		return nil
+	}
+
+	if this.StorageType == "redis" {
+		return this.redis.MessageID(msg, publishID)
+	}
+
+	msg.ID = atomic.AddInt64(&this.lastMessageID, 1)
+
+	return nil
+}
+
+// AddPendingAck remembers msg, sent to UID, until UID acks it or ack_timeout
+// passes. msg must have an ID.
+func (this *Storage) AddPendingAck(UID, page string, msg *Message) error {
+	if !this.acksEnabled || msg.ID == 0 {
+		return nil
+	}
+
+	ack := &pendingAck{UID: UID, Page: page, Message: msg, Expires: time.Now().Add(this.ackTimeout).Unix()}
+
+	if this.StorageType == "redis" {
+		return this.redis.AddPendingAck(ack)
+	}
+
+	this.ackMu.Lock()
+	this.memory.AddPendingAck(ack)
+	this.ackMu.Unlock()
+
+	return nil
+}
+
+// Ack forgets the message UID acknowledged, returning it if it was pending.
+// Across the cluster, only one caller gets it back.
+func (this *Storage) Ack(UID string, id int64) (*pendingAck, error) {
+	if !this.acksEnabled {
+		return nil, nil
+	}
+
+	if this.StorageType == "redis" {
+		return this.redis.Ack(UID, id)
+	}
+
+	this.ackMu.Lock()
+	defer this.ackMu.Unlock()
+
+	return this.memory.Ack(UID, id), nil
+}
+
+// PendingAcks returns UID's unexpired, unacknowledged messages, oldest first.
+func (this *Storage) PendingAcks(UID string) ([]*pendingAck, error) {
+	if !this.acksEnabled {
+		return nil, nil
+	}
+
+	var acks pendingAcks
+	var err error
+
+	if this.StorageType == "redis" {
+		acks, err = this.redis.PendingAcks(UID)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		this.ackMu.Lock()
+		acks = this.memory.PendingAcks(UID)
+		this.ackMu.Unlock()
+	}
+
+	now := time.Now().Unix()
+	unexpired := acks[:0]
+	for _, ack := range acks {
+		if ack.Expires > now {
+			unexpired = append(unexpired, ack)
+		}
+	}
+
+	sort.Sort(unexpired)
+
+	return unexpired, nil
+}
+
+// ExpireAcks removes and returns the pending acks whose deadline has passed.
+func (this *Storage) ExpireAcks(now time.Time) ([]*pendingAck, error) {
+	if !this.acksEnabled {
+		return nil, nil
+	}
+
+	if this.StorageType == "redis" {
+		return this.redis.ExpireAcks(now, 1000)
+	}
+
+	this.ackMu.Lock()
+	defer this.ackMu.Unlock()
+
+	return this.memory.ExpireAcks(now), nil
+}
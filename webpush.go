@@ -0,0 +1,248 @@
+package incus
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	webPushRecordSize     = 4096
+	webPushRequestTimeout = 10 * time.Second
+	webPushDefaultTTL     = 86400
+
+	// Push services must accept 4096 byte bodies. Of those, the aes128gcm
+	// header takes 86, and the padding delimiter and GCM tag 17 more.
+	webPushMaxPayload = webPushRecordSize - 86 - 17
+
+	// RFC 8292 caps VAPID tokens at 24 hours.
+	vapidTokenLifetime = 12 * time.Hour
+)
+
+var errWebPushPayloadTooLarge = errors.New("Web push payload is too large")
+
+// WebPushSubscription is what a browser's PushManager.subscribe() hands the
+// application: where to push, and the keys to encrypt the push with.
+type WebPushSubscription struct {
+	Endpoint string
+	P256dh   string // base64url encoded P-256 public key of the browser
+	Auth     string // base64url encoded 16 byte authentication secret
+}
+
+// WebPushOptions are the RFC 8030 headers sent with each push.
+type WebPushOptions struct {
+	TTL     int    // seconds the push service keeps an undelivered push
+	Urgency string // very-low, low, normal or high
+	Topic   string // pushes with the same topic replace each other
+}
+
+type WebPushClient interface {
+	Send(sub *WebPushSubscription, payload []byte, options WebPushOptions) (int, error)
+}
+
+// WebPushSender delivers RFC 8291 encrypted pushes, identifying itself to
+// push services with a VAPID (RFC 8292) key pair.
+type WebPushSender struct {
+	key       *ecdsa.PrivateKey
+	publicKey string
+	subject   string
+	client    *http.Client
+}
+
+// NewWebPushSender takes the VAPID private key as a base64url encoded P-256
+// scalar, the format generated by most web push libraries, and a mailto: or
+// https: subject push services can use to reach the operator.
+func NewWebPushSender(privateKey, subject string, client *http.Client) (*WebPushSender, error) {
+	d, err := decodeBase64URL(privateKey)
+	if err != nil || len(d) != 32 {
+		return nil, errors.New("VAPID private key must be a base64url encoded 32 byte P-256 key")
+	}
+
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	key.PublicKey.Curve = elliptic.P256()
+	key.PublicKey.X, key.PublicKey.Y = key.PublicKey.Curve.ScalarBaseMult(d)
+
+	publicKey := elliptic.Marshal(key.PublicKey.Curve, key.PublicKey.X, key.PublicKey.Y)
+
+	if client == nil {
+		client = &http.Client{Timeout: webPushRequestTimeout}
+	}
+
+	return &WebPushSender{
+		key:       key,
+		publicKey: base64.RawURLEncoding.EncodeToString(publicKey),
+		subject:   subject,
+		client:    client,
+	}, nil
+}
+
+// Send encrypts and delivers a single push, returning the push service's
+// HTTP status. 404 and 410 mean the subscription no longer exists.
+func (this *WebPushSender) Send(sub *WebPushSubscription, payload []byte, options WebPushOptions) (int, error) {
+	body, err := encryptWebPush(sub, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	endpoint, err := url.Parse(sub.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return 0, fmt.Errorf("Invalid web push endpoint %q", sub.Endpoint)
+	}
+
+	token, err := this.vapidToken(endpoint.Scheme + "://" + endpoint.Host)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest("POST", sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Authorization", "vapid t="+token+", k="+this.publicKey)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(options.TTL))
+	if options.Urgency != "" {
+		req.Header.Set("Urgency", options.Urgency)
+	}
+	if options.Topic != "" {
+		req.Header.Set("Topic", options.Topic)
+	}
+
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("Push service rejected web push: %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+func (this *WebPushSender) vapidToken(audience string) (string, error) {
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": audience,
+		"exp": time.Now().Add(vapidTokenLifetime).Unix(),
+		"sub": this.subject,
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, this.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// encryptWebPush encrypts payload for sub as a single aes128gcm record, as
+// described in RFC 8291.
+func encryptWebPush(sub *WebPushSubscription, payload []byte) ([]byte, error) {
+	if len(payload) > webPushMaxPayload {
+		return nil, errWebPushPayloadTooLarge
+	}
+
+	uaPublicBytes, err := decodeBase64URL(sub.P256dh)
+	if err != nil {
+		return nil, errors.New("Invalid web push p256dh key")
+	}
+
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, errors.New("Invalid web push p256dh key")
+	}
+
+	authSecret, err := decodeBase64URL(sub.Auth)
+	if err != nil || len(authSecret) == 0 {
+		return nil, errors.New("Invalid web push auth secret")
+	}
+
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublicBytes := asPrivate.PublicKey().Bytes()
+
+	ecdhSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublicBytes...)
+	keyInfo = append(keyInfo, asPublicBytes...)
+	ikm := hkdf(authSecret, ecdhSecret, keyInfo, 32)
+
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// A single, final record: the payload followed by the 0x02 delimiter.
+	plaintext := append(append([]byte{}, payload...), 2)
+
+	header := make([]byte, 0, 86)
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webPushRecordSize)
+	header = append(header, byte(len(asPublicBytes)))
+	header = append(header, asPublicBytes...)
+
+	return aead.Seal(header, nonce, plaintext, nil), nil
+}
+
+// hkdf is HKDF-SHA256 (RFC 5869), limited to a single block of output.
+func hkdf(salt, ikm, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write(info)
+	expand.Write([]byte{1})
+
+	return expand.Sum(nil)[:length]
+}
+
+// Browsers hand out keys as unpadded base64url, but some libraries pad them.
+func decodeBase64URL(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
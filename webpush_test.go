@@ -0,0 +1,184 @@
+package incus
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// decryptTestWebPush does the browser's half of RFC 8291.
+func decryptTestWebPush(t *testing.T, uaPrivate *ecdh.PrivateKey, authSecret, body []byte) []byte {
+	salt := body[:16]
+	if binary.BigEndian.Uint32(body[16:20]) != webPushRecordSize {
+		t.Fatalf("Unexpected record size %d", binary.BigEndian.Uint32(body[16:20]))
+	}
+
+	idlen := int(body[20])
+	asPublicBytes := body[21 : 21+idlen]
+
+	asPublic, err := ecdh.P256().NewPublicKey(asPublicBytes)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	ecdhSecret, _ := uaPrivate.ECDH(asPublic)
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPrivate.PublicKey().Bytes()...)
+	keyInfo = append(keyInfo, asPublicBytes...)
+	ikm := hkdf(authSecret, ecdhSecret, keyInfo, 32)
+
+	block, _ := aes.NewCipher(hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16))
+	aead, _ := cipher.NewGCM(block)
+
+	plaintext, err := aead.Open(nil, hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12), body[21+idlen:], nil)
+	if err != nil {
+		t.Fatalf("Could not decrypt web push: %s", err.Error())
+	}
+
+	if plaintext[len(plaintext)-1] != 2 {
+		t.Fatalf("Expected a final record delimiter")
+	}
+
+	return plaintext[:len(plaintext)-1]
+}
+
+func verifyTestVAPID(t *testing.T, authorization, audience string) {
+	var token, key string
+	for _, param := range strings.Split(strings.TrimPrefix(authorization, "vapid "), ", ") {
+		if strings.HasPrefix(param, "t=") {
+			token = param[2:]
+		} else if strings.HasPrefix(param, "k=") {
+			key = param[2:]
+		}
+	}
+
+	keyBytes, _ := base64.RawURLEncoding.DecodeString(key)
+	x, y := elliptic.Unmarshal(elliptic.P256(), keyBytes)
+	if x == nil {
+		t.Fatalf("Expected an uncompressed P-256 VAPID key, instead %q", key)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Expected a VAPID JWT, instead %q", authorization)
+	}
+
+	var claims map[string]interface{}
+	claimsJSON, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(claimsJSON, &claims)
+	if claims["aud"] != audience || claims["sub"] != "mailto:push@example.com" {
+		t.Fatalf("Unexpected VAPID claims %+v", claims)
+	}
+
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	if !ecdsa.Verify(publicKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		t.Fatalf("VAPID signature did not verify")
+	}
+}
+
+func TestWebPush(t *testing.T) {
+	vapidKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	sender, err := NewWebPushSender(base64.RawURLEncoding.EncodeToString(vapidKey.D.Bytes()), "mailto:push@example.com", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	uaPrivate, _ := ecdh.P256().GenerateKey(rand.Reader)
+	authSecret := make([]byte, 16)
+	rand.Read(authSecret)
+
+	var requests []*http.Request
+	var bodies [][]byte
+
+	// A stand-in for a browser vendor's push service
+	pushService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r)
+		bodies = append(bodies, body)
+
+		if r.URL.Path == "/push/expired" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer pushService.Close()
+
+	server := &Server{
+		Stats:   &DiscardStats{},
+		webPush: sender,
+	}
+
+	command, _ := json.Marshal(map[string]interface{}{
+		"command": map[string]string{
+			"command":          "push",
+			"push_type":        "web",
+			"webpush_endpoint": pushService.URL + "/push/abc",
+			"webpush_p256dh":   base64.RawURLEncoding.EncodeToString(uaPrivate.PublicKey().Bytes()),
+			"webpush_auth":     base64.RawURLEncoding.EncodeToString(authSecret),
+			"webpush_ttl":      "60",
+			"webpush_urgency":  "high",
+		},
+		"message": map[string]interface{}{
+			"event": "foobaz",
+			"data":  map[string]interface{}{"message_text": "foobar"},
+			"time":  1234,
+		},
+	})
+
+	msg := new(CommandMsg)
+	json.Unmarshal(command, &msg)
+	msg.FromRedis(server)
+
+	if len(requests) != 1 {
+		t.Fatalf("Expected one request to the push service, instead %d", len(requests))
+	}
+
+	for header, expected := range map[string]string{
+		"Content-Encoding": "aes128gcm",
+		"TTL":              "60",
+		"Urgency":          "high",
+	} {
+		if requests[0].Header.Get(header) != expected {
+			t.Fatalf("Expected %s to be %q, instead %q", header, expected, requests[0].Header.Get(header))
+		}
+	}
+
+	verifyTestVAPID(t, requests[0].Header.Get("Authorization"), pushService.URL)
+
+	var pushed Message
+	json.Unmarshal(decryptTestWebPush(t, uaPrivate, authSecret, bodies[0]), &pushed)
+	if pushed.Event != "foobaz" || pushed.Data["message_text"] != "foobar" {
+		t.Fatalf("Expected the message to be pushed, instead %+v", pushed)
+	}
+
+	sub := &WebPushSubscription{
+		Endpoint: pushService.URL + "/push/expired",
+		P256dh:   base64.RawURLEncoding.EncodeToString(uaPrivate.PublicKey().Bytes()),
+		Auth:     base64.RawURLEncoding.EncodeToString(authSecret),
+	}
+
+	if status, err := sender.Send(sub, []byte("{}"), WebPushOptions{}); err == nil || status != http.StatusGone {
+		t.Fatalf("Expected an expired subscription to fail with 410, instead %d (%v)", status, err)
+	}
+
+	if _, err := sender.Send(sub, make([]byte, webPushMaxPayload+1), WebPushOptions{}); err != errWebPushPayloadTooLarge {
+		t.Fatalf("Expected an oversized payload to be rejected, instead %v", err)
+	}
+}